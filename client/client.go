@@ -29,10 +29,27 @@ type Client interface {
 	// `laddr` is a local bind address, a local address is automatically chosen if nil.
 	ListenUDP(laddr *net.UDPAddr) (net.PacketConn, error)
 
+	// ListenUDPOverTCP relays UDP packets though a Shadowsocks proxy, carrying them
+	// over a single TCP connection for networks that block or throttle UDP.
+	// `laddr` is a local bind address, a local address is automatically chosen if nil.
+	ListenUDPOverTCP(laddr *net.TCPAddr) (net.PacketConn, error)
+
+	// DialMux connects to the Shadowsocks proxy over TCP, and returns a session
+	// that multiplexes many TCP connections over that single connection.
+	// `laddr` is a local bind address, a local address is automatically chosen if nil.
+	DialMux(laddr *net.TCPAddr) (MuxSession, error)
+
 	// SetTCPSaltGenerator controls the SaltGenerator used for TCP upstream.
 	// `salter` may be `nil`.
 	// This method is not thread-safe.
 	SetTCPSaltGenerator(ss.SaltGenerator)
+
+	// SetTCPFastOpen controls whether TCP connections to the proxy use TCP Fast
+	// Open, so that the salt, target address and initial payload are sent in the
+	// SYN.  It falls back to a regular handshake if the platform or kernel
+	// doesn't support it.
+	// This method is not thread-safe.
+	SetTCPFastOpen(enabled bool)
 }
 
 // NewClient creates a client that routes connections to a Shadowsocks proxy listening at
@@ -57,12 +74,18 @@ type ssClient struct {
 	proxyPort int
 	cipher    *ss.Cipher
 	salter    ss.SaltGenerator
+	// If true, TCP connections to the proxy use TCP Fast Open.
+	tcpFastOpen bool
 }
 
 func (c *ssClient) SetTCPSaltGenerator(salter ss.SaltGenerator) {
 	c.salter = salter
 }
 
+func (c *ssClient) SetTCPFastOpen(enabled bool) {
+	c.tcpFastOpen = enabled
+}
+
 // This code contains an optimization to send the initial client payload along with
 // the Shadowsocks handshake.  This saves one packet during connection, and also
 // reduces the distinctiveness of the connection pattern.
@@ -81,7 +104,14 @@ func (c *ssClient) DialTCP(laddr *net.TCPAddr, raddr string) (onet.TCPConn, erro
 		return nil, errors.New("Failed to parse target address")
 	}
 	proxyAddr := &net.TCPAddr{IP: c.proxyIP, Port: c.proxyPort}
-	proxyConn, err := net.DialTCP("tcp", laddr, proxyAddr)
+	var proxyConn *net.TCPConn
+	var err error
+	if c.tcpFastOpen {
+		// The lazy write below lets the first flush ride in the SYN.
+		proxyConn, err = onet.DialTCPFastOpen(laddr, proxyAddr)
+	} else {
+		proxyConn, err = net.DialTCP("tcp", laddr, proxyAddr)
+	}
 	if err != nil {
 		return nil, err
 	}
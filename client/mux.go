@@ -0,0 +1,96 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"net"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/xtaci/smux"
+)
+
+// MuxSession carries many logical TCP connections over a single Shadowsocks
+// TCP connection, saving a handshake with the proxy for each of them.
+type MuxSession interface {
+	// DialTCP opens a new stream to `raddr` over the shared connection.
+	// `raddr` has the form `host:port`, where `host` can be a domain name or IP address.
+	// Streams don't support half-close: CloseWrite returns an error, and Close
+	// shuts down both directions.
+	DialTCP(raddr string) (onet.TCPConn, error)
+	// NumStreams returns the number of open streams.
+	NumStreams() int
+	// IsClosed returns true once the shared connection is closed.  A closed
+	// session can't open new streams, so callers should dial a new one.
+	IsClosed() bool
+	// Close closes the shared connection and all of its streams.
+	Close() error
+}
+
+func (c *ssClient) DialMux(laddr *net.TCPAddr) (MuxSession, error) {
+	proxyConn, err := c.DialTCP(laddr, ss.MuxTargetAddr)
+	if err != nil {
+		return nil, err
+	}
+	session, err := smux.Client(proxyConn, ss.NewMuxConfig())
+	if err != nil {
+		proxyConn.Close()
+		return nil, err
+	}
+	return &muxSession{session}, nil
+}
+
+type muxSession struct {
+	*smux.Session
+}
+
+func (s *muxSession) DialTCP(raddr string) (onet.TCPConn, error) {
+	socksTargetAddr := socks.ParseAddr(raddr)
+	if socksTargetAddr == nil {
+		return nil, errors.New("Failed to parse target address")
+	}
+	stream, err := s.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(socksTargetAddr); err != nil {
+		stream.Close()
+		return nil, errors.New("Failed to write target address")
+	}
+	return &muxStream{stream}, nil
+}
+
+// errMuxHalfClose is returned by muxStream.CloseWrite.  Once both sides of an
+// smux stream have sent FIN, the library drops any data the reader hasn't
+// consumed yet, so the client never half-closes and leaves that to the server.
+var errMuxHalfClose = errors.New("half-close is not supported on multiplexed streams")
+
+type muxStream struct {
+	*smux.Stream
+}
+
+func (s *muxStream) CloseRead() error {
+	return nil
+}
+
+func (s *muxStream) CloseWrite() error {
+	return errMuxHalfClose
+}
+
+func (s *muxStream) SetKeepAlive(bool) error {
+	return nil
+}
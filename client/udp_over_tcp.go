@@ -0,0 +1,88 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func (c *ssClient) ListenUDPOverTCP(laddr *net.TCPAddr) (net.PacketConn, error) {
+	proxyConn, err := c.DialTCP(laddr, ss.UDPOverTCPTargetAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &streamPacketConn{TCPConn: proxyConn}, nil
+}
+
+// streamPacketConn is a net.PacketConn that carries datagrams over a
+// Shadowsocks TCP connection, framed as described in ss.UDPOverTCPTargetAddr.
+type streamPacketConn struct {
+	onet.TCPConn
+	readMu  sync.Mutex // Serializes reads of whole frames.
+	writeMu sync.Mutex // Serializes writes of whole frames.
+}
+
+// WriteTo encrypts `b` and writes to `addr` through the proxy.
+func (c *streamPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	socksTargetAddr := socks.ParseAddr(addr.String())
+	if socksTargetAddr == nil {
+		return 0, errors.New("Failed to parse target address")
+	}
+	lazySlice := udpPool.LazySlice()
+	frameBuf := lazySlice.Acquire()
+	defer lazySlice.Release()
+	frameLen := ss.UDPOverTCPFrameHeaderSize + len(socksTargetAddr) + len(b)
+	if frameLen > len(frameBuf) {
+		return 0, errors.New("Packet is too large")
+	}
+	copy(frameBuf[ss.UDPOverTCPFrameHeaderSize:], socksTargetAddr)
+	copy(frameBuf[ss.UDPOverTCPFrameHeaderSize+len(socksTargetAddr):], b)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := ss.WriteUDPOverTCPFrame(c.TCPConn, frameBuf[:frameLen]); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom reads the next datagram from the proxy into `b`.
+func (c *streamPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	lazySlice := udpPool.LazySlice()
+	datagramBuf := lazySlice.Acquire()
+	defer lazySlice.Release()
+	c.readMu.Lock()
+	buf, err := ss.ReadUDPOverTCPFrame(c.TCPConn, datagramBuf)
+	c.readMu.Unlock()
+	if err != nil {
+		return 0, nil, err
+	}
+	socksSrcAddr := socks.SplitAddr(buf)
+	if socksSrcAddr == nil {
+		return 0, nil, errors.New("Failed to read source address")
+	}
+	srcAddr := NewAddr(socksSrcAddr.String(), "udp")
+	n := copy(b, buf[len(socksSrcAddr):]) // Strip the SOCKS source address
+	if len(b) < len(buf)-len(socksSrcAddr) {
+		return n, srcAddr, io.ErrShortBuffer
+	}
+	return n, srcAddr, nil
+}
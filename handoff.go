@@ -0,0 +1,252 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A running server can hand its sockets off to a new process, so that an
+// upgrade doesn't refuse connections while the new binary starts.  The sockets
+// are passed as inherited file descriptors, starting at 3, and described by
+// environment variables.
+const (
+	// socketsEnv names the inherited sockets in descriptor order, e.g.
+	// "tcp/9000,udp/9000".
+	socketsEnv = "OUTLINE_SS_SERVER_SOCKETS"
+	// readyFDEnv holds the descriptor of a pipe.  The new process writes to it
+	// once it is serving, so that the old one can start draining.
+	readyFDEnv = "OUTLINE_SS_SERVER_READY_FD"
+	// replayFDEnv holds the descriptor of a pipe, if the replay snapshots are
+	// enabled.  The old process writes its replay cache to it once it stops
+	// accepting connections, and again when it exits, so that the new one
+	// learns the handshakes it saw after the last snapshot.
+	replayFDEnv = "OUTLINE_SS_SERVER_REPLAY_FD"
+)
+
+// firstInheritedFD is the descriptor of the first entry of exec.Cmd.ExtraFiles.
+const firstInheritedFD = 3
+
+// handoffTimeout is how long to wait for the new process to start serving.
+const handoffTimeout = 30 * time.Second
+
+func socketName(network string, portNum int) string {
+	return fmt.Sprintf("%s/%d", network, portNum)
+}
+
+// loadInheritedSockets returns the sockets handed off by the parent process,
+// keyed by socket name.  It returns nil if this process wasn't started by a
+// handoff.
+func loadInheritedSockets() map[string]*os.File {
+	names := os.Getenv(socketsEnv)
+	os.Unsetenv(socketsEnv)
+	if names == "" {
+		return nil
+	}
+	sockets := make(map[string]*os.File)
+	for i, name := range strings.Split(names, ",") {
+		fd := firstInheritedFD + i
+		sockets[name] = os.NewFile(uintptr(fd), name)
+	}
+	return sockets
+}
+
+// loadInheritedReplayCache returns the pipe of the replay cache of the parent
+// process, or nil if there is none.
+func loadInheritedReplayCache() *os.File {
+	fdStr := os.Getenv(replayFDEnv)
+	os.Unsetenv(replayFDEnv)
+	if fdStr == "" {
+		return nil
+	}
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		logger.Errorf("Invalid %v: %v", replayFDEnv, err)
+		return nil
+	}
+	return os.NewFile(uintptr(fd), "replay")
+}
+
+// notifyReady tells the parent process, if any, that this process is serving.
+func notifyReady() error {
+	fdStr := os.Getenv(readyFDEnv)
+	os.Unsetenv(readyFDEnv)
+	if fdStr == "" {
+		return nil
+	}
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return fmt.Errorf("Invalid %v: %v", readyFDEnv, err)
+	}
+	pipe := os.NewFile(uintptr(fd), "ready")
+	defer pipe.Close()
+	_, err = pipe.Write([]byte{1})
+	return err
+}
+
+func (s *SSServer) takeInherited(network string, portNum int) *os.File {
+	name := socketName(network, portNum)
+	f, ok := s.inherited[name]
+	if !ok {
+		return nil
+	}
+	delete(s.inherited, name)
+	return f
+}
+
+func (s *SSServer) listenTCP(portNum int) (*net.TCPListener, error) {
+	f := s.takeInherited("tcp", portNum)
+	if f == nil {
+		return net.ListenTCP("tcp", &net.TCPAddr{Port: portNum})
+	}
+	defer f.Close()
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	tcpListener, ok := listener.(*net.TCPListener)
+	if !ok {
+		listener.Close()
+		return nil, fmt.Errorf("Inherited socket %v is not a TCP listener", f.Name())
+	}
+	logger.Infof("Using inherited TCP listener on port %v", portNum)
+	return tcpListener, nil
+}
+
+func (s *SSServer) listenUDP(portNum int) (*net.UDPConn, error) {
+	f := s.takeInherited("udp", portNum)
+	if f == nil {
+		return net.ListenUDP("udp", &net.UDPAddr{Port: portNum})
+	}
+	defer f.Close()
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("Inherited socket %v is not a UDP socket", f.Name())
+	}
+	logger.Infof("Using inherited UDP socket on port %v", portNum)
+	return udpConn, nil
+}
+
+// closeUnusedInheritedSockets closes the inherited sockets of ports that are no
+// longer in the config.
+func (s *SSServer) closeUnusedInheritedSockets() {
+	for name, f := range s.inherited {
+		logger.Infof("Closing unused inherited socket %v", name)
+		f.Close()
+	}
+	s.inherited = nil
+}
+
+// Handoff starts a new process from the current executable, with the same
+// arguments, and passes it the sockets of all ports.  It returns once the new
+// process is serving, after which the caller should drain this one.
+func (s *SSServer) Handoff() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// The port map must not change until the new process has its sockets.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	var files []*os.File
+	defer func() {
+		// The new process has its own copies.
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for portNum, port := range s.ports {
+		tcpFile, err := port.tcpListener.File()
+		if err != nil {
+			return fmt.Errorf("Failed to get TCP listener on port %v: %v", portNum, err)
+		}
+		names = append(names, socketName("tcp", portNum))
+		files = append(files, tcpFile)
+		udpFile, err := port.packetConn.File()
+		if err != nil {
+			return fmt.Errorf("Failed to get UDP socket on port %v: %v", portNum, err)
+		}
+		names = append(names, socketName("udp", portNum))
+		files = append(files, udpFile)
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+	defer readyWriter.Close()
+	extraFiles := append(files, readyWriter)
+	env := []string{
+		socketsEnv + "=" + strings.Join(names, ","),
+		readyFDEnv + "=" + strconv.Itoa(firstInheritedFD+len(names)),
+	}
+	var replayWriter *os.File
+	defer func() {
+		if replayWriter != nil && replayWriter != s.replayHandoff {
+			replayWriter.Close()
+		}
+	}()
+	if s.replaySnapshotStop != nil {
+		// Let the new process load the latest handshakes, and send it the
+		// later ones when draining.
+		s.saveReplaySnapshot()
+		var replayReader *os.File
+		replayReader, replayWriter, err = os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer replayReader.Close()
+		env = append(env, replayFDEnv+"="+strconv.Itoa(firstInheritedFD+len(extraFiles)))
+		extraFiles = append(extraFiles, replayReader)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = extraFiles
+	cmd.Env = append(os.Environ(), env...)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Failed to start new process: %v", err)
+	}
+	go cmd.Wait()
+	// Close our end, so that the read fails if the new process exits early.
+	readyWriter.Close()
+
+	readyReader.SetReadDeadline(time.Now().Add(handoffTimeout))
+	if n, err := readyReader.Read(make([]byte, 1)); n == 0 {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			cmd.Process.Kill()
+		}
+		return fmt.Errorf("New process %v didn't start serving: %v", cmd.Process.Pid, err)
+	}
+	logger.Infof("New process %v is serving", cmd.Process.Pid)
+	// The new process saves the replay snapshots from now on.
+	s.stopReplaySnapshots()
+	s.replayHandoff = replayWriter
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestInheritedSockets(t *testing.T) {
+	// Bind the first port of the config, as a previous process would have.
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: 9000})
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+	defer listener.Close()
+	tcpFile, err := listener.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: 9000})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %v", err)
+	}
+	defer packetConn.Close()
+	udpFile, err := packetConn.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unusedListener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: 0})
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+	defer unusedListener.Close()
+	unusedFile, err := unusedListener.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := metrics.NewPrometheusShadowsocksMetrics(nil, prometheus.NewRegistry())
+	// Opening new sockets on port 9000 would fail, because it's in use.
+	server, err := RunSSServer("config_example.yml", 30*time.Second, m, 10000, &ServerOptions{
+		InheritedSockets: map[string]*os.File{
+			"tcp/9000": tcpFile,
+			"udp/9000": udpFile,
+			"tcp/1":    unusedFile,
+		},
+	})
+	if err != nil {
+		t.Fatalf("RunSSServer() error = %v", err)
+	}
+	if server.ports[9000].tcpListener.Addr().String() != listener.Addr().String() {
+		t.Errorf("Wrong TCP listener: %v", server.ports[9000].tcpListener.Addr())
+	}
+	if server.inherited != nil {
+		t.Errorf("Inherited sockets left over: %v", server.inherited)
+	}
+	if _, err := unusedFile.Stat(); err == nil {
+		t.Error("Unused inherited socket wasn't closed")
+	}
+	if err := server.Stop(); err != nil {
+		t.Errorf("Error while stopping server: %v", err)
+	}
+}
+
+func TestReplayHandoff(t *testing.T) {
+	snapshotFile := filepath.Join(t.TempDir(), "replay.snapshot")
+	options := &ServerOptions{ReplaySnapshotFile: snapshotFile, ReplaySnapshotInterval: time.Hour}
+	m := metrics.NewPrometheusShadowsocksMetrics(nil, prometheus.NewRegistry())
+	server, err := RunSSServer("config_example.yml", 30*time.Second, m, 10000, options)
+	if err != nil {
+		t.Fatalf("RunSSServer() error = %v", err)
+	}
+	// What Handoff does once the new process is serving.
+	server.saveReplaySnapshot()
+	server.stopReplaySnapshots()
+	replayReader, replayWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.replayHandoff = replayWriter
+	// A handshake after the snapshot that the new process loads.
+	salt := []byte("0123456789abcdef")
+	if !server.replayCache.Add("user-0", salt) {
+		t.Fatal("New salt rejected")
+	}
+	if err := server.Drain(0); err != nil {
+		t.Errorf("Error while draining server: %v", err)
+	}
+	if server.replayHandoff != nil {
+		t.Error("Drain didn't close the replay handoff")
+	}
+
+	m = metrics.NewPrometheusShadowsocksMetrics(nil, prometheus.NewRegistry())
+	server, err = RunSSServer("config_example.yml", 30*time.Second, m, 10000, options)
+	if err != nil {
+		t.Fatalf("RunSSServer() error = %v", err)
+	}
+	defer server.Drain(0)
+	server.mergeInheritedReplayCache(replayReader)
+	if server.replayCache.Add("user-0", salt) {
+		t.Error("Salt from the old process was accepted")
+	}
+}
+
+func TestLoadInheritedSocketsWithoutParent(t *testing.T) {
+	if sockets := loadInheritedSockets(); sockets != nil {
+		t.Errorf("Unexpected inherited sockets: %v", sockets)
+	}
+	if pipe := loadInheritedReplayCache(); pipe != nil {
+		t.Errorf("Unexpected inherited replay cache: %v", pipe.Name())
+	}
+	if err := notifyReady(); err != nil {
+		t.Errorf("notifyReady failed: %v", err)
+	}
+}
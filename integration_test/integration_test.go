@@ -16,6 +16,7 @@ package integration_test
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"net"
 	"strconv"
@@ -164,10 +165,183 @@ func TestTCPEcho(t *testing.T) {
 	echoRunning.Wait()
 }
 
+func TestTCPIdleTimeout(t *testing.T) {
+	echoListener, echoRunning := startTCPEchoServer(t)
+
+	proxyListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err, "ListenTCP failed")
+	secrets := ss.MakeTestSecrets(1)
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	const testTimeout = 200 * time.Millisecond
+	testMetrics := &statusMetrics{}
+	proxy := service.NewTCPService(cipherList, nil, testMetrics, testTimeout, &service.TCPServiceOptions{
+		TargetIPValidator: allowAll,
+		IdleTimeout:       300 * time.Millisecond,
+	})
+	go proxy.Serve(onet.AdaptListener(proxyListener))
+
+	proxyHost, proxyPort, err := net.SplitHostPort(proxyListener.Addr().String())
+	require.NoError(t, err)
+	portNum, err := strconv.Atoi(proxyPort)
+	require.NoError(t, err)
+	client, err := client.NewClient(proxyHost, portNum, secrets[0], ss.TestCipher)
+	require.NoError(t, err, "Failed to create ShadowsocksClient")
+	conn, err := client.DialTCP(nil, echoListener.Addr().String())
+	require.NoError(t, err, "ShadowsocksClient.DialTCP failed")
+
+	// Traffic keeps the connection open past the idle timeout.
+	buf := make([]byte, 10)
+	for i := 0; i < 3; i++ {
+		_, err = conn.Write(buf)
+		require.NoError(t, err)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Once idle, the server closes the connection.
+	start := time.Now()
+	_, err = conn.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	conn.Close()
+
+	proxy.GracefulStop()
+	echoListener.Close()
+	echoRunning.Wait()
+	assert.Equal(t, []string{"ERR_IDLE_TIMEOUT"}, testMetrics.statuses)
+}
+
+func TestTCPCloseConnections(t *testing.T) {
+	echoListener, echoRunning := startTCPEchoServer(t)
+
+	proxyListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err, "ListenTCP failed")
+	secrets := ss.MakeTestSecrets(1)
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	const testTimeout = 200 * time.Millisecond
+	testMetrics := &statusMetrics{}
+	proxy := service.NewTCPService(cipherList, nil, testMetrics, testTimeout)
+	proxy.SetTargetIPValidator(allowAll)
+	go proxy.Serve(onet.AdaptListener(proxyListener))
+
+	proxyHost, proxyPort, err := net.SplitHostPort(proxyListener.Addr().String())
+	require.NoError(t, err)
+	portNum, err := strconv.Atoi(proxyPort)
+	require.NoError(t, err)
+	client, err := client.NewClient(proxyHost, portNum, secrets[0], ss.TestCipher)
+	require.NoError(t, err, "Failed to create ShadowsocksClient")
+	conn, err := client.DialTCP(nil, echoListener.Addr().String())
+	require.NoError(t, err, "ShadowsocksClient.DialTCP failed")
+	buf := make([]byte, 10)
+	_, err = conn.Write(buf)
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	// Stopping the service leaves existing connections open.
+	require.NoError(t, proxy.Stop())
+	assert.Equal(t, 1, proxy.ActiveConnections())
+	_, err = conn.Write(buf)
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	proxy.CloseConnections()
+	_, err = conn.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	conn.Close()
+
+	proxy.GracefulStop()
+	assert.Equal(t, 0, proxy.ActiveConnections())
+	echoListener.Close()
+	echoRunning.Wait()
+	assert.Equal(t, []string{"ERR_SHUTDOWN"}, testMetrics.statuses)
+}
+
+func TestTCPMuxEcho(t *testing.T) {
+	echoListener, echoRunning := startTCPEchoServer(t)
+
+	proxyListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err, "ListenTCP failed: %v", err)
+	secrets := ss.MakeTestSecrets(1)
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	testMetrics := &statusMetrics{}
+	const testTimeout = 200 * time.Millisecond
+	proxy := service.NewTCPService(cipherList, nil, testMetrics, testTimeout, &service.TCPServiceOptions{Mux: true})
+	proxy.SetTargetIPValidator(allowAll)
+	go proxy.Serve(onet.AdaptListener(proxyListener))
+
+	proxyHost, proxyPort, err := net.SplitHostPort(proxyListener.Addr().String())
+	require.NoError(t, err)
+	portNum, err := strconv.Atoi(proxyPort)
+	require.NoError(t, err)
+	client, err := client.NewClient(proxyHost, portNum, secrets[0], ss.TestCipher)
+	require.NoError(t, err, "Failed to create ShadowsocksClient")
+	session, err := client.DialMux(nil)
+	require.NoError(t, err, "ShadowsocksClient.DialMux failed")
+
+	const numStreams = 10
+	var streams sync.WaitGroup
+	for i := 0; i < numStreams; i++ {
+		streams.Add(1)
+		go func(i int) {
+			defer streams.Done()
+			conn, err := session.DialTCP(echoListener.Addr().String())
+			if !assert.NoError(t, err, "MuxSession.DialTCP failed") {
+				return
+			}
+			defer conn.Close()
+			up := bytes.Repeat([]byte{byte(i)}, 1000)
+			_, err = conn.Write(up)
+			assert.NoError(t, err)
+			assert.Error(t, conn.CloseWrite(), "Multiplexed streams don't support half-close")
+			down := make([]byte, len(up))
+			_, err = io.ReadFull(conn, down)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(up, down), "Echo mismatch on stream %d", i)
+		}(i)
+	}
+	streams.Wait()
+	assert.Equal(t, 0, session.NumStreams())
+
+	// Multiplexed streams still honor the target IP validator.
+	proxy.SetTargetIPValidator(onet.RequirePublicIP)
+	conn, err := session.DialTCP(echoListener.Addr().String())
+	require.NoError(t, err)
+	n, err := conn.Read(make([]byte, 10))
+	assert.Equal(t, 0, n, "Server should close the stream on rejected address")
+	assert.Equal(t, io.EOF, err)
+	conn.Close()
+
+	require.NoError(t, session.Close())
+	proxy.GracefulStop()
+	echoListener.Close()
+	echoRunning.Wait()
+	// The whole session is reported as a single connection, and each stream
+	// with its own status.
+	assert.Equal(t, []string{"OK"}, testMetrics.statuses)
+	expectedStreams := []string{"ERR_ADDRESS_INVALID"}
+	for i := 0; i < numStreams; i++ {
+		expectedStreams = append(expectedStreams, "OK")
+	}
+	assert.ElementsMatch(t, expectedStreams, testMetrics.streamStatuses)
+}
+
 type statusMetrics struct {
 	metrics.NoOpMetrics
 	sync.Mutex
-	statuses []string
+	statuses       []string
+	streamStatuses []string
+}
+
+func (m *statusMetrics) AddTCPMuxStream(accessKey, status string) {
+	m.Lock()
+	m.streamStatuses = append(m.streamStatuses, status)
+	m.Unlock()
 }
 
 func (m *statusMetrics) AddClosedTCPConnection(clientLocation, accessKey, status string, data metrics.ProxyMetrics, timeToCipher, duration time.Duration) {
@@ -246,12 +420,15 @@ func (m *fakeUDPMetrics) AddUDPPacketFromClient(clientLocation, accessKey, statu
 func (m *fakeUDPMetrics) AddUDPPacketFromTarget(clientLocation, accessKey, status string, targetProxyBytes, proxyClientBytes int) {
 	m.down = append(m.down, udpRecord{clientLocation, accessKey, status, targetProxyBytes, proxyClientBytes})
 }
-func (m *fakeUDPMetrics) AddUDPNatEntry() {
+func (m *fakeUDPMetrics) AddUDPNatEntry(accessKey string) {
 	m.natAdded++
 }
-func (m *fakeUDPMetrics) RemoveUDPNatEntry() {
+func (m *fakeUDPMetrics) RemoveUDPNatEntry(accessKey string) {
 	// Not tested because it requires waiting for a long timeout.
 }
+func (m *fakeUDPMetrics) AddClosedUDPSession(clientLocation, accessKey string, data metrics.UDPSessionMetrics, duration time.Duration) {
+	// Not tested for the same reason.
+}
 
 func TestUDPEcho(t *testing.T) {
 	echoConn, echoRunning := startUDPEchoServer(t)
@@ -350,6 +527,180 @@ func TestUDPEcho(t *testing.T) {
 	}
 }
 
+// startUDPProxy serves a single key on a localhost UDP socket, and returns a
+// client for it.
+func startUDPProxy(t testing.TB, opts *service.UDPServiceOptions) (service.UDPService, client.Client) {
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %v", err)
+	}
+	secrets := ss.MakeTestSecrets(1)
+	cipherList, err := service.MakeTestCiphers(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := service.NewUDPService(time.Hour, cipherList, &metrics.NoOpMetrics{}, opts)
+	proxy.SetTargetIPValidator(allowAll)
+	go proxy.Serve(proxyConn)
+
+	proxyAddr := proxyConn.LocalAddr().(*net.UDPAddr)
+	client, err := client.NewClient(proxyAddr.IP.String(), proxyAddr.Port, secrets[0], ss.TestCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	return proxy, client
+}
+
+func TestUDPEchoMultipleReaders(t *testing.T) {
+	testUDPEchoConcurrent(t, &service.UDPServiceOptions{NumReaders: 4})
+}
+
+func TestUDPEchoBatchIO(t *testing.T) {
+	testUDPEchoConcurrent(t, &service.UDPServiceOptions{NumReaders: 2, BatchIO: true})
+}
+
+// testUDPEchoConcurrent echoes datagrams from several clients at once.
+func testUDPEchoConcurrent(t *testing.T, opts *service.UDPServiceOptions) {
+	echoConn, echoRunning := startUDPEchoServer(t)
+	proxy, client := startUDPProxy(t, opts)
+
+	const numClients = 8
+	const numPackets = 20
+	var wg sync.WaitGroup
+	for i := 0; i < numClients; i++ {
+		conn, err := client.ListenUDP(nil)
+		if err != nil {
+			t.Fatalf("ShadowsocksClient.ListenUDP failed: %v", err)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer conn.Close()
+			// Each packet is echoed before the next one is sent, so all but the
+			// first use the NAT entry created for this client.
+			buf := make([]byte, 100)
+			for j := 0; j < numPackets; j++ {
+				up := []byte(fmt.Sprintf("client %d packet %d", i, j))
+				if _, err := conn.WriteTo(up, echoConn.LocalAddr()); err != nil {
+					t.Error(err)
+					return
+				}
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				n, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(up, buf[:n]) {
+					t.Errorf("Echo mismatch: %q != %q", up, buf[:n])
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	proxy.GracefulStop()
+	echoConn.Close()
+	echoRunning.Wait()
+}
+
+func TestUDPDrain(t *testing.T) {
+	targetConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	defer targetConn.Close()
+	proxy, client := startUDPProxy(t, &service.UDPServiceOptions{})
+	conn, err := client.ListenUDP(nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.WriteTo([]byte("request"), targetConn.LocalAddr())
+	require.NoError(t, err)
+	buf := make([]byte, 100)
+	targetConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, natAddr, err := targetConn.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "request", string(buf[:n]))
+
+	// The NAT entry keeps relaying replies after the service stops reading.
+	require.NoError(t, proxy.Drain())
+	require.Equal(t, 1, proxy.ActiveNATEntries())
+	_, err = targetConn.WriteTo([]byte("reply"), natAddr)
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err = conn.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "reply", string(buf[:n]))
+
+	// New packets from the client aren't forwarded.
+	_, err = conn.WriteTo([]byte("dropped"), targetConn.LocalAddr())
+	require.NoError(t, err)
+	targetConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = targetConn.ReadFrom(buf)
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	require.True(t, netErr.Timeout())
+
+	require.NoError(t, proxy.GracefulStop())
+	require.Equal(t, 0, proxy.ActiveNATEntries())
+}
+
+func TestUDPOverTCPEcho(t *testing.T) {
+	echoConn, echoRunning := startUDPEchoServer(t)
+
+	proxyListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err, "ListenTCP failed")
+	secrets := ss.MakeTestSecrets(1)
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	replayCache := service.NewReplayCache(5)
+	const testTimeout = 200 * time.Millisecond
+	testMetrics := &statusMetrics{}
+	proxy := service.NewTCPService(cipherList, &replayCache, testMetrics, testTimeout)
+	proxy.SetTargetIPValidator(allowAll)
+	go proxy.Serve(onet.AdaptListener(proxyListener))
+
+	proxyHost, proxyPort, err := net.SplitHostPort(proxyListener.Addr().String())
+	require.NoError(t, err)
+	portNum, err := strconv.Atoi(proxyPort)
+	require.NoError(t, err)
+	client, err := client.NewClient(proxyHost, portNum, secrets[0], ss.TestCipher)
+	require.NoError(t, err, "Failed to create ShadowsocksClient")
+	conn, err := client.ListenUDPOverTCP(nil)
+	require.NoError(t, err, "ShadowsocksClient.ListenUDPOverTCP failed")
+
+	const N = 1000
+	for i := 0; i < 3; i++ {
+		up := ss.MakeTestPayload(N)
+		n, err := conn.WriteTo(up, echoConn.LocalAddr())
+		require.NoError(t, err)
+		require.Equal(t, N, n)
+
+		down := make([]byte, N)
+		n, addr, err := conn.ReadFrom(down)
+		require.NoError(t, err)
+		require.Equal(t, N, n)
+		require.Equal(t, echoConn.LocalAddr().String(), addr.String())
+		require.True(t, bytes.Equal(up, down), "Echo mismatch")
+	}
+
+	// Datagrams to rejected targets are dropped without closing the connection.
+	proxy.SetTargetIPValidator(onet.RequirePublicIP)
+	_, err = conn.WriteTo([]byte("dropped"), echoConn.LocalAddr())
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err = conn.ReadFrom(make([]byte, N))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	require.True(t, netErr.Timeout())
+
+	conn.Close()
+	proxy.GracefulStop()
+	echoConn.Close()
+	echoRunning.Wait()
+	assert.Equal(t, []string{"OK"}, testMetrics.statuses)
+}
+
 func BenchmarkTCPThroughput(b *testing.B) {
 	echoListener, echoRunning := startTCPEchoServer(b)
 
@@ -591,3 +942,43 @@ func BenchmarkUDPManyKeys(b *testing.B) {
 	echoConn.Close()
 	echoRunning.Wait()
 }
+
+// Measures packets per second with many clients sending at once, for several
+// numbers of readers, with and without batched I/O.
+func BenchmarkUDPEchoParallel(b *testing.B) {
+	for _, opts := range []service.UDPServiceOptions{
+		{NumReaders: 1}, {NumReaders: 2}, {NumReaders: 4}, {NumReaders: 8},
+		{NumReaders: 1, BatchIO: true}, {NumReaders: 4, BatchIO: true},
+	} {
+		opts := opts
+		b.Run(fmt.Sprintf("readers=%d/batch=%v", opts.NumReaders, opts.BatchIO), func(b *testing.B) {
+			echoConn, echoRunning := startUDPEchoServer(b)
+			proxy, client := startUDPProxy(b, &opts)
+
+			const N = 1000
+			b.SetParallelism(4)
+			b.ResetTimer()
+			start := time.Now()
+			b.RunParallel(func(pb *testing.PB) {
+				conn, err := client.ListenUDP(nil)
+				if err != nil {
+					b.Errorf("ShadowsocksClient.ListenUDP failed: %v", err)
+					return
+				}
+				defer conn.Close()
+				buf := make([]byte, N)
+				for pb.Next() {
+					conn.WriteTo(buf, echoConn.LocalAddr())
+					conn.SetReadDeadline(time.Now().Add(time.Second))
+					conn.ReadFrom(buf)
+				}
+			})
+			b.StopTimer()
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "pps")
+
+			proxy.Stop()
+			echoConn.Close()
+			echoRunning.Wait()
+		})
+	}
+}
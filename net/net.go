@@ -54,6 +54,32 @@ func WrapConn(c TCPConn, r io.Reader, w io.Writer) TCPConn {
 	return &tcpConnAdaptor{TCPConn: conn, r: r, w: w}
 }
 
+type halfCloseConn interface {
+	net.Conn
+	CloseWrite() error
+}
+
+type halfCloseConnAdaptor struct {
+	halfCloseConn
+}
+
+func (c *halfCloseConnAdaptor) CloseRead() error {
+	return nil
+}
+
+func (c *halfCloseConnAdaptor) SetKeepAlive(bool) error {
+	return nil
+}
+
+// AdaptHalfCloseConn turns a connection that supports CloseWrite, such as a
+// multiplexed stream, into a TCPConn.  CloseRead and SetKeepAlive are no-ops.
+func AdaptHalfCloseConn(c interface {
+	net.Conn
+	CloseWrite() error
+}) TCPConn {
+	return &halfCloseConnAdaptor{c}
+}
+
 func copyOneWay(leftConn, rightConn TCPConn) (int64, error) {
 	n, err := io.Copy(leftConn, rightConn)
 	// Send FIN to indicate EOF
@@ -0,0 +1,107 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	First, Last int
+}
+
+// Contains reports whether `port` is in the range.
+func (r PortRange) Contains(port int) bool {
+	return port >= r.First && port <= r.Last
+}
+
+// ParsePortRange parses a port, like "443", or a range, like "8000-8999".
+func ParsePortRange(ports string) (PortRange, error) {
+	first, last, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		last = first
+	}
+	a, errA := strconv.Atoi(strings.TrimSpace(first))
+	b, errB := strconv.Atoi(strings.TrimSpace(last))
+	if errA != nil || errB != nil || a < 0 || b > 65535 || a > b {
+		return PortRange{}, fmt.Errorf("invalid port range %q", ports)
+	}
+	return PortRange{a, b}, nil
+}
+
+// blockedPortGroups are names for ports that are often blocked together.
+var blockedPortGroups = map[string][]PortRange{
+	// Mail submission, which hosting providers watch for spam.
+	"smtp": {{25, 25}, {465, 465}, {587, 587}},
+	// NetBIOS and SMB, which are targets of worms.
+	"netbios": {{137, 139}, {445, 445}},
+}
+
+// DefaultBlockedPorts is the egress blocklist when none is configured.
+var DefaultBlockedPorts = []string{"smtp"}
+
+// ParseBlockedPorts parses a list of ports, port ranges and the group names
+// "smtp" and "netbios".
+func ParseBlockedPorts(specs []string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, spec := range specs {
+		if group, ok := blockedPortGroups[strings.ToLower(spec)]; ok {
+			ranges = append(ranges, group...)
+			continue
+		}
+		r, err := ParsePortRange(spec)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// PortBlocklist holds the target ports that clients may not reach.  It can be
+// replaced while in use, so that it can be shared by services and reloaded.
+type PortBlocklist struct {
+	ranges atomic.Value // []PortRange
+}
+
+// NewPortBlocklist creates a PortBlocklist that blocks `ranges`.
+func NewPortBlocklist(ranges []PortRange) *PortBlocklist {
+	b := &PortBlocklist{}
+	b.Set(ranges)
+	return b
+}
+
+// Set replaces the blocked ports with `ranges`.
+func (b *PortBlocklist) Set(ranges []PortRange) {
+	b.ranges.Store(append([]PortRange(nil), ranges...))
+}
+
+// Check returns an error if `port` is blocked.  A nil PortBlocklist blocks
+// nothing.
+func (b *PortBlocklist) Check(port int) *ConnectionError {
+	if b == nil {
+		return nil
+	}
+	for _, r := range b.ranges.Load().([]PortRange) {
+		if r.Contains(port) {
+			return NewConnectionError("ERR_PORT_BLOCKED", fmt.Sprintf("Port is blocked: %v", port), nil)
+		}
+	}
+	return nil
+}
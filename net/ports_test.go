@@ -0,0 +1,84 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	for spec, expected := range map[string]PortRange{
+		"443":         {443, 443},
+		"8000-8999":   {8000, 8999},
+		" 0 - 65535 ": {0, 65535},
+	} {
+		r, err := ParsePortRange(spec)
+		if err != nil {
+			t.Errorf("ParsePortRange(%q) failed: %v", spec, err)
+		} else if r != expected {
+			t.Errorf("ParsePortRange(%q): expected %v, actual %v", spec, expected, r)
+		}
+	}
+	for _, spec := range []string{"", "http", "-1", "65536", "90-80", "1-2-3"} {
+		if _, err := ParsePortRange(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
+
+func TestParseBlockedPorts(t *testing.T) {
+	ranges, err := ParseBlockedPorts([]string{"SMTP", "netbios", "6660-6669"})
+	if err != nil {
+		t.Fatalf("ParseBlockedPorts failed: %v", err)
+	}
+	expected := []PortRange{{25, 25}, {465, 465}, {587, 587}, {137, 139}, {445, 445}, {6660, 6669}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("Expected %v, actual %v", expected, ranges)
+	}
+	if _, err := ParseBlockedPorts([]string{"ftp"}); err == nil {
+		t.Error("Expected error for unknown group")
+	}
+}
+
+func TestPortBlocklist(t *testing.T) {
+	ranges, _ := ParseBlockedPorts(DefaultBlockedPorts)
+	blocklist := NewPortBlocklist(ranges)
+	for _, port := range []int{25, 465, 587} {
+		if err := blocklist.Check(port); err == nil {
+			t.Errorf("Port %v should be blocked", port)
+		} else if err.Status != "ERR_PORT_BLOCKED" {
+			t.Errorf("Wrong status %s", err.Status)
+		}
+	}
+	for _, port := range []int{24, 80, 443, 445} {
+		if err := blocklist.Check(port); err != nil {
+			t.Errorf("Port %v should not be blocked: %v", port, err)
+		}
+	}
+
+	blocklist.Set([]PortRange{{445, 445}})
+	if err := blocklist.Check(25); err != nil {
+		t.Errorf("Port 25 should not be blocked after Set: %v", err)
+	}
+	if err := blocklist.Check(445); err == nil {
+		t.Error("Port 445 should be blocked after Set")
+	}
+
+	var nilBlocklist *PortBlocklist
+	if err := nilBlocklist.Check(25); err != nil {
+		t.Errorf("A nil blocklist should block nothing: %v", err)
+	}
+}
@@ -21,8 +21,45 @@ import (
 
 var privateNetworks []*net.IPNet
 
+// specialNetworks holds the special-purpose blocks of the IANA registries
+// that are not globally reachable, other than privateNetworks and the blocks
+// that IsGlobalUnicast already excludes.
+// See https://www.iana.org/assignments/iana-ipv4-special-registry and
+// https://www.iana.org/assignments/iana-ipv6-special-registry.
+var specialNetworks []*net.IPNet
+
+// reachableNetworks holds the globally reachable blocks inside
+// specialNetworks.
+var reachableNetworks []*net.IPNet
+
+// metadataAddresses holds the instance metadata services of cloud providers,
+// which are reachable from the server but must never be from clients.
+var metadataAddresses []net.IP
+
+var (
+	nat64Prefix  = mustParseCIDR("64:ff9b::/96")
+	sixToFour    = mustParseCIDR("2002::/16")
+	teredoPrefix = mustParseCIDR("2001::/32")
+)
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return subnet
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	subnets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		subnets = append(subnets, mustParseCIDR(cidr))
+	}
+	return subnets
+}
+
 func init() {
-	for _, cidr := range []string{
+	privateNetworks = parseCIDRs(
 		// RFC 1918: private IPv4 networks
 		"10.0.0.0/8",
 		"172.16.0.0/12",
@@ -31,33 +68,151 @@ func init() {
 		"fc00::/7",
 		// RFC 6598: reserved prefix for CGNAT
 		"100.64.0.0/10",
+	)
+
+	specialNetworks = parseCIDRs(
+		// RFC 791: "this network"
+		"0.0.0.0/8",
+		// RFC 6890: IETF protocol assignments, including DS-Lite and NAT64
+		// discovery
+		"192.0.0.0/24",
+		// RFC 5737: documentation
+		"192.0.2.0/24",
+		"198.51.100.0/24",
+		"203.0.113.0/24",
+		// RFC 7526: deprecated 6to4 relay anycast
+		"192.88.99.0/24",
+		// RFC 2544: benchmarking
+		"198.18.0.0/15",
+		// RFC 1112: reserved
+		"240.0.0.0/4",
+		// RFC 4291: deprecated IPv4-compatible addresses, including the
+		// unspecified and loopback addresses
+		"::/96",
+		// RFC 8215: local-use IPv4/IPv6 translation
+		"64:ff9b:1::/48",
+		// RFC 6666: discard-only
+		"100::/64",
+		// RFC 9780: dummy prefix
+		"100:0:0:1::/64",
+		// RFC 2928: IETF protocol assignments, including Teredo, benchmarking
+		// and the deprecated ORCHID
+		"2001::/23",
+		// RFC 3849 and RFC 9637: documentation
+		"2001:db8::/32",
+		"3fff::/20",
+		// RFC 9602: SRv6 SIDs
+		"5f00::/16",
+		// RFC 3879: deprecated site-local addresses
+		"fec0::/10",
+	)
+
+	reachableNetworks = parseCIDRs(
+		// RFC 7723 and RFC 8155: PCP and TURN anycast
+		"192.0.0.9/32",
+		"192.0.0.10/32",
+		"2001:1::1/128",
+		"2001:1::2/128",
+		// RFC 9665: DNS-SD SRP anycast
+		"2001:1::3/128",
+		// RFC 7450: AMT
+		"2001:3::/32",
+		// RFC 7535: AS112-v6
+		"2001:4:112::/48",
+		// RFC 7343 and RFC 9374: ORCHIDv2 and DRIP
+		"2001:20::/28",
+		"2001:30::/28",
+		// RFC 4380: Teredo, whose embedded addresses are checked instead
+		"2001::/32",
+	)
+
+	for _, ip := range []string{
+		// AWS, GCP, Azure, Oracle and others
+		"169.254.169.254",
+		"fd00:ec2::254",
+		// AWS ECS task metadata
+		"169.254.170.2",
+		// Azure wire server, which is a public address
+		"168.63.129.16",
+		// Alibaba Cloud
+		"100.100.100.200",
+		// Oracle Cloud
+		"192.0.0.192",
 	} {
-		_, subnet, _ := net.ParseCIDR(cidr)
-		privateNetworks = append(privateNetworks, subnet)
+		metadataAddresses = append(metadataAddresses, net.ParseIP(ip))
+	}
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
 	}
+	return false
 }
 
 // IsPrivateAddress returns whether an IP address belongs to the LAN.
 func IsPrivateAddress(ip net.IP) bool {
-	for _, network := range privateNetworks {
-		if network.Contains(ip) {
+	return containsIP(privateNetworks, ip)
+}
+
+// isSpecialAddress returns whether an IP address is in a special-purpose
+// block that is not globally reachable.
+func isSpecialAddress(ip net.IP) bool {
+	return containsIP(specialNetworks, ip) && !containsIP(reachableNetworks, ip)
+}
+
+func isMetadataAddress(ip net.IP) bool {
+	for _, metadata := range metadataAddresses {
+		if metadata.Equal(ip) {
 			return true
 		}
 	}
 	return false
 }
 
+// embeddedIPv4 returns the IPv4 addresses that traffic to the IPv6 address
+// `ip` reaches through a translator or tunnel: NAT64 (RFC 6052), 6to4
+// (RFC 3056), and the server and client of Teredo (RFC 4380).  IPv4-mapped
+// addresses are treated as IPv4 by the net package already.
+func embeddedIPv4(ip net.IP) []net.IP {
+	if ip.To4() != nil || len(ip) != net.IPv6len {
+		return nil
+	}
+	switch {
+	case nat64Prefix.Contains(ip):
+		return []net.IP{net.IPv4(ip[12], ip[13], ip[14], ip[15])}
+	case sixToFour.Contains(ip):
+		return []net.IP{net.IPv4(ip[2], ip[3], ip[4], ip[5])}
+	case teredoPrefix.Contains(ip):
+		server := net.IPv4(ip[4], ip[5], ip[6], ip[7])
+		client := net.IPv4(^ip[12], ^ip[13], ^ip[14], ^ip[15])
+		return []net.IP{server, client}
+	}
+	return nil
+}
+
 // TargetIPValidator is a type alias for checking if an IP is allowed.
 type TargetIPValidator = func(net.IP) *ConnectionError
 
 // RequirePublicIP returns an error if the destination IP is not a
-// standard public IP.
+// standard public IP.  IPv6 addresses that embed an IPv4 address must embed a
+// public one.
 func RequirePublicIP(ip net.IP) *ConnectionError {
 	if !ip.IsGlobalUnicast() {
 		return NewConnectionError("ERR_ADDRESS_INVALID", fmt.Sprintf("Address is not global unicast: %s", ip.String()), nil)
 	}
-	if IsPrivateAddress(ip) {
+	if IsPrivateAddress(ip) || isMetadataAddress(ip) {
 		return NewConnectionError("ERR_ADDRESS_PRIVATE", fmt.Sprintf("Address is private: %s", ip.String()), nil)
 	}
+	if isSpecialAddress(ip) {
+		return NewConnectionError("ERR_ADDRESS_INVALID", fmt.Sprintf("Address is reserved for special use: %s", ip.String()), nil)
+	}
+	for _, embedded := range embeddedIPv4(ip) {
+		if err := RequirePublicIP(embedded); err != nil {
+			return NewConnectionError(err.Status, fmt.Sprintf("Address %s embeds an invalid address: %s", ip.String(), err.Message), nil)
+		}
+	}
 	return nil
 }
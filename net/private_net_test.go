@@ -82,3 +82,119 @@ func TestRequirePublicIP(t *testing.T) {
 		t.Errorf("Wrong status %s", err.Status)
 	}
 }
+
+var publicIPTests = []struct {
+	address string
+	status  string // Empty if allowed.
+}{
+	// Public addresses.
+	{"8.8.8.8", ""},
+	{"1.1.1.1", ""},
+	{"2001:4860:4860::8888", ""},
+	{"2606:4700:4700::1111", ""},
+	{"::ffff:8.8.8.8", ""},
+	// Globally reachable blocks inside special-purpose ones.
+	{"192.0.0.9", ""},
+	{"192.0.0.10", ""},
+	{"2001:1::1", ""},
+	{"2001:3::1", ""},
+	{"2001:4:112::1", ""},
+	{"2001:20::1", ""},
+	// IPv4 special-purpose registry.
+	{"0.0.0.0", "ERR_ADDRESS_INVALID"},
+	{"0.1.2.3", "ERR_ADDRESS_INVALID"},
+	{"10.1.2.3", "ERR_ADDRESS_PRIVATE"},
+	{"100.64.0.1", "ERR_ADDRESS_PRIVATE"},
+	{"127.0.0.1", "ERR_ADDRESS_INVALID"},
+	{"169.254.1.1", "ERR_ADDRESS_INVALID"},
+	{"172.16.0.1", "ERR_ADDRESS_PRIVATE"},
+	{"192.0.0.1", "ERR_ADDRESS_INVALID"},
+	{"192.0.0.170", "ERR_ADDRESS_INVALID"},
+	{"192.0.2.1", "ERR_ADDRESS_INVALID"},
+	{"192.88.99.1", "ERR_ADDRESS_INVALID"},
+	{"192.168.1.1", "ERR_ADDRESS_PRIVATE"},
+	{"198.18.0.1", "ERR_ADDRESS_INVALID"},
+	{"198.19.255.255", "ERR_ADDRESS_INVALID"},
+	{"198.51.100.1", "ERR_ADDRESS_INVALID"},
+	{"203.0.113.1", "ERR_ADDRESS_INVALID"},
+	{"224.0.0.251", "ERR_ADDRESS_INVALID"},
+	{"240.0.0.1", "ERR_ADDRESS_INVALID"},
+	{"255.255.255.255", "ERR_ADDRESS_INVALID"},
+	// IPv6 special-purpose registry.
+	{"::", "ERR_ADDRESS_INVALID"},
+	{"::1", "ERR_ADDRESS_INVALID"},
+	{"::10.0.0.1", "ERR_ADDRESS_INVALID"},
+	{"::ffff:10.0.0.1", "ERR_ADDRESS_PRIVATE"},
+	{"::ffff:127.0.0.1", "ERR_ADDRESS_INVALID"},
+	{"64:ff9b:1::1", "ERR_ADDRESS_INVALID"},
+	{"100::1", "ERR_ADDRESS_INVALID"},
+	{"100:0:0:1::1", "ERR_ADDRESS_INVALID"},
+	{"2001:2::1", "ERR_ADDRESS_INVALID"},
+	{"2001:10::1", "ERR_ADDRESS_INVALID"},
+	{"2001:db8::1", "ERR_ADDRESS_INVALID"},
+	{"3fff::1", "ERR_ADDRESS_INVALID"},
+	{"5f00::1", "ERR_ADDRESS_INVALID"},
+	{"fc00::1", "ERR_ADDRESS_PRIVATE"},
+	{"fe80::1", "ERR_ADDRESS_INVALID"},
+	{"fec0::1", "ERR_ADDRESS_INVALID"},
+	{"ff02::fb", "ERR_ADDRESS_INVALID"},
+	// Cloud metadata services.
+	{"169.254.169.254", "ERR_ADDRESS_INVALID"},
+	{"fd00:ec2::254", "ERR_ADDRESS_PRIVATE"},
+	{"168.63.129.16", "ERR_ADDRESS_PRIVATE"},
+	{"192.0.0.192", "ERR_ADDRESS_PRIVATE"},
+	// NAT64 embeds the last 32 bits.
+	{"64:ff9b::8.8.8.8", ""},
+	{"64:ff9b::10.0.0.1", "ERR_ADDRESS_PRIVATE"},
+	{"64:ff9b::127.0.0.1", "ERR_ADDRESS_INVALID"},
+	{"64:ff9b::169.254.169.254", "ERR_ADDRESS_INVALID"},
+	// 6to4 embeds bits 16 to 47.
+	{"2002:808:808::1", ""},
+	{"2002:a00:1::1", "ERR_ADDRESS_PRIVATE"},
+	{"2002:c0a8:101::1", "ERR_ADDRESS_PRIVATE"},
+	{"2002:7f00:1::1", "ERR_ADDRESS_INVALID"},
+	// Teredo embeds the server, and the client with its bits inverted.
+	{"2001:0:808:808::f7f7:f7f7", ""},
+	{"2001:0:a00:1::f7f7:f7f7", "ERR_ADDRESS_PRIVATE"},
+	{"2001:0:808:808::f5ff:fffe", "ERR_ADDRESS_PRIVATE"},
+}
+
+func TestRequirePublicIPSpecialPurpose(t *testing.T) {
+	for _, tt := range publicIPTests {
+		ip := net.ParseIP(tt.address)
+		if ip == nil {
+			t.Fatalf("Invalid test address %s", tt.address)
+		}
+		err := RequirePublicIP(ip)
+		if tt.status == "" {
+			if err != nil {
+				t.Errorf("RequirePublicIP(%s): unexpected error %v", tt.address, err.Message)
+			}
+		} else if err == nil {
+			t.Errorf("RequirePublicIP(%s): expected %s", tt.address, tt.status)
+		} else if err.Status != tt.status {
+			t.Errorf("RequirePublicIP(%s): expected %s, actual %s", tt.address, tt.status, err.Status)
+		}
+	}
+}
+
+func TestEmbeddedIPv4(t *testing.T) {
+	for address, expected := range map[string][]string{
+		"64:ff9b::c000:221":                    {"192.0.2.33"},
+		"2002:c000:221::1":                     {"192.0.2.33"},
+		"2001:0:4136:e378:8000:63bf:3fff:fdd2": {"65.54.227.120", "192.0.2.45"},
+		"2001:4860:4860::8888":                 nil,
+		"8.8.8.8":                              nil,
+	} {
+		embedded := embeddedIPv4(net.ParseIP(address))
+		if len(embedded) != len(expected) {
+			t.Errorf("embeddedIPv4(%s): expected %v, actual %v", address, expected, embedded)
+			continue
+		}
+		for i, ip := range embedded {
+			if !ip.Equal(net.ParseIP(expected[i])) {
+				t.Errorf("embeddedIPv4(%s): expected %v, actual %v", address, expected, embedded)
+			}
+		}
+	}
+}
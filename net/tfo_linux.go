@@ -0,0 +1,68 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// tfoQueueLen is the maximum number of pending TCP Fast Open requests that
+// haven't completed the three-way handshake.
+const tfoQueueLen = 256
+
+// EnableTCPFastOpen enables TCP Fast Open on a listening socket, so that
+// clients can send data in the SYN.  The kernel only honors it if the
+// net.ipv4.tcp_fastopen sysctl allows server-side TFO; otherwise connections
+// proceed with a regular handshake.
+func EnableTCPFastOpen(listener *net.TCPListener) error {
+	rawConn, err := listener.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, tfoQueueLen)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// DialTCPFastOpen is like net.DialTCP, but asks the kernel to send the data
+// of the first write in the SYN.  Because the connection isn't established
+// until then, connection errors are reported by the first read or write.  If
+// the kernel refuses TCP Fast Open, it dials with a regular handshake.
+func DialTCPFastOpen(laddr, raddr *net.TCPAddr) (*net.TCPConn, error) {
+	dialer := net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				// Ignore the error, so that older kernels fall back to a regular connect.
+				unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+			})
+		},
+	}
+	if laddr != nil {
+		dialer.LocalAddr = laddr
+	}
+	conn, err := dialer.Dial("tcp", raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
@@ -0,0 +1,34 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package net
+
+import (
+	"errors"
+	"net"
+)
+
+// EnableTCPFastOpen enables TCP Fast Open on a listening socket.  It is only
+// supported on Linux.
+func EnableTCPFastOpen(listener *net.TCPListener) error {
+	return errors.New("TCP Fast Open is not supported on this platform")
+}
+
+// DialTCPFastOpen is like net.DialTCP.  TCP Fast Open is only supported on
+// Linux, so it always dials with a regular handshake.
+func DialTCPFastOpen(laddr, raddr *net.TCPAddr) (*net.TCPConn, error) {
+	return net.DialTCP("tcp", laddr, raddr)
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestTCPFastOpen(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+	defer listener.Close()
+	if err := EnableTCPFastOpen(listener); err != nil && runtime.GOOS == "linux" {
+		t.Errorf("EnableTCPFastOpen failed: %v", err)
+	}
+	go func() {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	// Dialing works whether or not the kernel accepts TCP Fast Open.
+	conn, err := DialTCPFastOpen(nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("DialTCPFastOpen failed: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	conn.CloseWrite()
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(reply) != "hello" {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// encryptedConfigHeader starts the config files encrypted with a NaCl
+// secretbox.  The rest of the file is the base64-encoded nonce followed by the
+// sealed config.
+const encryptedConfigHeader = "outline-ss-server encrypted config v1\n"
+
+const configNonceSize = 24
+
+// readConfigKey reads the key of encrypted config files from `filename`, which
+// holds it base64-encoded.
+func readConfigKey(filename string) (*[32]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode config key: %v", err)
+	}
+	if len(decoded) != 32 {
+		return nil, fmt.Errorf("Config key has %v bytes, expected 32", len(decoded))
+	}
+	key := new([32]byte)
+	copy(key[:], decoded)
+	return key, nil
+}
+
+func isEncryptedConfig(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedConfigHeader))
+}
+
+// encryptConfig seals the config `data` with `key`.
+func encryptConfig(data []byte, key *[32]byte) ([]byte, error) {
+	var nonce [configNonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	sealed := secretbox.Seal(nonce[:], data, &nonce, key)
+	return []byte(encryptedConfigHeader + base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+// decryptConfig opens the config `data` sealed by encryptConfig.
+func decryptConfig(data []byte, key *[32]byte) ([]byte, error) {
+	if !isEncryptedConfig(data) {
+		return nil, errors.New("Config file is not encrypted")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data[len(encryptedConfigHeader):])))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode encrypted config: %v", err)
+	}
+	if len(sealed) < configNonceSize+secretbox.Overhead {
+		return nil, errors.New("Encrypted config is truncated")
+	}
+	var nonce [configNonceSize]byte
+	copy(nonce[:], sealed)
+	config, ok := secretbox.Open(nil, sealed[configNonceSize:], &nonce, key)
+	if !ok {
+		return nil, errors.New("Failed to decrypt config: wrong key or corrupted file")
+	}
+	return config, nil
+}
+
+// resolveSecret returns the value of the config field `field` given inline,
+// read from `file`, or read from the environment variable `env`, whichever is
+// set.  The file and variable are named by `<field>_file` and `<field>_env`.
+func resolveSecret(field, value, file, env string) (string, error) {
+	set := 0
+	for _, v := range []string{value, file, env} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return "", fmt.Errorf("Only one of %v, %v_file and %v_env may be set", field, field, field)
+	}
+	switch {
+	case file != "":
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("Failed to read %v_file: %v", field, err)
+		}
+		value = strings.TrimRight(string(data), "\r\n")
+		if value == "" {
+			return "", fmt.Errorf("%v_file %v is empty", field, file)
+		}
+	case env != "":
+		var ok bool
+		if value, ok = os.LookupEnv(env); !ok {
+			return "", fmt.Errorf("%v_env %v is not set", field, env)
+		}
+		if value == "" {
+			return "", fmt.Errorf("%v_env %v is empty", field, env)
+		}
+	}
+	return value, nil
+}
+
+// resolveSecrets replaces the secret and key references of the keys in
+// `config` with their values.
+func resolveSecrets(config *Config) error {
+	for i := range config.Keys {
+		keyConfig := &config.Keys[i]
+		secret, err := resolveSecret("secret", keyConfig.Secret, keyConfig.SecretFile, keyConfig.SecretEnv)
+		if err != nil {
+			return fmt.Errorf("Key %v: %v", keyConfig.ID, err)
+		}
+		keyConfig.Secret, keyConfig.SecretFile, keyConfig.SecretEnv = secret, "", ""
+		key, err := resolveSecret("key", keyConfig.Key, keyConfig.KeyFile, keyConfig.KeyEnv)
+		if err != nil {
+			return fmt.Errorf("Key %v: %v", keyConfig.ID, err)
+		}
+		keyConfig.Key, keyConfig.KeyFile, keyConfig.KeyEnv = key, "", ""
+		for j := range keyConfig.PreviousSecrets {
+			secretConfig := &keyConfig.PreviousSecrets[j]
+			secret, err := resolveSecret("secret", secretConfig.Secret, secretConfig.SecretFile, secretConfig.SecretEnv)
+			if err != nil {
+				return fmt.Errorf("Key %v, previous secret %v: %v", keyConfig.ID, j+1, err)
+			}
+			secretConfig.Secret, secretConfig.SecretFile, secretConfig.SecretEnv = secret, "", ""
+			key, err := resolveSecret("key", secretConfig.Key, secretConfig.KeyFile, secretConfig.KeyEnv)
+			if err != nil {
+				return fmt.Errorf("Key %v, previous secret %v: %v", keyConfig.ID, j+1, err)
+			}
+			secretConfig.Key, secretConfig.KeyFile, secretConfig.KeyEnv = key, "", ""
+		}
+	}
+	return nil
+}
+
+// printEncryptedConfig prints the config file `filename` encrypted with the key
+// in `keyFile`.
+func printEncryptedConfig(filename, keyFile string) error {
+	if keyFile == "" {
+		return errors.New("-config_key_file is required")
+	}
+	key, err := readConfigKey(keyFile)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if isEncryptedConfig(data) {
+		return errors.New("Config file is already encrypted")
+	}
+	encrypted, err := encryptConfig(data, key)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(encrypted)
+	return err
+}
@@ -0,0 +1,206 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("FileSecret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_SS_SECRET", "EnvSecret")
+	config := &Config{Keys: []KeyConfig{
+		{ID: "inline", Secret: "InlineSecret"},
+		{ID: "file", SecretFile: secretFile},
+		{ID: "env", SecretEnv: "TEST_SS_SECRET", PreviousSecrets: []SecretConfig{{SecretFile: secretFile}}},
+	}}
+	if err := resolveSecrets(config); err != nil {
+		t.Fatalf("resolveSecrets failed: %v", err)
+	}
+	for i, expected := range []string{"InlineSecret", "FileSecret", "EnvSecret"} {
+		if secret := config.Keys[i].Secret; secret != expected {
+			t.Errorf("Key %v has secret %q, expected %q", config.Keys[i].ID, secret, expected)
+		}
+	}
+	if secret := config.Keys[2].PreviousSecrets[0].Secret; secret != "FileSecret" {
+		t.Errorf("Previous secret is %q", secret)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := ioutil.WriteFile(keyFile, []byte("RmlsZUtleQ==\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_SS_KEY", "RW52S2V5")
+	config = &Config{Keys: []KeyConfig{
+		{ID: "key-file", KeyFile: keyFile},
+		{ID: "key-env", KeyEnv: "TEST_SS_KEY", PreviousSecrets: []SecretConfig{{KeyFile: keyFile}}},
+	}}
+	if err := resolveSecrets(config); err != nil {
+		t.Fatalf("resolveSecrets failed: %v", err)
+	}
+	for i, expected := range []string{"RmlsZUtleQ==", "RW52S2V5"} {
+		if key := config.Keys[i].Key; key != expected {
+			t.Errorf("Key %v has key %q, expected %q", config.Keys[i].ID, key, expected)
+		}
+		if config.Keys[i].KeyFile != "" || config.Keys[i].KeyEnv != "" {
+			t.Errorf("Key %v still has a key reference", config.Keys[i].ID)
+		}
+	}
+	if key := config.Keys[1].PreviousSecrets[0].Key; key != "RmlsZUtleQ==" {
+		t.Errorf("Previous key is %q", key)
+	}
+
+	emptyFile := filepath.Join(t.TempDir(), "empty")
+	if err := ioutil.WriteFile(emptyFile, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_SS_EMPTY", "")
+	for _, keyConfig := range []KeyConfig{
+		{ID: "both", Secret: "Secret", SecretEnv: "TEST_SS_SECRET"},
+		{ID: "missing-file", SecretFile: filepath.Join(t.TempDir(), "missing")},
+		{ID: "empty-file", SecretFile: emptyFile},
+		{ID: "unset-env", SecretEnv: "TEST_SS_UNSET"},
+		{ID: "empty-env", SecretEnv: "TEST_SS_EMPTY"},
+		{ID: "previous", Secret: "Secret", PreviousSecrets: []SecretConfig{{SecretEnv: "TEST_SS_UNSET"}}},
+		{ID: "both-keys", Key: "RW52S2V5", KeyEnv: "TEST_SS_KEY"},
+		{ID: "unset-key-env", KeyEnv: "TEST_SS_UNSET"},
+		{ID: "previous-key", Secret: "Secret", PreviousSecrets: []SecretConfig{{KeyFile: emptyFile}}},
+	} {
+		if err := resolveSecrets(&Config{Keys: []KeyConfig{keyConfig}}); err == nil {
+			t.Errorf("Expected error for key %v", keyConfig.ID)
+		}
+	}
+}
+
+func writeConfigKey(t *testing.T, key byte) (string, *[32]byte) {
+	configKey := new([32]byte)
+	for i := range configKey {
+		configKey[i] = key
+	}
+	keyFile := filepath.Join(t.TempDir(), "config.key")
+	if err := ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(configKey[:])+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return keyFile, configKey
+}
+
+func TestEncryptConfig(t *testing.T) {
+	keyFile, key := writeConfigKey(t, 1)
+	readKey, err := readConfigKey(keyFile)
+	if err != nil {
+		t.Fatalf("readConfigKey failed: %v", err)
+	}
+	if *readKey != *key {
+		t.Fatal("Wrong config key")
+	}
+	_, otherKey := writeConfigKey(t, 2)
+
+	config := []byte("keys: []\n")
+	encrypted, err := encryptConfig(config, key)
+	if err != nil {
+		t.Fatalf("encryptConfig failed: %v", err)
+	}
+	if bytes.Contains(encrypted, config) || !isEncryptedConfig(encrypted) {
+		t.Fatalf("Config not encrypted: %q", encrypted)
+	}
+	decrypted, err := decryptConfig(encrypted, key)
+	if err != nil {
+		t.Fatalf("decryptConfig failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, config) {
+		t.Errorf("Decrypted %q, expected %q", decrypted, config)
+	}
+	if _, err := decryptConfig(encrypted, otherKey); err == nil {
+		t.Error("Expected error for the wrong key")
+	}
+	if _, err := decryptConfig(config, key); err == nil {
+		t.Error("Expected error for a plaintext config")
+	}
+	if _, err := decryptConfig([]byte(encryptedConfigHeader+"AAAA\n"), key); err == nil {
+		t.Error("Expected error for a truncated config")
+	}
+
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	if err := ioutil.WriteFile(configFile, encrypted, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readConfig(configFile); err == nil {
+		t.Error("Expected error for an encrypted config without a key")
+	}
+}
+
+func TestLoadEncryptedConfig(t *testing.T) {
+	keyFile, key := writeConfigKey(t, 1)
+	server := &SSServer{
+		m:            &metrics.NoOpMetrics{},
+		ports:        make(map[int]*ssPort),
+		blockedPorts: onet.NewPortBlocklist(nil),
+		options:      ServerOptions{ConfigKeyFile: keyFile},
+	}
+	defer server.Stop()
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNum := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	config := fmt.Sprintf(`keys:
+  - id: user-0
+    port: %v
+    cipher: chacha20-ietf-poly1305
+    secret_env: TEST_SS_SECRET
+`, portNum)
+	encrypted, err := encryptConfig([]byte(config), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(configFile, encrypted, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.loadConfig(configFile); err == nil {
+		t.Error("Expected error for an unset secret_env")
+	}
+	if len(server.ports) != 0 {
+		t.Error("Config with an unresolved secret was applied")
+	}
+	t.Setenv("TEST_SS_SECRET", "Secret0")
+	if err := server.loadConfig(configFile); err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if _, ok := server.ports[portNum]; !ok {
+		t.Errorf("Port %v not started", portNum)
+	}
+
+	// The key is read again on reload.
+	otherKeyFile, _ := writeConfigKey(t, 2)
+	server.options.ConfigKeyFile = otherKeyFile
+	if err := server.loadConfig(configFile); err == nil {
+		t.Error("Expected error for the wrong key")
+	}
+}
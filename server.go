@@ -16,6 +16,9 @@ package main
 
 import (
 	"container/list"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -25,6 +28,7 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -63,32 +67,164 @@ func init() {
 }
 
 type ssPort struct {
-	tcpService service.TCPService
-	udpService service.UDPService
-	cipherList service.CipherList
+	tcpListener *net.TCPListener
+	packetConn  *net.UDPConn
+	tcpService  service.TCPService
+	udpService  service.UDPService
+	cipherList  service.CipherList
+	// fallback receives the TCP connections that fail authentication.
+	fallback *service.Fallback
 }
 
 type SSServer struct {
 	natTimeout  time.Duration
 	m           metrics.ShadowsocksMetrics
 	replayCache service.ReplayCache
-	ports       map[int]*ssPort
+	// udpReplayFilter is shared among all ports, like replayCache.  Nil if
+	// disabled.
+	udpReplayFilter *service.UDPReplayFilter
+	// dnsProxy answers the DNS queries of UDP clients on all ports.  Nil if
+	// disabled.
+	dnsProxy *service.DNSProxy
+	// resolver resolves the target hostnames of all ports.
+	resolver *service.Resolver
+	// blockedPorts is the egress port blocklist of all ports, which is
+	// replaced when the config is reloaded.
+	blockedPorts *onet.PortBlocklist
+	// clientLimiter applies the client limits to all ports.
+	clientLimiter *service.ClientLimiter
+	// mu serializes config reloads, handoffs and shutdown, which use ports
+	// and drained.
+	mu    sync.Mutex
+	ports map[int]*ssPort
+	// drained is set by Drain, after which the config can't be loaded again.
+	drained bool
+	options ServerOptions
+	// sigHup receives the signals that reload the config.  Nil if reloads are
+	// not enabled or were stopped.
+	sigHup chan os.Signal
+	// Sockets inherited from a previous process that haven't been used yet.
+	inherited map[string]*os.File
+	// replaySnapshotStop stops saving the replay cache periodically.  Nil if
+	// the snapshots are disabled or stopped.
+	replaySnapshotStop chan struct{}
+	// replayHandoff sends the replay cache to the new process of a handoff.
+	// Nil if there was no handoff or the snapshots are disabled.
+	replayHandoff *os.File
+}
+
+// ServerOptions holds the optional settings of an SSServer.
+type ServerOptions struct {
+	// TCPFastOpen enables TCP Fast Open on the TCP listeners.
+	TCPFastOpen bool
+	// TCPIdleTimeout and TCPMaxLifetime limit relayed TCP connections, unless
+	// overridden by the access key.  Zero means no limit.
+	TCPIdleTimeout time.Duration
+	TCPMaxLifetime time.Duration
+	// TCPMux lets clients multiplex streams over one TCP connection.
+	TCPMux bool
+	// UDPReaders is the number of goroutines reading from each UDP socket.
+	// Defaults to 1.
+	UDPReaders int
+	// UDPBatchIO reads and writes several datagrams per system call on the UDP
+	// sockets (Linux only).
+	UDPBatchIO bool
+	// UDPNATFilter is the NAT filtering behavior for UDP, unless the port or
+	// key overrides it.
+	UDPNATFilter service.NATFilter
+	// UDPMaxNATEntries and UDPMaxNATEntriesPerKey limit the UDP NAT table of
+	// each port, in total and per access key.  Zero means no limit.
+	UDPMaxNATEntries       int
+	UDPMaxNATEntriesPerKey int
+	// UDPEvictNATEntries evicts the least recently active NAT entry when a
+	// limit is reached, instead of rejecting the new client.
+	UDPEvictNATEntries bool
+	// UDPReplayWindow enables UDP replay protection, rejecting packets whose
+	// salt was seen within this time.  Each key remembers at most
+	// UDPReplayMaxSalts salts per window.
+	UDPReplayWindow   time.Duration
+	UDPReplayMaxSalts int
+	// DNSUpstream is the UDP address of a resolver that answers the DNS
+	// queries of UDP clients, instead of the resolvers they chose.  Empty
+	// disables the DNS proxy.
+	DNSUpstream string
+	// DNSBlocklist holds domains, and their subdomains, that the DNS proxy
+	// answers with NXDOMAIN.
+	DNSBlocklist []string
+	// ResolverUpstream is the UDP address of the resolver for target hostnames.
+	// Empty uses the system resolver.
+	ResolverUpstream string
+	// IPPreference chooses the address family of targets with both, unless the
+	// port or key overrides it.
+	IPPreference service.IPPreference
+	// ClientLimits limits the connections of each client IP address and subnet
+	// before they are authenticated, across all ports.
+	ClientLimits service.ClientLimits
+	// ReplayWindow makes the replay cache remember the handshakes of this last
+	// period, up to the replay history per window, instead of a number of
+	// handshakes.  The replay history defaults to service.MaxCapacity then.
+	ReplayWindow time.Duration
+	// ReplaySnapshotFile is where the replay cache is saved every
+	// ReplaySnapshotInterval and on shutdown, and loaded from on startup unless
+	// it is older than ReplaySnapshotMaxAge.  Empty disables the snapshots.
+	ReplaySnapshotFile     string
+	ReplaySnapshotInterval time.Duration
+	ReplaySnapshotMaxAge   time.Duration
+	// ConfigKeyFile holds the base64-encoded key of the config file, which must
+	// then be encrypted (see encryptConfig).  It is read on every load.
+	ConfigKeyFile string
+	// InheritedSockets holds the sockets handed off by a previous process (see
+	// loadInheritedSockets).  Ports in the config use them instead of opening
+	// new sockets, and the unused ones are closed.
+	InheritedSockets map[string]*os.File
+	// InheritedReplayCache receives the replay cache of a previous process (see
+	// loadInheritedReplayCache), whose handshakes are merged into the one
+	// loaded from ReplaySnapshotFile.
+	InheritedReplayCache *os.File
 }
 
 func (s *SSServer) startPort(portNum int) error {
-	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: portNum})
+	listener, err := s.listenTCP(portNum)
 	if err != nil {
 		return fmt.Errorf("Failed to start TCP on port %v: %v", portNum, err)
 	}
-	packetConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: portNum})
+	if s.options.TCPFastOpen {
+		if err := onet.EnableTCPFastOpen(listener); err != nil {
+			logger.Warningf("Failed to enable TCP Fast Open on port %v: %v", portNum, err)
+		}
+	}
+	packetConn, err := s.listenUDP(portNum)
 	if err != nil {
 		return fmt.Errorf("Failed to start UDP on port %v: %v", portNum, err)
 	}
 	logger.Infof("Listening TCP and UDP on port %v", portNum)
-	port := &ssPort{cipherList: service.NewCipherList()}
+	port := &ssPort{tcpListener: listener, packetConn: packetConn, cipherList: service.NewCipherList(), fallback: service.NewFallback("")}
 	// TODO: Register initial data metrics at zero.
-	port.tcpService = service.NewTCPService(port.cipherList, &s.replayCache, s.m, tcpReadTimeout)
-	port.udpService = service.NewUDPService(s.natTimeout, port.cipherList, s.m)
+	port.tcpService = service.NewTCPService(port.cipherList, &s.replayCache, s.m, tcpReadTimeout, &service.TCPServiceOptions{
+		IdleTimeout:   s.options.TCPIdleTimeout,
+		MaxLifetime:   s.options.TCPMaxLifetime,
+		Resolver:      s.resolver,
+		IPPreference:  s.options.IPPreference,
+		BlockedPorts:  s.blockedPorts,
+		Fallback:      port.fallback,
+		ClientLimiter: s.clientLimiter,
+		Mux:           s.options.TCPMux,
+		NATFilter:     s.options.UDPNATFilter,
+	})
+	port.udpService = service.NewUDPService(s.natTimeout, port.cipherList, s.m, &service.UDPServiceOptions{
+		NumReaders:          s.options.UDPReaders,
+		BatchIO:             s.options.UDPBatchIO,
+		NATFilter:           s.options.UDPNATFilter,
+		MaxNATEntries:       s.options.UDPMaxNATEntries,
+		MaxNATEntriesPerKey: s.options.UDPMaxNATEntriesPerKey,
+		EvictNATEntries:     s.options.UDPEvictNATEntries,
+		ReplayFilter:        s.udpReplayFilter,
+		DNSProxy:            s.dnsProxy,
+		Resolver:            s.resolver,
+		IPPreference:        s.options.IPPreference,
+		BlockedPorts:        s.blockedPorts,
+		ClientLimiter:       s.clientLimiter,
+	})
 	s.ports[portNum] = port
 	go port.tcpService.Serve(onet.AdaptListener(listener))
 	go port.udpService.Serve(packetConn)
@@ -102,6 +238,10 @@ func (s *SSServer) removePort(portNum int) error {
 	}
 	tcpErr := port.tcpService.Stop()
 	udpErr := port.udpService.Stop()
+	// The services only close the sockets once Serve has started, so close them
+	// here too, to free the port right away.
+	port.tcpListener.Close()
+	port.packetConn.Close()
 	delete(s.ports, portNum)
 	if tcpErr != nil {
 		return fmt.Errorf("Failed to close listener on %v: %v", portNum, tcpErr)
@@ -114,10 +254,49 @@ func (s *SSServer) removePort(portNum int) error {
 }
 
 func (s *SSServer) loadConfig(filename string) error {
-	config, err := readConfig(filename)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.drained {
+		return errors.New("Server is shutting down")
+	}
+	var config *Config
+	var err error
+	if s.options.ConfigKeyFile != "" {
+		config, err = readEncryptedConfig(filename, s.options.ConfigKeyFile)
+	} else {
+		config, err = readConfig(filename)
+	}
 	if err != nil {
 		return fmt.Errorf("Failed to read config file %v: %v", filename, err)
 	}
+	// Secrets are resolved on every load, so that a reload picks up the
+	// changes to their files.
+	if err := resolveSecrets(config); err != nil {
+		return fmt.Errorf("Failed to resolve secrets: %v", err)
+	}
+
+	portConfigs := make(map[int]*PortConfig)
+	for i, portConfig := range config.Ports {
+		if _, ok := portConfigs[portConfig.Port]; ok {
+			return fmt.Errorf("Port %v is configured more than once", portConfig.Port)
+		}
+		if err := service.ValidateFallbackAddr(portConfig.Fallback); err != nil {
+			return fmt.Errorf("Port %v: %v", portConfig.Port, err)
+		}
+		portConfigs[portConfig.Port] = &config.Ports[i]
+	}
+
+	policies, err := newACLPolicies(config.ACLs)
+	if err != nil {
+		return err
+	}
+	if _, ok := policies[config.ACL]; config.ACL != "" && !ok {
+		return fmt.Errorf("Unknown ACL policy %v", config.ACL)
+	}
+	blockedPorts, err := parseBlockedPorts(config.BlockedPorts)
+	if err != nil {
+		return err
+	}
 
 	portChanges := make(map[int]int)
 	portCiphers := make(map[int]*list.List) // Values are *List of *CipherEntry.
@@ -128,13 +307,26 @@ func (s *SSServer) loadConfig(filename string) error {
 			cipherList = list.New()
 			portCiphers[keyConfig.Port] = cipherList
 		}
-		cipher, err := ss.NewCipher(keyConfig.Cipher, keyConfig.Secret)
+		entries, err := newCipherEntries(&keyConfig, portConfigs[keyConfig.Port])
 		if err != nil {
 			return fmt.Errorf("Failed to create cipher for key %v: %v", keyConfig.ID, err)
 		}
-		entry := service.MakeCipherEntry(keyConfig.ID, cipher, keyConfig.Secret)
-		cipherList.PushBack(&entry)
+		aclName := keyConfig.ACL
+		if aclName == "" {
+			aclName = config.ACL
+		}
+		var acl *service.ACLPolicy
+		if aclName != "" {
+			if acl = policies[aclName]; acl == nil {
+				return fmt.Errorf("Unknown ACL policy %v for key %v", aclName, keyConfig.ID)
+			}
+		}
+		for _, entry := range entries {
+			entry.ACL = acl
+			cipherList.PushBack(entry)
+		}
 	}
+	s.blockedPorts.Set(blockedPorts)
 	for port := range s.ports {
 		portChanges[port] = portChanges[port] - 1
 	}
@@ -151,6 +343,11 @@ func (s *SSServer) loadConfig(filename string) error {
 	}
 	for portNum, cipherList := range portCiphers {
 		s.ports[portNum].cipherList.Update(cipherList)
+		fallback := ""
+		if portConfig := portConfigs[portNum]; portConfig != nil {
+			fallback = portConfig.Fallback
+		}
+		s.ports[portNum].fallback.Set(fallback)
 	}
 	logger.Infof("Loaded %v access keys", len(config.Keys))
 	s.m.SetNumAccessKeys(len(config.Keys), len(portCiphers))
@@ -159,6 +356,8 @@ func (s *SSServer) loadConfig(filename string) error {
 
 // Stop serving on all ports.
 func (s *SSServer) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for portNum := range s.ports {
 		if err := s.removePort(portNum); err != nil {
 			return err
@@ -167,67 +366,649 @@ func (s *SSServer) Stop() error {
 	return nil
 }
 
+// defaultReplaySnapshotInterval is how often the replay cache is saved when
+// ServerOptions.ReplaySnapshotInterval is not set.
+const defaultReplaySnapshotInterval = time.Minute
+
+// loadReplaySnapshot adds the handshakes of the replay snapshot to the replay
+// cache, so that they can't be replayed after a restart.
+func (s *SSServer) loadReplaySnapshot() {
+	err := s.replayCache.LoadSnapshot(s.options.ReplaySnapshotFile, s.options.ReplaySnapshotMaxAge)
+	switch {
+	case err == nil:
+		logger.Infof("Loaded replay snapshot %v", s.options.ReplaySnapshotFile)
+	case errors.Is(err, os.ErrNotExist):
+		logger.Infof("No replay snapshot at %v", s.options.ReplaySnapshotFile)
+	case errors.Is(err, service.ErrStaleReplaySnapshot):
+		logger.Infof("Ignoring replay snapshot %v: %v", s.options.ReplaySnapshotFile, err)
+	default:
+		logger.Warningf("Failed to load replay snapshot %v: %v", s.options.ReplaySnapshotFile, err)
+	}
+}
+
+func (s *SSServer) saveReplaySnapshot() {
+	if err := s.replayCache.SaveSnapshot(s.options.ReplaySnapshotFile); err != nil {
+		logger.Warningf("Failed to save replay snapshot %v: %v", s.options.ReplaySnapshotFile, err)
+	}
+}
+
+// mergeInheritedReplayCache adds the handshakes that the previous process sends
+// over `pipe` to the replay cache, until it exits.
+func (s *SSServer) mergeInheritedReplayCache(pipe *os.File) {
+	defer pipe.Close()
+	added, err := s.replayCache.MergeSnapshots(pipe)
+	if err != nil {
+		logger.Warningf("Failed to merge the replay cache of the previous process after %v handshakes: %v", added, err)
+		return
+	}
+	logger.Infof("Merged %v handshakes from the previous process", added)
+}
+
+// sendReplayHandoff sends the replay cache to the new process of a handoff, if
+// any.  It gives up on the new process if the write fails.
+func (s *SSServer) sendReplayHandoff() {
+	if s.replayHandoff == nil {
+		return
+	}
+	s.replayHandoff.SetWriteDeadline(time.Now().Add(handoffTimeout))
+	if err := s.replayCache.WriteSnapshot(s.replayHandoff); err != nil {
+		logger.Warningf("Failed to send the replay cache to the new process: %v", err)
+		s.replayHandoff.Close()
+		s.replayHandoff = nil
+	}
+}
+
+// startReplaySnapshots saves the replay cache every ReplaySnapshotInterval
+// until replaySnapshotStop is closed.
+func (s *SSServer) startReplaySnapshots() {
+	interval := s.options.ReplaySnapshotInterval
+	if interval <= 0 {
+		interval = defaultReplaySnapshotInterval
+	}
+	stop := make(chan struct{})
+	s.replaySnapshotStop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.saveReplaySnapshot()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopReplaySnapshots stops the periodic replay snapshots.  It returns
+// false if they were not running.
+func (s *SSServer) stopReplaySnapshots() bool {
+	if s.replaySnapshotStop == nil {
+		return false
+	}
+	close(s.replaySnapshotStop)
+	s.replaySnapshotStop = nil
+	return true
+}
+
+// drainPollInterval is how often Drain checks and reports its progress.
+const drainPollInterval = time.Second
+
+// Drain stops reloading the config, accepting connections and reading UDP
+// packets on all ports, waits up to `timeout` for the existing TCP connections
+// to finish and the UDP NAT entries to expire, and then closes the remaining
+// ones.  Meanwhile the NAT entries keep relaying the replies of targets to
+// their clients.  After a handoff, the clients' next packets reach the new
+// process, which relays them with new NAT entries.
+func (s *SSServer) Drain(timeout time.Duration) error {
+	s.stopReloads()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drained = true
+	var stopErr error
+	for portNum, port := range s.ports {
+		if err := port.tcpService.Stop(); err != nil && stopErr == nil {
+			stopErr = fmt.Errorf("Failed to close listener on %v: %v", portNum, err)
+		}
+		if err := port.udpService.Drain(); err != nil && stopErr == nil {
+			stopErr = fmt.Errorf("Failed to drain UDP on %v: %v", portNum, err)
+		}
+		port.tcpListener.Close()
+	}
+	// The new process of a handoff gets the handshakes seen since its start,
+	// and those of the connections that were accepted but not authenticated
+	// yet once they finish.
+	s.sendReplayHandoff()
+	deadline := time.Now().Add(timeout)
+	logger.Infof("Stopped accepting connections, draining for up to %v", timeout)
+	for {
+		remaining := s.activeTCPConnections()
+		s.m.SetDrainingTCPConnections(remaining)
+		natEntries := s.activeNATEntries()
+		if remaining == 0 && natEntries == 0 {
+			logger.Info("All connections finished")
+			break
+		}
+		untilDeadline := time.Until(deadline)
+		if untilDeadline <= 0 {
+			logger.Infof("Drain deadline reached, closing %v remaining TCP connections and %v UDP NAT entries", remaining, natEntries)
+			break
+		}
+		logger.Infof("Waiting for %v TCP connections and %v UDP NAT entries to finish", remaining, natEntries)
+		if untilDeadline > drainPollInterval {
+			untilDeadline = drainPollInterval
+		}
+		time.Sleep(untilDeadline)
+	}
+	for portNum, port := range s.ports {
+		port.tcpService.CloseConnections()
+		port.tcpService.GracefulStop()
+		port.udpService.GracefulStop()
+		port.packetConn.Close()
+		delete(s.ports, portNum)
+	}
+	s.m.SetDrainingTCPConnections(0)
+	// Save the final handshakes, or send them to the new process if it took
+	// over the snapshots in a handoff.
+	if s.stopReplaySnapshots() {
+		s.saveReplaySnapshot()
+	}
+	s.sendReplayHandoff()
+	if s.replayHandoff != nil {
+		s.replayHandoff.Close()
+		s.replayHandoff = nil
+	}
+	return stopErr
+}
+
+// activeTCPConnections must be called with mu held.
+func (s *SSServer) activeTCPConnections() int {
+	count := 0
+	for _, port := range s.ports {
+		count += port.tcpService.ActiveConnections()
+	}
+	return count
+}
+
+// activeNATEntries must be called with mu held.
+func (s *SSServer) activeNATEntries() int {
+	count := 0
+	for _, port := range s.ports {
+		count += port.udpService.ActiveNATEntries()
+	}
+	return count
+}
+
 // RunSSServer starts a shadowsocks server running, and returns the server or an error.
-func RunSSServer(filename string, natTimeout time.Duration, sm metrics.ShadowsocksMetrics, replayHistory int) (*SSServer, error) {
+func RunSSServer(filename string, natTimeout time.Duration, sm metrics.ShadowsocksMetrics, replayHistory int, opts ...*ServerOptions) (*SSServer, error) {
 	server := &SSServer{
-		natTimeout:  natTimeout,
-		m:           sm,
-		replayCache: service.NewReplayCache(replayHistory),
-		ports:       make(map[int]*ssPort),
+		natTimeout:   natTimeout,
+		m:            sm,
+		ports:        make(map[int]*ssPort),
+		blockedPorts: onet.NewPortBlocklist(nil),
+	}
+	if opts != nil {
+		if len(opts) > 1 {
+			logger.Errorf("RunSSServer: at most one ServerOptions argument is allowed")
+		}
+		server.options = *opts[0]
 	}
-	err := server.loadConfig(filename)
+	server.inherited = server.options.InheritedSockets
+	if server.options.ReplayWindow > 0 && replayHistory == 0 {
+		// The capacity still bounds the memory of a time-based replay cache.
+		replayHistory = service.MaxCapacity
+	}
+	server.replayCache = service.NewReplayCache(replayHistory, &service.ReplayCacheOptions{
+		Window:  server.options.ReplayWindow,
+		Metrics: sm,
+	})
+	server.clientLimiter = service.NewClientLimiter(server.options.ClientLimits)
+	if server.options.UDPReplayWindow > 0 {
+		server.udpReplayFilter = service.NewUDPReplayFilter(server.options.UDPReplayWindow, server.options.UDPReplayMaxSalts)
+	}
+	resolver, err := service.NewResolver(sm, &service.ResolverOptions{Upstream: server.options.ResolverUpstream})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start resolver: %v", err)
+	}
+	server.resolver = resolver
+	if server.options.DNSUpstream != "" {
+		dnsProxy, err := service.NewDNSProxy(server.options.DNSUpstream, &service.DNSProxyOptions{
+			Blocklist: server.options.DNSBlocklist,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to start DNS proxy: %v", err)
+		}
+		server.dnsProxy = dnsProxy
+	}
+	if server.options.ReplaySnapshotFile != "" {
+		server.loadReplaySnapshot()
+		server.startReplaySnapshots()
+	}
+	if server.options.InheritedReplayCache != nil {
+		go server.mergeInheritedReplayCache(server.options.InheritedReplayCache)
+	}
+	err = server.loadConfig(filename)
+	server.closeUnusedInheritedSockets()
 	if err != nil {
 		return nil, fmt.Errorf("Failed to load config file %v: %v", filename, err)
 	}
+	server.startReloads(filename)
+	return server, nil
+}
+
+// startReloads reloads the config from `filename` on SIGHUP, until stopReloads
+// is called.
+func (s *SSServer) startReloads(filename string) {
 	sigHup := make(chan os.Signal, 1)
 	signal.Notify(sigHup, syscall.SIGHUP)
+	s.sigHup = sigHup
 	go func() {
 		for range sigHup {
 			logger.Info("Updating config")
-			if err := server.loadConfig(filename); err != nil {
+			if err := s.loadConfig(filename); err != nil {
 				logger.Errorf("Could not reload config: %v", err)
 			}
 		}
 	}()
-	return server, nil
+}
+
+// stopReloads stops reloading the config on SIGHUP.  A reload in progress
+// finishes first, since it holds mu.
+func (s *SSServer) stopReloads() {
+	if s.sigHup == nil {
+		return
+	}
+	signal.Stop(s.sigHup)
+	close(s.sigHup)
+	s.sigHup = nil
 }
 
 type Config struct {
-	Keys []struct {
-		ID     string
-		Port   int
-		Cipher string
-		Secret string
+	Keys  []KeyConfig
+	Ports []PortConfig
+	// ACLs holds the destination policies that keys can select by name.
+	ACLs []ACLConfig `yaml:"acls"`
+	// ACL is the name of the policy for keys that don't select one.  Empty
+	// allows all targets.
+	ACL string
+	// BlockedPorts holds the target ports that no key may reach: ports,
+	// ranges like "6660-6669", and the groups "smtp" (25, 465 and 587) and
+	// "netbios" (137-139 and 445).  Defaults to "smtp" if absent.  An empty
+	// list blocks nothing.
+	BlockedPorts []string `yaml:"blocked_ports"`
+}
+
+// ACLConfig is a named list of rules that allow or deny targets.  The first
+// rule that matches a target decides.
+type ACLConfig struct {
+	Name string
+	// Default is the action for targets that match no rule, "allow" or "deny".
+	// Defaults to "allow".
+	Default string
+	Rules   []service.ACLRuleConfig
+}
+
+// PortConfig holds the settings that apply to all the keys on a port.
+type PortConfig struct {
+	Port int
+	// UDPNATFilter is the NAT filtering behavior for UDP on this port, unless
+	// the key overrides it.  See service.ParseNATFilter for the names.
+	UDPNATFilter string `yaml:"udp_nat_filter"`
+	// IPPreference is "ipv4" or "ipv6" to connect to targets with that address
+	// family first, unless the key overrides it.
+	IPPreference string `yaml:"ip_preference"`
+	// Fallback is the host:port of a server, such as a web server, that
+	// receives the TCP connections that fail authentication, so that the port
+	// behaves like that server to active probers.  Empty absorbs them instead.
+	Fallback string
+}
+
+type KeyConfig struct {
+	ID     string
+	Port   int
+	Cipher string
+	Secret string
+	// SecretFile and SecretEnv name a file and an environment variable that
+	// hold the secret, as alternatives to Secret.  They are read on every load.
+	SecretFile string `yaml:"secret_file"`
+	SecretEnv  string `yaml:"secret_env"`
+	// Key is a base64-encoded raw key, as an alternative to Secret.  KeyFile
+	// and KeyEnv hold it like SecretFile and SecretEnv hold the secret.
+	Key     string
+	KeyFile string `yaml:"key_file"`
+	KeyEnv  string `yaml:"key_env"`
+	// IdleTimeout and MaxLifetime override the server-wide limits on TCP
+	// connections, e.g. "10m".  Zero removes the limit for the key, and unset
+	// values inherit the server's.
+	IdleTimeout *time.Duration `yaml:"idle_timeout"`
+	MaxLifetime *time.Duration `yaml:"max_lifetime"`
+	// UDPNATFilter overrides the NAT filtering behavior for UDP.
+	UDPNATFilter string `yaml:"udp_nat_filter"`
+	// UDPMaxNATEntries overrides -udp_max_nat_entries_per_key.  Zero removes
+	// the limit for the key, and an unset value inherits the server's.
+	UDPMaxNATEntries *int `yaml:"udp_max_nat_entries"`
+	// IPPreference overrides the address family preference for targets.
+	IPPreference string `yaml:"ip_preference"`
+	// ACL overrides the destination policy, by name.
+	ACL string
+	// NotBefore and NotAfter limit when the key is valid, as RFC 3339 times
+	// like 2024-01-31T00:00:00Z.  Either may be absent.  Keys become valid and
+	// expire at those times without a reload.
+	NotBefore time.Time `yaml:"not_before"`
+	NotAfter  time.Time `yaml:"not_after"`
+	// CloseOnExpiry closes the connections of the key when it expires, instead
+	// of letting them finish.
+	CloseOnExpiry bool `yaml:"close_on_expiry"`
+	// PreviousSecrets are accepted along with Secret or Key, so that clients
+	// can move to a new secret without losing access.
+	PreviousSecrets []SecretConfig `yaml:"previous_secrets"`
+}
+
+// SecretConfig is a previous secret of a key.
+type SecretConfig struct {
+	// Cipher defaults to the cipher of the key.
+	Cipher     string
+	Secret     string
+	SecretFile string `yaml:"secret_file"`
+	SecretEnv  string `yaml:"secret_env"`
+	// Key is a base64-encoded raw key, as an alternative to Secret.
+	Key     string
+	KeyFile string `yaml:"key_file"`
+	KeyEnv  string `yaml:"key_env"`
+	// NotAfter is when the secret stops being accepted, if it is before the
+	// expiry of the key.
+	NotAfter time.Time `yaml:"not_after"`
+}
+
+// entryTimeout converts a timeout of KeyConfig to the one of CipherEntry, where
+// zero inherits the service's and negative values remove the limit.
+func entryTimeout(timeout *time.Duration) time.Duration {
+	switch {
+	case timeout == nil:
+		return 0
+	case *timeout <= 0:
+		return -1
+	default:
+		return *timeout
 	}
 }
 
+// newCipherEntry creates the CipherEntry for a key, including its connection
+// limits, NAT filter and IP preference.  `portConfig` supplies the defaults for
+// the key's port, and may be nil.
+func newCipherEntry(keyConfig *KeyConfig, portConfig *PortConfig) (*service.CipherEntry, error) {
+	entry, err := newKeyCipherEntry(keyConfig.ID, keyConfig.Cipher, keyConfig.Secret, keyConfig.Key)
+	if err != nil {
+		return nil, err
+	}
+	entry.IdleTimeout = entryTimeout(keyConfig.IdleTimeout)
+	entry.MaxLifetime = entryTimeout(keyConfig.MaxLifetime)
+	if limit := keyConfig.UDPMaxNATEntries; limit != nil {
+		// CipherEntry uses zero to inherit the limit, and negative values to
+		// remove it.
+		entry.MaxNATEntries = *limit
+		if *limit <= 0 {
+			entry.MaxNATEntries = -1
+		}
+	}
+	if !keyConfig.NotBefore.IsZero() && !keyConfig.NotAfter.IsZero() && !keyConfig.NotAfter.After(keyConfig.NotBefore) {
+		return nil, fmt.Errorf("not_after (%v) must be later than not_before (%v)", keyConfig.NotAfter, keyConfig.NotBefore)
+	}
+	entry.NotBefore = keyConfig.NotBefore
+	entry.NotAfter = keyConfig.NotAfter
+	entry.CloseOnExpiry = keyConfig.CloseOnExpiry
+	natFilter := keyConfig.UDPNATFilter
+	if natFilter == "" && portConfig != nil {
+		natFilter = portConfig.UDPNATFilter
+	}
+	if entry.NATFilter, err = service.ParseNATFilter(natFilter); err != nil {
+		return nil, err
+	}
+	ipPreference := keyConfig.IPPreference
+	if ipPreference == "" && portConfig != nil {
+		ipPreference = portConfig.IPPreference
+	}
+	if entry.IPPreference, err = service.ParseIPPreference(ipPreference); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// newCipherEntries creates the CipherEntry of the current secret of a key,
+// like newCipherEntry, followed by one for each of its previous secrets.  They
+// all have the ID and settings of the key.
+func newCipherEntries(keyConfig *KeyConfig, portConfig *PortConfig) ([]*service.CipherEntry, error) {
+	entry, err := newCipherEntry(keyConfig, portConfig)
+	if err != nil {
+		return nil, err
+	}
+	entries := []*service.CipherEntry{entry}
+	for i, secretConfig := range keyConfig.PreviousSecrets {
+		cipherName := secretConfig.Cipher
+		if cipherName == "" {
+			cipherName = keyConfig.Cipher
+		}
+		secretEntry, err := newKeyCipherEntry(keyConfig.ID, cipherName, secretConfig.Secret, secretConfig.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Previous secret %v: %v", i+1, err)
+		}
+		previous := *entry
+		previous.Cipher = secretEntry.Cipher
+		previous.SaltGenerator = secretEntry.SaltGenerator
+		if notAfter := secretConfig.NotAfter; !notAfter.IsZero() && (previous.NotAfter.IsZero() || notAfter.Before(previous.NotAfter)) {
+			previous.NotAfter = notAfter
+		}
+		entries = append(entries, &previous)
+	}
+	return entries, nil
+}
+
+// parseBlockedPorts parses the egress blocklist of the config, which is
+// onet.DefaultBlockedPorts if `specs` is nil.
+func parseBlockedPorts(specs []string) ([]onet.PortRange, error) {
+	if specs == nil {
+		specs = onet.DefaultBlockedPorts
+	}
+	ranges, err := onet.ParseBlockedPorts(specs)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid blocked ports: %v", err)
+	}
+	return ranges, nil
+}
+
+// newACLPolicies creates the ACL policies in `configs`, by name.
+func newACLPolicies(configs []ACLConfig) (map[string]*service.ACLPolicy, error) {
+	policies := make(map[string]*service.ACLPolicy)
+	for _, aclConfig := range configs {
+		if aclConfig.Name == "" {
+			return nil, errors.New("ACL policy without a name")
+		}
+		if _, ok := policies[aclConfig.Name]; ok {
+			return nil, fmt.Errorf("ACL policy %v is configured more than once", aclConfig.Name)
+		}
+		policy, err := service.NewACLPolicy(aclConfig.Name, aclConfig.Default, aclConfig.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create ACL policy %v: %v", aclConfig.Name, err)
+		}
+		policies[aclConfig.Name] = policy
+	}
+	return policies, nil
+}
+
+// newKeyCipherEntry creates the CipherEntry for a secret of a key, using the
+// raw key if present and the password-derived key otherwise.
+func newKeyCipherEntry(id, cipherName, secret, rawKey string) (*service.CipherEntry, error) {
+	if rawKey == "" {
+		cipher, err := ss.NewCipher(cipherName, secret)
+		if err != nil {
+			return nil, err
+		}
+		entry := service.MakeCipherEntry(id, cipher, secret)
+		return &entry, nil
+	}
+	if secret != "" {
+		return nil, errors.New("Only one of secret and key may be set")
+	}
+	key, err := base64.StdEncoding.DecodeString(rawKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode key: %v", err)
+	}
+	cipher, err := ss.NewCipherFromKey(cipherName, key)
+	if err != nil {
+		return nil, err
+	}
+	entry := service.MakeCipherEntryFromKey(id, cipher, key)
+	return &entry, nil
+}
+
+// generateKey prints a new random base64-encoded key for the named cipher.
+func generateKey(cipherName string) error {
+	keySize, err := ss.KeySize(cipherName)
+	if err != nil {
+		return err
+	}
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(key))
+	return nil
+}
+
 func readConfig(filename string) (*Config, error) {
 	config := Config{}
 	configData, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
+	if isEncryptedConfig(configData) {
+		return nil, errors.New("Config file is encrypted, but no key was given with -config_key_file")
+	}
 	err = yaml.Unmarshal(configData, &config)
 	return &config, err
 }
 
+// readEncryptedConfig reads a config file encrypted with the key in `keyFile`.
+func readEncryptedConfig(filename, keyFile string) (*Config, error) {
+	key, err := readConfigKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	configData, err := decryptConfig(encrypted, key)
+	if err != nil {
+		return nil, err
+	}
+	config := Config{}
+	err = yaml.Unmarshal(configData, &config)
+	return &config, err
+}
+
+// readDomainList reads a file with one domain per line.  Blank lines and
+// lines starting with '#' are ignored.
+func readDomainList(filename string) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var domains []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains = append(domains, line)
+	}
+	return domains, nil
+}
+
 func main() {
 	var flags struct {
-		ConfigFile    string
-		MetricsAddr   string
-		IPCountryDB   string
-		natTimeout    time.Duration
-		replayHistory int
-		Verbose       bool
-		Version       bool
+		ConfigFile             string
+		MetricsAddr            string
+		IPCountryDB            string
+		natTimeout             time.Duration
+		replayHistory          int
+		Verbose                bool
+		Version                bool
+		GenerateKey            string
+		EncryptConfig          string
+		ConfigKeyFile          string
+		ReplayWindow           time.Duration
+		ReplaySnapshot         string
+		ReplaySnapshotInterval time.Duration
+		ReplaySnapshotMaxAge   time.Duration
+		TCPFastOpen            bool
+		TCPIdleTimeout         time.Duration
+		TCPMaxLifetime         time.Duration
+		TCPMux                 bool
+		DrainTimeout           time.Duration
+		UDPReaders             int
+		UDPBatchIO             bool
+		UDPNATFilter           string
+		UDPMaxNATEntries       int
+		UDPMaxNATEntriesPerKey int
+		UDPEvictNATEntries     bool
+		UDPReplayWindow        time.Duration
+		UDPReplayMaxSalts      int
+		DNSUpstream            string
+		DNSBlocklist           string
+		Resolver               string
+		IPPreference           string
+		ClientIPRate           float64
+		ClientIPBurst          int
+		ClientSubnetRate       float64
+		ClientSubnetBurst      int
+		ClientIPMaxConns       int
+		ClientSubnetMaxConns   int
+		ClientSubnetBitsIPv4   int
+		ClientSubnetBitsIPv6   int
+		ClientLimitAction      string
 	}
 	flag.StringVar(&flags.ConfigFile, "config", "", "Configuration filename")
 	flag.StringVar(&flags.MetricsAddr, "metrics", "", "Address for the Prometheus metrics")
 	flag.StringVar(&flags.IPCountryDB, "ip_country_db", "", "Path to the ip-to-country mmdb file")
 	flag.DurationVar(&flags.natTimeout, "udptimeout", defaultNatTimeout, "UDP tunnel timeout")
-	flag.IntVar(&flags.replayHistory, "replay_history", 0, "Replay buffer size (# of handshakes)")
+	flag.IntVar(&flags.replayHistory, "replay_history", 0, "Replay buffer size (# of handshakes, or the maximum per -replay_window)")
+	flag.DurationVar(&flags.ReplayWindow, "replay_window", 0, "Rejects the handshakes replayed within this time, e.g. 6h, instead of within -replay_history handshakes")
+	flag.StringVar(&flags.ReplaySnapshot, "replay_snapshot", "", "File where the replay buffer is saved periodically and on shutdown, and loaded from on startup")
+	flag.DurationVar(&flags.ReplaySnapshotInterval, "replay_snapshot_interval", defaultReplaySnapshotInterval, "How often to save the replay buffer to -replay_snapshot")
+	flag.DurationVar(&flags.ReplaySnapshotMaxAge, "replay_snapshot_max_age", 24*time.Hour, "Ignores replay snapshots saved longer ago than this on startup (0 for no limit)")
 	flag.BoolVar(&flags.Verbose, "verbose", false, "Enables verbose logging output")
 	flag.BoolVar(&flags.Version, "version", false, "The version of the server")
+	flag.StringVar(&flags.GenerateKey, "generate_key", "", "Print a new random key for the given cipher and exit")
+	flag.StringVar(&flags.EncryptConfig, "encrypt_config", "", "Print the given config file encrypted with the key of -config_key_file and exit")
+	flag.StringVar(&flags.ConfigKeyFile, "config_key_file", "", "File with the base64-encoded 32-byte key of the encrypted config file")
+	flag.BoolVar(&flags.TCPFastOpen, "tcp_fastopen", false, "Enables TCP Fast Open on the TCP listeners (Linux only)")
+	flag.DurationVar(&flags.TCPIdleTimeout, "tcp_idle_timeout", 0, "Closes TCP connections without traffic for this long (0 for no limit)")
+	flag.DurationVar(&flags.TCPMaxLifetime, "tcp_max_lifetime", 0, "Closes TCP connections this long after they were accepted (0 for no limit)")
+	flag.BoolVar(&flags.TCPMux, "tcp_mux", false, "Lets clients multiplex many TCP connections over one Shadowsocks connection")
+	flag.IntVar(&flags.UDPReaders, "udp_readers", 1, "Number of goroutines reading from each UDP socket")
+	flag.BoolVar(&flags.UDPBatchIO, "udp_batch", false, "Reads and writes several UDP datagrams per system call (Linux only)")
+	flag.StringVar(&flags.UDPNATFilter, "udp_nat_filter", string(service.NATFilterEndpointIndependent), "Which peers can reply to UDP clients: endpoint-independent (full cone), address-dependent or address-and-port-dependent")
+	flag.IntVar(&flags.UDPMaxNATEntries, "udp_max_nat_entries", 0, "Maximum number of UDP NAT entries per port (0 for no limit)")
+	flag.IntVar(&flags.UDPMaxNATEntriesPerKey, "udp_max_nat_entries_per_key", 0, "Maximum number of UDP NAT entries per access key (0 for no limit), unless the key sets udp_max_nat_entries")
+	flag.BoolVar(&flags.UDPEvictNATEntries, "udp_nat_evict", false, "When a UDP NAT limit is reached, evicts the least recently active entry instead of rejecting the new client")
+	flag.DurationVar(&flags.UDPReplayWindow, "udp_replay_window", 0, "Rejects UDP packets whose salt was seen within this time (0 disables UDP replay protection)")
+	flag.IntVar(&flags.UDPReplayMaxSalts, "udp_replay_max_salts", 10_000, "Maximum number of UDP salts remembered per access key and replay window")
+	flag.StringVar(&flags.DNSUpstream, "dns_upstream", "", "Answers UDP DNS queries through the resolver at this host:port, instead of the resolvers chosen by the clients")
+	flag.StringVar(&flags.DNSBlocklist, "dns_blocklist", "", "File with domains to answer with NXDOMAIN, one per line, when -dns_upstream is set")
+	flag.StringVar(&flags.Resolver, "resolver", "", "Resolves target hostnames with the DNS server at this host:port instead of the system resolver")
+	flag.StringVar(&flags.IPPreference, "ip_preference", "", "Address family to use first for targets that have both: ipv4 or ipv6")
+	flag.Float64Var(&flags.ClientIPRate, "client_ip_rate", 0, "New connections per second that each client IP address may open before authentication (0 for no limit)")
+	flag.IntVar(&flags.ClientIPBurst, "client_ip_burst", 0, "Burst of new connections of each client IP address (defaults to -client_ip_rate)")
+	flag.Float64Var(&flags.ClientSubnetRate, "client_subnet_rate", 0, "New connections per second that each client subnet may open before authentication (0 for no limit)")
+	flag.IntVar(&flags.ClientSubnetBurst, "client_subnet_burst", 0, "Burst of new connections of each client subnet (defaults to -client_subnet_rate)")
+	flag.IntVar(&flags.ClientIPMaxConns, "client_ip_concurrency", 0, "Maximum number of unauthenticated connections and UDP NAT entries per client IP address (0 for no limit)")
+	flag.IntVar(&flags.ClientSubnetMaxConns, "client_subnet_concurrency", 0, "Maximum number of unauthenticated connections and UDP NAT entries per client subnet (0 for no limit)")
+	flag.IntVar(&flags.ClientSubnetBitsIPv4, "client_subnet_ipv4_bits", 24, "Prefix length of the IPv4 client subnets")
+	flag.IntVar(&flags.ClientSubnetBitsIPv6, "client_subnet_ipv6_bits", 64, "Prefix length of the IPv6 client subnets")
+	flag.StringVar(&flags.ClientLimitAction, "client_limit_action", string(service.RateLimitDrop), "What to do with TCP connections over the client limits: drop, or absorb them like probes")
+	flag.DurationVar(&flags.DrainTimeout, "drain_timeout", 0, "On SIGINT or SIGTERM, how long to let existing TCP connections finish before closing them.  UDP sessions end at once")
 
 	flag.Parse()
 
@@ -242,11 +1023,44 @@ func main() {
 		return
 	}
 
+	if flags.GenerateKey != "" {
+		if err := generateKey(flags.GenerateKey); err != nil {
+			log.Fatalf("Could not generate key: %v", err)
+		}
+		return
+	}
+
+	if flags.EncryptConfig != "" {
+		if err := printEncryptedConfig(flags.EncryptConfig, flags.ConfigKeyFile); err != nil {
+			log.Fatalf("Could not encrypt config: %v", err)
+		}
+		return
+	}
+
 	if flags.ConfigFile == "" {
 		flag.Usage()
 		return
 	}
 
+	natFilter, err := service.ParseNATFilter(flags.UDPNATFilter)
+	if err != nil {
+		log.Fatalf("Invalid -udp_nat_filter: %v", err)
+	}
+	ipPreference, err := service.ParseIPPreference(flags.IPPreference)
+	if err != nil {
+		log.Fatalf("Invalid -ip_preference: %v", err)
+	}
+	clientLimitAction, err := service.ParseRateLimitAction(flags.ClientLimitAction)
+	if err != nil {
+		log.Fatalf("Invalid -client_limit_action: %v", err)
+	}
+	var dnsBlocklist []string
+	if flags.DNSBlocklist != "" {
+		if dnsBlocklist, err = readDomainList(flags.DNSBlocklist); err != nil {
+			log.Fatalf("Could not read DNS blocklist: %v", err)
+		}
+	}
+
 	if flags.MetricsAddr != "" {
 		http.Handle("/metrics", promhttp.Handler())
 		go func() {
@@ -256,7 +1070,6 @@ func main() {
 	}
 
 	var ipCountryDB *geoip2.Reader
-	var err error
 	if flags.IPCountryDB != "" {
 		logger.Infof("Using IP-Country database at %v", flags.IPCountryDB)
 		ipCountryDB, err = geoip2.Open(flags.IPCountryDB)
@@ -267,12 +1080,69 @@ func main() {
 	}
 	m := metrics.NewPrometheusShadowsocksMetrics(ipCountryDB, prometheus.DefaultRegisterer)
 	m.SetBuildInfo(version)
-	_, err = RunSSServer(flags.ConfigFile, flags.natTimeout, m, flags.replayHistory)
+	server, err := RunSSServer(flags.ConfigFile, flags.natTimeout, m, flags.replayHistory, &ServerOptions{
+		TCPFastOpen:            flags.TCPFastOpen,
+		TCPIdleTimeout:         flags.TCPIdleTimeout,
+		TCPMaxLifetime:         flags.TCPMaxLifetime,
+		TCPMux:                 flags.TCPMux,
+		UDPReaders:             flags.UDPReaders,
+		UDPBatchIO:             flags.UDPBatchIO,
+		UDPNATFilter:           natFilter,
+		UDPMaxNATEntries:       flags.UDPMaxNATEntries,
+		UDPMaxNATEntriesPerKey: flags.UDPMaxNATEntriesPerKey,
+		UDPEvictNATEntries:     flags.UDPEvictNATEntries,
+		UDPReplayWindow:        flags.UDPReplayWindow,
+		UDPReplayMaxSalts:      flags.UDPReplayMaxSalts,
+		DNSUpstream:            flags.DNSUpstream,
+		DNSBlocklist:           dnsBlocklist,
+		ResolverUpstream:       flags.Resolver,
+		IPPreference:           ipPreference,
+		ClientLimits: service.ClientLimits{
+			IPRate:            flags.ClientIPRate,
+			IPBurst:           flags.ClientIPBurst,
+			SubnetRate:        flags.ClientSubnetRate,
+			SubnetBurst:       flags.ClientSubnetBurst,
+			IPConcurrency:     flags.ClientIPMaxConns,
+			SubnetConcurrency: flags.ClientSubnetMaxConns,
+			SubnetBitsIPv4:    flags.ClientSubnetBitsIPv4,
+			SubnetBitsIPv6:    flags.ClientSubnetBitsIPv6,
+			Action:            clientLimitAction,
+		},
+		ReplayWindow:           flags.ReplayWindow,
+		ReplaySnapshotFile:     flags.ReplaySnapshot,
+		ReplaySnapshotInterval: flags.ReplaySnapshotInterval,
+		ReplaySnapshotMaxAge:   flags.ReplaySnapshotMaxAge,
+		ConfigKeyFile:          flags.ConfigKeyFile,
+		InheritedSockets:       loadInheritedSockets(),
+		InheritedReplayCache:   loadInheritedReplayCache(),
+	})
 	if err != nil {
 		logger.Fatal(err)
 	}
+	if err := notifyReady(); err != nil {
+		logger.Errorf("Failed to notify the previous process: %v", err)
+	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
+	upgradeCh := make(chan os.Signal, 1)
+	if len(upgradeSignals) > 0 {
+		signal.Notify(upgradeCh, upgradeSignals...)
+	}
+	for {
+		select {
+		case sig := <-sigCh:
+			logger.Infof("Received %v, shutting down", sig)
+		case <-upgradeCh:
+			logger.Info("Handing off sockets to a new process")
+			if err := server.Handoff(); err != nil {
+				logger.Errorf("Failed to hand off sockets: %v", err)
+				continue
+			}
+		}
+		break
+	}
+	if err := server.Drain(flags.DrainTimeout); err != nil {
+		logger.Errorf("Failed to shut down cleanly: %v", err)
+	}
 }
@@ -15,10 +15,17 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
 	"testing"
 	"time"
 
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/Jigsaw-Code/outline-ss-server/service"
 	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -32,3 +39,482 @@ func TestRunSSServer(t *testing.T) {
 		t.Errorf("Error while stopping server: %v", err)
 	}
 }
+
+func TestDrain(t *testing.T) {
+	m := metrics.NewPrometheusShadowsocksMetrics(nil, prometheus.NewRegistry())
+	server, err := RunSSServer("config_example.yml", 30*time.Second, m, 10000)
+	if err != nil {
+		t.Fatalf("RunSSServer() error = %v", err)
+	}
+	// Reloads racing with the drain don't start the ports again.
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		for server.loadConfig("config_example.yml") == nil {
+		}
+	}()
+	// Without connections, the drain doesn't wait for the deadline.
+	start := time.Now()
+	if err := server.Drain(time.Minute); err != nil {
+		t.Errorf("Error while draining server: %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("Drain waited for %v", time.Since(start))
+	}
+	<-reloaded
+	if len(server.ports) != 0 {
+		t.Errorf("Drain left %v ports open", len(server.ports))
+	}
+	if server.sigHup != nil {
+		t.Error("Drain didn't stop the config reloads")
+	}
+}
+
+func TestReplaySnapshot(t *testing.T) {
+	snapshotFile := filepath.Join(t.TempDir(), "replay.snapshot")
+	options := &ServerOptions{ReplaySnapshotFile: snapshotFile, ReplaySnapshotInterval: time.Hour}
+	m := metrics.NewPrometheusShadowsocksMetrics(nil, prometheus.NewRegistry())
+	server, err := RunSSServer("config_example.yml", 30*time.Second, m, 10000, options)
+	if err != nil {
+		t.Fatalf("RunSSServer() error = %v", err)
+	}
+	salt := []byte("0123456789abcdef")
+	if !server.replayCache.Add("user-0", salt) {
+		t.Fatal("New salt rejected")
+	}
+	if err := server.Drain(0); err != nil {
+		t.Errorf("Error while draining server: %v", err)
+	}
+
+	m = metrics.NewPrometheusShadowsocksMetrics(nil, prometheus.NewRegistry())
+	server, err = RunSSServer("config_example.yml", 30*time.Second, m, 10000, options)
+	if err != nil {
+		t.Fatalf("RunSSServer() error = %v", err)
+	}
+	defer server.Drain(0)
+	if server.replayCache.Add("user-0", salt) {
+		t.Error("Salt from before the restart was accepted")
+	}
+}
+
+func TestNewCipherEntry(t *testing.T) {
+	// 32 bytes, as required by chacha20-ietf-poly1305.
+	const key = "PqqhLuxxFy4gS1uIMz8uc/Gzuc2WY23jYfambRSgMMA="
+	if _, err := newCipherEntry(&KeyConfig{ID: "secret", Cipher: ss.TestCipher, Secret: "Secret0"}, nil); err != nil {
+		t.Errorf("Failed to create cipher from secret: %v", err)
+	}
+	if _, err := newCipherEntry(&KeyConfig{ID: "key", Cipher: ss.TestCipher, Key: key}, nil); err != nil {
+		t.Errorf("Failed to create cipher from key: %v", err)
+	}
+	if _, err := newCipherEntry(&KeyConfig{ID: "both", Cipher: ss.TestCipher, Secret: "Secret0", Key: key}, nil); err == nil {
+		t.Error("Expected error when both secret and key are set")
+	}
+	if _, err := newCipherEntry(&KeyConfig{ID: "bad-base64", Cipher: ss.TestCipher, Key: "not base64!"}, nil); err == nil {
+		t.Error("Expected error for invalid base64")
+	}
+	if _, err := newCipherEntry(&KeyConfig{ID: "bad-size", Cipher: "aes-128-gcm", Key: key}, nil); err == nil {
+		t.Error("Expected error for wrong key size")
+	}
+}
+
+func TestReadConfigTimeouts(t *testing.T) {
+	configFile, err := ioutil.TempFile(t.TempDir(), "config*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile.WriteString(`keys:
+  - id: user-0
+    port: 9000
+    cipher: chacha20-ietf-poly1305
+    secret: Secret0
+    idle_timeout: 5m
+    max_lifetime: 24h
+  - id: user-1
+    port: 9000
+    cipher: chacha20-ietf-poly1305
+    secret: Secret1
+    idle_timeout: 0
+`)
+	configFile.Close()
+	config, err := readConfig(configFile.Name())
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	entry, err := newCipherEntry(&config.Keys[0], nil)
+	if err != nil {
+		t.Fatalf("newCipherEntry failed: %v", err)
+	}
+	if entry.IdleTimeout != 5*time.Minute || entry.MaxLifetime != 24*time.Hour {
+		t.Errorf("Wrong timeouts: idle %v, lifetime %v", entry.IdleTimeout, entry.MaxLifetime)
+	}
+	// Zero disables the limit, and unset timeouts are inherited.
+	entry, err = newCipherEntry(&config.Keys[1], nil)
+	if err != nil {
+		t.Fatalf("newCipherEntry failed: %v", err)
+	}
+	if entry.IdleTimeout >= 0 || entry.MaxLifetime != 0 {
+		t.Errorf("Wrong timeouts: idle %v, lifetime %v", entry.IdleTimeout, entry.MaxLifetime)
+	}
+}
+
+func TestReadConfigValidity(t *testing.T) {
+	configFile, err := ioutil.TempFile(t.TempDir(), "config*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile.WriteString(`keys:
+  - id: trial
+    port: 9000
+    cipher: chacha20-ietf-poly1305
+    secret: Secret0
+    not_before: 2024-01-01T00:00:00Z
+    not_after: 2024-01-08T12:00:00+02:00
+    close_on_expiry: true
+  - id: backwards
+    port: 9000
+    cipher: chacha20-ietf-poly1305
+    secret: Secret1
+    not_before: 2024-01-08T00:00:00Z
+    not_after: 2024-01-01T00:00:00Z
+`)
+	configFile.Close()
+	config, err := readConfig(configFile.Name())
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	entry, err := newCipherEntry(&config.Keys[0], nil)
+	if err != nil {
+		t.Fatalf("newCipherEntry failed: %v", err)
+	}
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2024, 1, 8, 10, 0, 0, 0, time.UTC)
+	if !entry.NotBefore.Equal(notBefore) || !entry.NotAfter.Equal(notAfter) || !entry.CloseOnExpiry {
+		t.Errorf("Wrong validity: [%v, %v), close %v", entry.NotBefore, entry.NotAfter, entry.CloseOnExpiry)
+	}
+	if _, err := newCipherEntry(&config.Keys[1], nil); err == nil {
+		t.Error("Expected error for not_after before not_before")
+	}
+}
+
+func TestReadConfigPreviousSecrets(t *testing.T) {
+	configFile, err := ioutil.TempFile(t.TempDir(), "config*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile.WriteString(`keys:
+  - id: rotated
+    port: 9000
+    cipher: chacha20-ietf-poly1305
+    secret: Secret1
+    idle_timeout: 10m
+    not_after: 2024-02-01T00:00:00Z
+    previous_secrets:
+      - secret: Secret0
+        not_after: 2024-01-15T00:00:00Z
+      - cipher: aes-128-gcm
+        key: AAAAAAAAAAAAAAAAAAAAAA==
+        not_after: 2024-03-01T00:00:00Z
+  - id: bad
+    port: 9000
+    cipher: chacha20-ietf-poly1305
+    secret: Secret2
+    previous_secrets:
+      - secret: Secret3
+        key: AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+`)
+	configFile.Close()
+	config, err := readConfig(configFile.Name())
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	entries, err := newCipherEntries(&config.Keys[0], nil)
+	if err != nil {
+		t.Fatalf("newCipherEntries failed: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %v", len(entries))
+	}
+	notAfters := []time.Time{
+		time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC),
+		// Limited by the expiry of the key.
+		time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for i, entry := range entries {
+		if entry.ID != "rotated" {
+			t.Errorf("Entry %v has ID %v", i, entry.ID)
+		}
+		if entry.IdleTimeout != 10*time.Minute {
+			t.Errorf("Entry %v has idle timeout %v", i, entry.IdleTimeout)
+		}
+		if !entry.NotAfter.Equal(notAfters[i]) {
+			t.Errorf("Entry %v expires at %v, expected %v", i, entry.NotAfter, notAfters[i])
+		}
+	}
+	if entries[0].Cipher == entries[1].Cipher {
+		t.Error("Previous secret shares the cipher of the current one")
+	}
+	if saltSize := entries[2].Cipher.SaltSize(); saltSize != 16 {
+		t.Errorf("Previous secret should use aes-128-gcm, got salt size %v", saltSize)
+	}
+	if _, err := newCipherEntries(&config.Keys[1], nil); err == nil {
+		t.Error("Expected error for previous secret with both secret and key")
+	}
+}
+
+func TestReadConfigNATFilter(t *testing.T) {
+	configFile, err := ioutil.TempFile(t.TempDir(), "config*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile.WriteString(`keys:
+  - id: port-default
+    port: 9000
+    cipher: chacha20-ietf-poly1305
+    secret: Secret0
+  - id: key-override
+    port: 9000
+    cipher: chacha20-ietf-poly1305
+    secret: Secret1
+    udp_nat_filter: full-cone
+    udp_max_nat_entries: 50
+  - id: key-unlimited
+    port: 9000
+    cipher: chacha20-ietf-poly1305
+    secret: Secret2
+    udp_max_nat_entries: 0
+ports:
+  - port: 9000
+    udp_nat_filter: port-restricted
+`)
+	configFile.Close()
+	config, err := readConfig(configFile.Name())
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	if len(config.Ports) != 1 {
+		t.Fatalf("Wrong number of ports: %v", config.Ports)
+	}
+	entry, err := newCipherEntry(&config.Keys[0], &config.Ports[0])
+	if err != nil {
+		t.Fatalf("newCipherEntry failed: %v", err)
+	}
+	if entry.NATFilter != service.NATFilterAddressAndPortDependent {
+		t.Errorf("Expected the port's NAT filter, got %q", entry.NATFilter)
+	}
+	if entry.MaxNATEntries != 0 {
+		t.Errorf("Expected the server's NAT limit, got %v", entry.MaxNATEntries)
+	}
+	entry, err = newCipherEntry(&config.Keys[1], &config.Ports[0])
+	if err != nil {
+		t.Fatalf("newCipherEntry failed: %v", err)
+	}
+	if entry.NATFilter != service.NATFilterEndpointIndependent {
+		t.Errorf("Expected the key's NAT filter, got %q", entry.NATFilter)
+	}
+	if entry.MaxNATEntries != 50 {
+		t.Errorf("Expected the key's NAT limit, got %v", entry.MaxNATEntries)
+	}
+	entry, err = newCipherEntry(&config.Keys[2], &config.Ports[0])
+	if err != nil {
+		t.Fatalf("newCipherEntry failed: %v", err)
+	}
+	if entry.MaxNATEntries >= 0 {
+		t.Errorf("Expected no NAT limit, got %v", entry.MaxNATEntries)
+	}
+	if _, err := newCipherEntry(&KeyConfig{ID: "bad-filter", Cipher: ss.TestCipher, Secret: "Secret0", UDPNATFilter: "symmetric"}, nil); err == nil {
+		t.Error("Expected error for unknown NAT filter")
+	}
+}
+
+func TestNewCipherEntryIPPreference(t *testing.T) {
+	portConfig := &PortConfig{Port: 9000, IPPreference: "ipv6"}
+	entry, err := newCipherEntry(&KeyConfig{ID: "port-default", Cipher: ss.TestCipher, Secret: "Secret0"}, portConfig)
+	if err != nil {
+		t.Fatalf("newCipherEntry failed: %v", err)
+	}
+	if entry.IPPreference != service.IPPreferenceIPv6 {
+		t.Errorf("Expected the port's IP preference, got %q", entry.IPPreference)
+	}
+	entry, err = newCipherEntry(&KeyConfig{ID: "key-override", Cipher: ss.TestCipher, Secret: "Secret0", IPPreference: "ipv4"}, portConfig)
+	if err != nil {
+		t.Fatalf("newCipherEntry failed: %v", err)
+	}
+	if entry.IPPreference != service.IPPreferenceIPv4 {
+		t.Errorf("Expected the key's IP preference, got %q", entry.IPPreference)
+	}
+	if _, err := newCipherEntry(&KeyConfig{ID: "bad-preference", Cipher: ss.TestCipher, Secret: "Secret0", IPPreference: "ipx"}, nil); err == nil {
+		t.Error("Expected error for unknown IP preference")
+	}
+}
+
+func TestReadConfigACLs(t *testing.T) {
+	configFile, err := ioutil.TempFile(t.TempDir(), "config*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile.WriteString(`keys:
+  - id: user-0
+    port: 9000
+    cipher: chacha20-ietf-poly1305
+    secret: Secret0
+    acl: web-only
+acl: no-smtp
+acls:
+  - name: no-smtp
+    rules:
+      - action: deny
+        ports: ["25", "465-587"]
+        protocols: [tcp]
+  - name: web-only
+    default: deny
+    rules:
+      - action: deny
+        domains: [internal.example]
+      - action: allow
+        networks: [203.0.113.0/24, 2001:db8::1]
+        ports: ["80", "443"]
+`)
+	configFile.Close()
+	config, err := readConfig(configFile.Name())
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	if config.ACL != "no-smtp" || config.Keys[0].ACL != "web-only" {
+		t.Errorf("Wrong ACL selection: global %q, key %q", config.ACL, config.Keys[0].ACL)
+	}
+	policies, err := newACLPolicies(config.ACLs)
+	if err != nil {
+		t.Fatalf("newACLPolicies failed: %v", err)
+	}
+	if len(policies) != 2 || policies["web-only"].Name() != "web-only" {
+		t.Errorf("Wrong policies: %v", policies)
+	}
+
+	if _, err := newACLPolicies(append(config.ACLs, ACLConfig{Name: "no-smtp"})); err == nil {
+		t.Error("Expected error for duplicate policy")
+	}
+	bad := ACLConfig{Name: "bad", Rules: []service.ACLRuleConfig{{Action: "allow", Ports: []string{"443-80"}}}}
+	if _, err := newACLPolicies([]ACLConfig{bad}); err == nil {
+		t.Error("Expected error for invalid port range")
+	}
+}
+
+func TestLoadConfigBlockedPorts(t *testing.T) {
+	server := &SSServer{
+		m:            &metrics.NoOpMetrics{},
+		ports:        make(map[int]*ssPort),
+		blockedPorts: onet.NewPortBlocklist(nil),
+	}
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	loadConfig := func(config string) error {
+		if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return server.loadConfig(configFile)
+	}
+
+	// SMTP is blocked by default.
+	if err := loadConfig("keys: []\n"); err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if err := server.blockedPorts.Check(25); err == nil || err.Status != "ERR_PORT_BLOCKED" {
+		t.Errorf("Expected port 25 to be blocked, got %v", err)
+	}
+
+	if err := loadConfig("blocked_ports: [netbios, 6660-6669]\n"); err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if err := server.blockedPorts.Check(25); err != nil {
+		t.Errorf("Port 25 should not be blocked after reload: %v", err)
+	}
+	for _, port := range []int{445, 6667} {
+		if err := server.blockedPorts.Check(port); err == nil {
+			t.Errorf("Port %v should be blocked after reload", port)
+		}
+	}
+
+	// An invalid list leaves the previous one in place.
+	if err := loadConfig("blocked_ports: [mail]\n"); err == nil {
+		t.Error("Expected error for unknown port group")
+	}
+	if err := server.blockedPorts.Check(445); err == nil {
+		t.Error("Port 445 should still be blocked")
+	}
+
+	if err := loadConfig("blocked_ports: []\n"); err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if err := server.blockedPorts.Check(445); err != nil {
+		t.Errorf("An empty list should block nothing: %v", err)
+	}
+}
+
+func TestLoadConfigFallback(t *testing.T) {
+	server := &SSServer{
+		m:            &metrics.NoOpMetrics{},
+		ports:        make(map[int]*ssPort),
+		blockedPorts: onet.NewPortBlocklist(nil),
+	}
+	defer server.Stop()
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNum := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	loadConfig := func(fallback string) error {
+		config := fmt.Sprintf(`keys:
+  - id: user-0
+    port: %v
+    cipher: chacha20-ietf-poly1305
+    secret: Secret0
+ports:
+  - port: %v
+    fallback: %q
+`, portNum, portNum, fallback)
+		if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return server.loadConfig(configFile)
+	}
+
+	if err := loadConfig("127.0.0.1:8080"); err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if got := server.ports[portNum].fallback.Addr(); got != "127.0.0.1:8080" {
+		t.Errorf("Wrong fallback: %q", got)
+	}
+
+	// An invalid address leaves the previous one in place.
+	if err := loadConfig("127.0.0.1"); err == nil {
+		t.Error("Expected error for fallback without a port")
+	}
+	if got := server.ports[portNum].fallback.Addr(); got != "127.0.0.1:8080" {
+		t.Errorf("Fallback changed by an invalid config: %q", got)
+	}
+
+	if err := loadConfig(""); err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if got := server.ports[portNum].fallback.Addr(); got != "" {
+		t.Errorf("Fallback should be disabled, got %q", got)
+	}
+}
+
+func TestReadDomainList(t *testing.T) {
+	listFile, err := ioutil.TempFile(t.TempDir(), "blocklist*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listFile.WriteString("# Ads\nads.example\n\n  tracker.example.  \n")
+	listFile.Close()
+	domains, err := readDomainList(listFile.Name())
+	if err != nil {
+		t.Fatalf("readDomainList failed: %v", err)
+	}
+	if len(domains) != 2 || domains[0] != "ads.example" || domains[1] != "tracker.example." {
+		t.Errorf("Wrong domains: %q", domains)
+	}
+}
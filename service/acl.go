@@ -0,0 +1,324 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+)
+
+// Actions of ACL rules.
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// aclDefaultRule is the rule label in metrics when no rule matches.
+const aclDefaultRule = "default"
+
+// ACLRuleConfig is the textual form of an ACL rule, as in the config file.  A
+// rule matches a target if it matches every criterion that is set.
+type ACLRuleConfig struct {
+	// Action is ACLAllow or ACLDeny.
+	Action string
+	// Networks holds CIDRs or single IP addresses.
+	Networks []string
+	// Ports holds ports or ranges, like "8000-8999".
+	Ports []string
+	// Protocols holds "tcp" or "udp".
+	Protocols []string
+	// Domains holds domain suffixes.  They only match hostname targets, and are
+	// checked before the hostname is resolved.
+	Domains []string
+}
+
+type aclRule struct {
+	allow     bool
+	networks  []*net.IPNet
+	ports     []onet.PortRange
+	protocols []string
+	domains   []string
+}
+
+// ACLPolicy is an ordered list of rules that allow or deny targets.  The first
+// rule that matches a target decides, or the default action if none does.
+// Allowed targets must still pass the TargetIPValidator of the service.
+type ACLPolicy struct {
+	name         string
+	rules        []aclRule
+	defaultAllow bool
+}
+
+// NewACLPolicy creates the policy `name`, with `rules` and the action for
+// targets that match none of them, which defaults to ACLAllow if empty.
+func NewACLPolicy(name string, defaultAction string, rules []ACLRuleConfig) (*ACLPolicy, error) {
+	defaultAllow, err := parseACLAction(defaultAction, true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default action: %v", err)
+	}
+	p := &ACLPolicy{name: name, defaultAllow: defaultAllow}
+	for i, config := range rules {
+		rule, err := parseACLRule(config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %v: %v", i, err)
+		}
+		p.rules = append(p.rules, rule)
+	}
+	return p, nil
+}
+
+// Name returns the name of the policy.
+func (p *ACLPolicy) Name() string {
+	return p.name
+}
+
+func parseACLAction(action string, defaultAllow bool) (bool, error) {
+	switch strings.ToLower(action) {
+	case "":
+		return defaultAllow, nil
+	case ACLAllow:
+		return true, nil
+	case ACLDeny:
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown action %q", action)
+}
+
+func parseACLRule(config ACLRuleConfig) (aclRule, error) {
+	var rule aclRule
+	if config.Action == "" {
+		return rule, fmt.Errorf("missing action")
+	}
+	var err error
+	if rule.allow, err = parseACLAction(config.Action, false); err != nil {
+		return rule, err
+	}
+	for _, network := range config.Networks {
+		ipNet, err := parseNetwork(network)
+		if err != nil {
+			return rule, err
+		}
+		rule.networks = append(rule.networks, ipNet)
+	}
+	for _, ports := range config.Ports {
+		r, err := onet.ParsePortRange(ports)
+		if err != nil {
+			return rule, err
+		}
+		rule.ports = append(rule.ports, r)
+	}
+	for _, protocol := range config.Protocols {
+		protocol = strings.ToLower(protocol)
+		if protocol != "tcp" && protocol != "udp" {
+			return rule, fmt.Errorf("unknown protocol %q", protocol)
+		}
+		rule.protocols = append(rule.protocols, protocol)
+	}
+	for _, domain := range config.Domains {
+		domain = strings.TrimPrefix(canonicalDomain(domain), "*.")
+		if domain == "" {
+			return rule, fmt.Errorf("empty domain")
+		}
+		rule.domains = append(rule.domains, domain)
+	}
+	return rule, nil
+}
+
+// parseNetwork parses a CIDR, or a single IP address.
+func parseNetwork(network string) (*net.IPNet, error) {
+	if !strings.Contains(network, "/") {
+		ip := net.ParseIP(network)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid network %q", network)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network %q: %v", network, err)
+	}
+	return ipNet, nil
+}
+
+// matchesDomain reports whether `domain` is one of the suffixes of the rule, or
+// a subdomain of one.
+func (r *aclRule) matchesDomain(domain string) bool {
+	for _, suffix := range r.domains {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the rule matches the target, except for the
+// networks, which the caller must check.
+func (r *aclRule) matches(network, domain string, port int) bool {
+	if len(r.protocols) > 0 && !containsString(r.protocols, network) {
+		return false
+	}
+	if len(r.ports) > 0 {
+		inRange := false
+		for _, pr := range r.ports {
+			if pr.Contains(port) {
+				inRange = true
+				break
+			}
+		}
+		if !inRange {
+			return false
+		}
+	}
+	return len(r.domains) == 0 || (domain != "" && r.matchesDomain(domain))
+}
+
+func (r *aclRule) matchesIP(ip net.IP) bool {
+	if len(r.networks) == 0 {
+		return true
+	}
+	for _, ipNet := range r.networks {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// decide returns the index of the first rule that matches the target, or -1
+// if none does.  `domain` is empty for IP targets.  With a nil `ip`, it stops
+// at the first rule with networks, and returns false because the target can't
+// be decided until it's resolved.
+func (p *ACLPolicy) decide(network, domain string, ip net.IP, port int) (int, bool) {
+	for i := range p.rules {
+		rule := &p.rules[i]
+		if ip == nil && len(rule.networks) > 0 {
+			return 0, false
+		}
+		if rule.matches(network, domain, port) && (ip == nil || rule.matchesIP(ip)) {
+			return i, true
+		}
+	}
+	return -1, true
+}
+
+// targetPolicy holds the settings of a client that decide how it reaches
+// targets.
+type targetPolicy struct {
+	ipPreference IPPreference
+	// ACL policy of the client, or nil to allow all targets.
+	acl *ACLPolicy
+	// Ports that no client may reach, or nil.
+	blockedPorts *onet.PortBlocklist
+	m            metrics.ShadowsocksMetrics
+}
+
+// targetCheck applies a targetPolicy, and then a TargetIPValidator, to a
+// single target.
+type targetCheck struct {
+	policy    *targetPolicy
+	validator onet.TargetIPValidator
+	network   string
+	domain    string
+	port      int
+	// Set once the ACL has decided to allow the target.
+	allowed bool
+}
+
+// check returns the check of `tgtAddr`, a host:port, for `network`, "tcp" or
+// "udp".
+func (p *targetPolicy) check(network, tgtAddr string, validator onet.TargetIPValidator) *targetCheck {
+	c := &targetCheck{policy: p, validator: validator, network: network}
+	host, portStr, err := net.SplitHostPort(tgtAddr)
+	if err != nil {
+		return c
+	}
+	c.port, _ = strconv.Atoi(portStr)
+	if net.ParseIP(host) == nil {
+		c.domain = canonicalDomain(host)
+	}
+	return c
+}
+
+// checkHost applies the port blocklist, and the ACL rules that can be decided
+// before the target is resolved.
+func (c *targetCheck) checkHost() *onet.ConnectionError {
+	if err := c.policy.blockedPorts.Check(c.port); err != nil {
+		return err
+	}
+	if c.policy.acl == nil {
+		return nil
+	}
+	rule, ok := c.policy.acl.decide(c.network, c.domain, nil, c.port)
+	if !ok {
+		return nil
+	}
+	if err := c.apply(rule); err != nil {
+		return err
+	}
+	c.allowed = true
+	return nil
+}
+
+// checkIP applies the ACL, unless checkHost decided already, and then the
+// TargetIPValidator to an address of the target.  It's a
+// onet.TargetIPValidator.
+func (c *targetCheck) checkIP(ip net.IP) *onet.ConnectionError {
+	if c.policy.acl != nil && !c.allowed {
+		if ip == nil {
+			return onet.NewConnectionError("ERR_ADDRESS_INVALID", "Target address is not an IP address", nil)
+		}
+		rule, _ := c.policy.acl.decide(c.network, c.domain, ip, c.port)
+		if err := c.apply(rule); err != nil {
+			return err
+		}
+	}
+	return c.validator(ip)
+}
+
+// apply reports the hit of `rule`, or of the default action if it's -1, and
+// returns an error if the target is denied.
+func (c *targetCheck) apply(rule int) *onet.ConnectionError {
+	acl := c.policy.acl
+	allow, label := acl.defaultAllow, aclDefaultRule
+	if rule >= 0 {
+		allow, label = acl.rules[rule].allow, strconv.Itoa(rule)
+	}
+	action := ACLDeny
+	if allow {
+		action = ACLAllow
+	}
+	c.policy.m.AddACLHit(acl.name, label, action)
+	if !allow {
+		return onet.NewConnectionError("ERR_ACL_DENIED", fmt.Sprintf("Target denied by ACL policy %v", acl.name), nil)
+	}
+	return nil
+}
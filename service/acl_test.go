@@ -0,0 +1,184 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// aclTestMetrics records the ACL hits as "policy/rule/action".
+type aclTestMetrics struct {
+	metrics.NoOpMetrics
+	mu   sync.Mutex
+	hits []string
+}
+
+func (m *aclTestMetrics) AddACLHit(policy, rule, action string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hits = append(m.hits, policy+"/"+rule+"/"+action)
+}
+
+func makeTestACL(t *testing.T) *ACLPolicy {
+	policy, err := NewACLPolicy("test", ACLDeny, []ACLRuleConfig{
+		{Action: ACLDeny, Domains: []string{"*.Blocked.example."}},
+		{Action: ACLAllow, Protocols: []string{"udp"}, Ports: []string{"53"}},
+		{Action: ACLDeny, Networks: []string{"192.0.2.0/24", "2001:db8::1"}},
+		{Action: ACLAllow, Ports: []string{"80", "8000-8999"}},
+	})
+	require.NoError(t, err)
+	return policy
+}
+
+func TestNewACLPolicyErrors(t *testing.T) {
+	for name, rule := range map[string]ACLRuleConfig{
+		"no action":   {Ports: []string{"80"}},
+		"bad action":  {Action: "drop"},
+		"bad network": {Action: ACLDeny, Networks: []string{"192.0.2.0/33"}},
+		"bad IP":      {Action: ACLDeny, Networks: []string{"example.com"}},
+		"bad port":    {Action: ACLDeny, Ports: []string{"65536"}},
+		"bad range":   {Action: ACLDeny, Ports: []string{"90-80"}},
+		"bad proto":   {Action: ACLDeny, Protocols: []string{"sctp"}},
+		"bad domain":  {Action: ACLDeny, Domains: []string{"."}},
+	} {
+		_, err := NewACLPolicy("test", "", []ACLRuleConfig{rule})
+		assert.Error(t, err, name)
+	}
+	_, err := NewACLPolicy("test", "reject", nil)
+	assert.Error(t, err)
+}
+
+func TestACLPolicyDecide(t *testing.T) {
+	policy := makeTestACL(t)
+	for _, tc := range []struct {
+		network, domain, ip string
+		port                int
+		rule                int
+	}{
+		{"tcp", "blocked.example", "", 80, 0},
+		{"udp", "www.blocked.example", "", 53, 0},
+		{"tcp", "notblocked.example", "198.51.100.1", 80, 3},
+		{"udp", "", "192.0.2.1", 53, 1},
+		{"tcp", "", "192.0.2.1", 80, 2},
+		{"tcp", "example.com", "2001:db8::1", 8080, 2},
+		{"tcp", "", "2001:db8::2", 8080, 3},
+		{"tcp", "", "198.51.100.1", 443, -1},
+	} {
+		rule, ok := policy.decide(tc.network, tc.domain, net.ParseIP(tc.ip), tc.port)
+		assert.True(t, ok)
+		assert.Equal(t, tc.rule, rule, "%v %v %v %v", tc.network, tc.domain, tc.ip, tc.port)
+	}
+
+	// Before resolution, the rules before the first one with networks decide.
+	rule, ok := policy.decide("tcp", "www.blocked.example", nil, 80)
+	assert.True(t, ok)
+	assert.Equal(t, 0, rule)
+	_, ok = policy.decide("tcp", "example.com", nil, 80)
+	assert.False(t, ok)
+}
+
+func TestTargetCheck(t *testing.T) {
+	m := &aclTestMetrics{}
+	policy := &targetPolicy{acl: makeTestACL(t), m: m}
+
+	check := policy.check("tcp", "www.Blocked.example:80", onet.RequirePublicIP)
+	err := check.checkHost()
+	require.NotNil(t, err)
+	assert.Equal(t, "ERR_ACL_DENIED", err.Status)
+
+	// Decided before resolution, but the validator still applies.
+	check = policy.check("udp", "example.com:53", onet.RequirePublicIP)
+	assert.Nil(t, check.checkHost())
+	assert.Nil(t, check.checkIP(net.ParseIP("8.8.8.8")))
+	err = check.checkIP(net.ParseIP("10.0.0.1"))
+	require.NotNil(t, err)
+	assert.Equal(t, "ERR_ADDRESS_PRIVATE", err.Status)
+
+	check = policy.check("tcp", "192.0.2.1:80", onet.RequirePublicIP)
+	assert.Nil(t, check.checkHost())
+	err = check.checkIP(net.ParseIP("192.0.2.1"))
+	require.NotNil(t, err)
+	assert.Equal(t, "ERR_ACL_DENIED", err.Status)
+
+	check = policy.check("tcp", "example.com:443", onet.RequirePublicIP)
+	err = check.checkIP(net.ParseIP("8.8.8.8"))
+	require.NotNil(t, err)
+	assert.Equal(t, "ERR_ACL_DENIED", err.Status)
+
+	assert.Equal(t, []string{"test/0/deny", "test/1/allow", "test/2/deny", "test/default/deny"}, m.hits)
+
+	// Without a policy, only the validator applies.
+	policy = &targetPolicy{m: m}
+	check = policy.check("tcp", "www.blocked.example:80", onet.RequirePublicIP)
+	assert.Nil(t, check.checkHost())
+	assert.Nil(t, check.checkIP(net.ParseIP("8.8.8.8")))
+}
+
+func TestACLBeforeResolution(t *testing.T) {
+	stub := startStubResolver(t, false)
+	resolver := startStubResolverClient(t, stub, &metrics.NoOpMetrics{})
+	policy := &targetPolicy{acl: makeTestACL(t), m: &metrics.NoOpMetrics{}}
+
+	_, err := resolveTarget(socks.ParseAddr("ads.blocked.example:80"), resolver, policy, allowAll)
+	require.NotNil(t, err)
+	assert.Equal(t, "ERR_ACL_DENIED", err.Status)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&stub.queries))
+
+	s := NewTCPService(nil, nil, &metrics.NoOpMetrics{}, timeout, &TCPServiceOptions{
+		Resolver:          resolver,
+		TargetIPValidator: allowAll,
+	}).(*tcpService)
+	_, err = s.dial("ads.blocked.example:80", policy, nil, &metrics.ProxyMetrics{})
+	require.NotNil(t, err)
+	assert.Equal(t, "ERR_ACL_DENIED", err.Status)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&stub.queries))
+}
+
+func TestACLAfterResolution(t *testing.T) {
+	stub := startStubResolver(t, false)
+	resolver := startStubResolverClient(t, stub, &metrics.NoOpMetrics{})
+	acl, err := NewACLPolicy("no-loopback-v4", "", []ACLRuleConfig{
+		{Action: ACLDeny, Networks: []string{"127.0.0.0/8"}},
+	})
+	require.NoError(t, err)
+	policy := &targetPolicy{ipPreference: IPPreferenceIPv4, acl: acl, m: &metrics.NoOpMetrics{}}
+
+	_, connErr := resolveTarget(socks.ParseAddr("example.com:5353"), resolver, policy, allowAll)
+	require.NotNil(t, connErr)
+	assert.Equal(t, "ERR_ACL_DENIED", connErr.Status)
+
+	policy.ipPreference = IPPreferenceIPv6
+	tgtAddr, connErr := resolveTarget(socks.ParseAddr("example.com:5353"), resolver, policy, allowAll)
+	require.Nil(t, connErr)
+	assert.Equal(t, stubIPv6, tgtAddr.IP)
+}
+
+func TestTCPServiceKeyACL(t *testing.T) {
+	acl := makeTestACL(t)
+	s := NewTCPService(nil, nil, &metrics.NoOpMetrics{}, timeout, &TCPServiceOptions{ACL: acl}).(*tcpService)
+	assert.Equal(t, acl, s.targetPolicyFor(&CipherEntry{}).acl)
+	keyACL, err := NewACLPolicy("key", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, keyACL, s.targetPolicyFor(&CipherEntry{ACL: keyACL}).acl)
+}
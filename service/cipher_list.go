@@ -18,6 +18,7 @@ import (
 	"container/list"
 	"net"
 	"sync"
+	"time"
 
 	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
 )
@@ -28,18 +29,74 @@ const minSaltEntropy = 16
 // CipherEntry holds a Cipher with an identifier.
 // The public fields are constant, but lastClientIP is mutable under cipherList.mu.
 type CipherEntry struct {
+	// ID identifies the key in metrics and limits.  The entries of a key with
+	// several secrets share it.
 	ID            string
 	Cipher        *ss.Cipher
 	SaltGenerator ServerSaltGenerator
+	// IdleTimeout and MaxLifetime override the limits of TCPServiceOptions for
+	// connections that use this key, unless they are zero.  Negative values
+	// remove the limit for this key.
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	// NATFilter overrides the NAT filtering behavior of the UDP service for
+	// clients that use this key, unless it is empty.
+	NATFilter NATFilter
+	// MaxNATEntries overrides UDPServiceOptions.MaxNATEntriesPerKey for this
+	// key, unless it is zero.  Negative values remove the limit for this key.
+	MaxNATEntries int
+	// IPPreference overrides the address family preference of the services
+	// for clients that use this key, unless it is empty.
+	IPPreference IPPreference
+	// ACL overrides the destination policy of the services for clients that
+	// use this key, unless it is nil.
+	ACL *ACLPolicy
+	// NotBefore and NotAfter bound the time when the key is valid, unless they
+	// are zero.  Outside of it, clients can't authenticate with the key.
+	NotBefore time.Time
+	NotAfter  time.Time
+	// CloseOnExpiry closes the connections and NAT entries of the key at
+	// NotAfter, instead of letting them finish.
+	CloseOnExpiry bool
 	lastClientIP  net.IP
 }
 
+// ValidAt reports whether the key is valid at time `t`.
+func (e *CipherEntry) ValidAt(t time.Time) bool {
+	return (e.NotBefore.IsZero() || !t.Before(e.NotBefore)) && !e.expiredAt(t)
+}
+
+// expiredAt reports whether the key has expired at time `t`.  Sessions that
+// outlive the key can't reach new targets.
+func (e *CipherEntry) expiredAt(t time.Time) bool {
+	return !e.NotAfter.IsZero() && !t.Before(e.NotAfter)
+}
+
+// closeTime returns when the connections of the key must be closed, or zero if
+// they can outlive it.
+func (e *CipherEntry) closeTime() time.Time {
+	if !e.CloseOnExpiry {
+		return time.Time{}
+	}
+	return e.NotAfter
+}
+
 // MakeCipherEntry constructs a CipherEntry.
 func MakeCipherEntry(id string, cipher *ss.Cipher, secret string) CipherEntry {
+	return makeCipherEntry(id, cipher, []byte(secret))
+}
+
+// MakeCipherEntryFromKey constructs a CipherEntry for a cipher that was
+// created from a raw key with ss.NewCipherFromKey.
+func MakeCipherEntryFromKey(id string, cipher *ss.Cipher, key []byte) CipherEntry {
+	return makeCipherEntry(id, cipher, key)
+}
+
+func makeCipherEntry(id string, cipher *ss.Cipher, saltKey []byte) CipherEntry {
 	var saltGenerator ServerSaltGenerator
 	if cipher.SaltSize()-ServerSaltMarkLen >= minSaltEntropy {
 		// Mark salts with a tag for reverse replay protection.
-		saltGenerator = NewServerSaltGenerator(secret)
+		saltGenerator = NewServerSaltGeneratorFromKey(saltKey)
 	} else {
 		// Adding a tag would leave too little randomness to protect
 		// against accidental salt reuse, so don't mark the salts.
@@ -53,7 +110,8 @@ func MakeCipherEntry(id string, cipher *ss.Cipher, secret string) CipherEntry {
 }
 
 // CipherList is a thread-safe collection of CipherEntry elements that allows for
-// snapshotting and moving to front.
+// snapshotting and moving to front.  A key with several secrets, e.g. during a
+// rotation, has one entry per secret, all with the key's ID.
 type CipherList interface {
 	// Returns a snapshot of the cipher list optimized for this client IP
 	SnapshotForClientIP(clientIP net.IP) []*list.Element
@@ -80,21 +138,40 @@ func matchesIP(e *list.Element, clientIP net.IP) bool {
 	return clientIP != nil && clientIP.Equal(c.lastClientIP)
 }
 
+// SnapshotForClientIP returns the ciphers that were last used by `clientIP`
+// first, then the other ciphers of the same keys, since the entries with the
+// same ID are the secrets of one key, and then the rest in recency order.
 func (cl *cipherList) SnapshotForClientIP(clientIP net.IP) []*list.Element {
 	cl.mu.RLock()
 	defer cl.mu.RUnlock()
 	cipherArray := make([]*list.Element, cl.list.Len())
 	i := 0
+	// IDs of the keys used by the client, if any.
+	var clientKeys map[string]bool
 	// First pass: put all ciphers with matching last known IP at the front.
 	for e := cl.list.Front(); e != nil; e = e.Next() {
 		if matchesIP(e, clientIP) {
 			cipherArray[i] = e
 			i++
+			if clientKeys == nil {
+				clientKeys = make(map[string]bool)
+			}
+			clientKeys[e.Value.(*CipherEntry).ID] = true
+		}
+	}
+	// Second pass: the other secrets of those keys, in case the client has
+	// switched to one of them.
+	if clientKeys != nil {
+		for e := cl.list.Front(); e != nil; e = e.Next() {
+			if !matchesIP(e, clientIP) && clientKeys[e.Value.(*CipherEntry).ID] {
+				cipherArray[i] = e
+				i++
+			}
 		}
 	}
-	// Second pass: include all remaining ciphers in recency order.
+	// Third pass: include all remaining ciphers in recency order.
 	for e := cl.list.Front(); e != nil; e = e.Next() {
-		if !matchesIP(e, clientIP) {
+		if !matchesIP(e, clientIP) && (clientKeys == nil || !clientKeys[e.Value.(*CipherEntry).ID]) {
 			cipherArray[i] = e
 			i++
 		}
@@ -15,9 +15,11 @@
 package service
 
 import (
+	"container/list"
 	"math/rand"
 	"net"
 	"testing"
+	"time"
 
 	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
 )
@@ -62,3 +64,55 @@ func BenchmarkSnapshot(b *testing.B) {
 		}
 	})
 }
+
+func TestCipherEntryValidAt(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+	for _, tc := range []struct {
+		entry CipherEntry
+		t     time.Time
+		valid bool
+	}{
+		{CipherEntry{}, start, true},
+		{CipherEntry{NotBefore: start}, start.Add(-time.Second), false},
+		{CipherEntry{NotBefore: start}, start, true},
+		{CipherEntry{NotAfter: end}, end.Add(-time.Second), true},
+		{CipherEntry{NotAfter: end}, end, false},
+		{CipherEntry{NotBefore: start, NotAfter: end}, start.Add(time.Hour), true},
+		{CipherEntry{NotBefore: start, NotAfter: end}, end.Add(time.Hour), false},
+	} {
+		if valid := tc.entry.ValidAt(tc.t); valid != tc.valid {
+			t.Errorf("ValidAt(%v) of [%v, %v) = %v", tc.t, tc.entry.NotBefore, tc.entry.NotAfter, valid)
+		}
+	}
+	if !(&CipherEntry{NotAfter: end}).closeTime().IsZero() {
+		t.Error("Connections should outlive the key unless CloseOnExpiry is set")
+	}
+	if closeTime := (&CipherEntry{NotAfter: end, CloseOnExpiry: true}).closeTime(); !closeTime.Equal(end) {
+		t.Errorf("Wrong close time %v", closeTime)
+	}
+}
+
+func TestSnapshotGroupsSecretsOfKey(t *testing.T) {
+	l := list.New()
+	for _, id := range []string{"a", "b", "a", "c", "b"} {
+		l.PushBack(&CipherEntry{ID: id})
+	}
+	ciphers := NewCipherList()
+	ciphers.Update(l)
+	entries := ciphers.SnapshotForClientIP(nil)
+	clientIP := net.ParseIP("192.0.2.1")
+	// The client last used the second secret of "b".
+	ciphers.MarkUsedByClientIP(entries[4], clientIP)
+
+	snapshot := ciphers.SnapshotForClientIP(clientIP)
+	if len(snapshot) != len(entries) {
+		t.Fatalf("Wrong snapshot size %v", len(snapshot))
+	}
+	expected := []*list.Element{entries[4], entries[1], entries[0], entries[2], entries[3]}
+	for i, e := range snapshot {
+		if e != expected[i] {
+			t.Errorf("Entry %v is %v, expected %v", i, e.Value.(*CipherEntry).ID, expected[i].Value.(*CipherEntry).ID)
+		}
+	}
+}
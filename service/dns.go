@@ -0,0 +1,427 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Results of a DNS query handled by the DNSProxy, for metrics.
+const (
+	DNSResultCached   = "cached"
+	DNSResultUpstream = "upstream"
+	DNSResultBlocked  = "blocked"
+	DNSResultError    = "error"
+)
+
+const (
+	defaultDNSTimeout   = 5 * time.Second
+	defaultDNSCacheSize = 10_000
+	// Responses are cached for at most this long, regardless of their TTL.
+	maxDNSCacheTTL = time.Hour
+)
+
+// DNSProxyOptions holds the optional settings of a DNSProxy.
+type DNSProxyOptions struct {
+	// Blocklist holds domains that resolve to NXDOMAIN, along with all their
+	// subdomains.
+	Blocklist []string
+	// CacheSize is the maximum number of cached responses.  Defaults to
+	// 10,000.  Negative disables the cache.
+	CacheSize int
+	// Timeout for the upstream queries.  Defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+// DNSProxy answers the DNS queries of clients through a single upstream
+// resolver, instead of relaying them to whatever resolver each client chose.
+// The responses are cached, and may be shared by several services.
+type DNSProxy struct {
+	upstream  *dnsUpstream
+	cache     *dnsCache
+	blocklist map[string]bool
+}
+
+// NewDNSProxy creates a DNSProxy that sends queries to the resolver at
+// `upstream`, a UDP host:port.
+func NewDNSProxy(upstream string, opts ...*DNSProxyOptions) (*DNSProxy, error) {
+	timeout := defaultDNSTimeout
+	cacheSize := defaultDNSCacheSize
+	blocklist := make(map[string]bool)
+	if opts != nil {
+		if len(opts) > 1 {
+			logger.Errorf("NewDNSProxy: at most one DNSProxyOptions argument is allowed")
+		}
+		if opts[0].Timeout > 0 {
+			timeout = opts[0].Timeout
+		}
+		if opts[0].CacheSize != 0 {
+			cacheSize = opts[0].CacheSize
+		}
+		for _, domain := range opts[0].Blocklist {
+			blocklist[canonicalDomain(domain)] = true
+		}
+	}
+	u, err := newDNSUpstream(upstream, timeout)
+	if err != nil {
+		return nil, err
+	}
+	p := &DNSProxy{upstream: u, blocklist: blocklist}
+	if cacheSize > 0 {
+		p.cache = newDNSCache(cacheSize)
+	}
+	return p, nil
+}
+
+// Close stops the proxy.  Pending and future queries fail.
+func (p *DNSProxy) Close() error {
+	return p.upstream.Close()
+}
+
+// canonicalDomain lowercases `domain` and removes the trailing dot.
+func canonicalDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// isBlocked reports whether `domain` or any of its parents is in the blocklist.
+func (p *DNSProxy) isBlocked(domain string) bool {
+	if len(p.blocklist) == 0 {
+		return false
+	}
+	for domain != "" {
+		if p.blocklist[domain] {
+			return true
+		}
+		dot := strings.IndexByte(domain, '.')
+		if dot < 0 {
+			break
+		}
+		domain = domain[dot+1:]
+	}
+	return false
+}
+
+// Query returns the response to the DNS message `query`, and how it was
+// obtained: DNSResultCached, DNSResultUpstream or DNSResultBlocked.
+func (p *DNSProxy) Query(query []byte) ([]byte, string, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, DNSResultError, fmt.Errorf("failed to parse DNS query: %v", err)
+	}
+	if header.Response {
+		return nil, DNSResultError, errors.New("DNS message is not a query")
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, DNSResultError, fmt.Errorf("failed to parse DNS question: %v", err)
+	}
+	domain := canonicalDomain(question.Name.String())
+
+	if p.isBlocked(domain) {
+		response, err := blockedResponse(header, question)
+		return response, DNSResultBlocked, err
+	}
+
+	key := dnsCacheKey{domain, question.Type, question.Class, dnssecOK(&parser)}
+	if response := p.cache.get(key, header.ID, time.Now()); response != nil {
+		return response, DNSResultCached, nil
+	}
+	response, err := p.upstream.exchange(query)
+	if err != nil {
+		return nil, DNSResultError, err
+	}
+	p.cache.put(key, response, time.Now())
+	return response, DNSResultUpstream, nil
+}
+
+// dnssecOK reports whether the query sets the EDNS DO bit, which asks for the
+// DNSSEC records.  `parser` must be positioned after the first question.
+func dnssecOK(parser *dnsmessage.Parser) bool {
+	if err := parser.SkipAllQuestions(); err != nil {
+		return false
+	}
+	if err := parser.SkipAllAnswers(); err != nil {
+		return false
+	}
+	if err := parser.SkipAllAuthorities(); err != nil {
+		return false
+	}
+	for {
+		header, err := parser.AdditionalHeader()
+		if err != nil {
+			return false
+		}
+		if header.Type == dnsmessage.TypeOPT {
+			return header.DNSSECAllowed()
+		}
+		if err := parser.SkipAdditional(); err != nil {
+			return false
+		}
+	}
+}
+
+// blockedResponse answers the query with NXDOMAIN.
+func blockedResponse(query dnsmessage.Header, question dnsmessage.Question) ([]byte, error) {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			OpCode:             query.OpCode,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              dnsmessage.RCodeNameError,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+	return msg.Pack()
+}
+
+// dnsUpstream sends queries to the upstream resolver through a single socket,
+// giving each pending query a random unique ID.
+type dnsUpstream struct {
+	conn    net.Conn
+	timeout time.Duration
+	mu      sync.Mutex
+	pending map[uint16]chan []byte
+}
+
+func newDNSUpstream(addr string, timeout time.Duration) (*dnsUpstream, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to DNS resolver %v: %v", addr, err)
+	}
+	u := &dnsUpstream{conn: conn, timeout: timeout, pending: make(map[uint16]chan []byte)}
+	go u.readResponses()
+	return u, nil
+}
+
+func (u *dnsUpstream) Close() error {
+	return u.conn.Close()
+}
+
+// readResponses delivers the responses to the pending queries until the
+// socket is closed.
+func (u *dnsUpstream) readResponses() {
+	buf := make([]byte, serverUDPBufferSize)
+	for {
+		n, err := u.conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Debugf("Failed to read DNS response: %v", err)
+			continue
+		}
+		if n < 2 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(buf)
+		u.mu.Lock()
+		ch := u.pending[id]
+		delete(u.pending, id)
+		u.mu.Unlock()
+		if ch != nil {
+			ch <- append([]byte(nil), buf[:n]...)
+		}
+	}
+}
+
+// register reserves a random ID for a new query.
+func (u *dnsUpstream) register() (uint16, chan []byte, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.pending) > 0xffff {
+		return 0, nil, errors.New("too many pending DNS queries")
+	}
+	var b [2]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, nil, err
+		}
+		id := binary.BigEndian.Uint16(b[:])
+		if _, ok := u.pending[id]; !ok {
+			ch := make(chan []byte, 1)
+			u.pending[id] = ch
+			return id, ch, nil
+		}
+	}
+}
+
+func (u *dnsUpstream) unregister(id uint16) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.pending, id)
+}
+
+// exchange sends `query` upstream and returns the response, with the ID of
+// `query`.
+func (u *dnsUpstream) exchange(query []byte) ([]byte, error) {
+	id, ch, err := u.register()
+	if err != nil {
+		return nil, err
+	}
+	defer u.unregister(id)
+
+	upstreamQuery := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(upstreamQuery, id)
+	if _, err := u.conn.Write(upstreamQuery); err != nil {
+		return nil, fmt.Errorf("failed to send DNS query: %v", err)
+	}
+	timer := time.NewTimer(u.timeout)
+	defer timer.Stop()
+	select {
+	case response := <-ch:
+		copy(response, query[:2])
+		return response, nil
+	case <-timer.C:
+		return nil, errors.New("DNS query timed out")
+	}
+}
+
+type dnsCacheKey struct {
+	domain string
+	qtype  dnsmessage.Type
+	class  dnsmessage.Class
+	// Responses to queries with the DO bit may hold DNSSEC records.
+	dnssecOK bool
+}
+
+type dnsCacheEntry struct {
+	response []byte
+	stored   time.Time
+	expires  time.Time
+}
+
+// dnsCache holds responses until their TTL expires.  When it's full, expired
+// entries are dropped, or an arbitrary one if there are none.
+type dnsCache struct {
+	mu      sync.Mutex
+	maxSize int
+	entries map[dnsCacheKey]dnsCacheEntry
+}
+
+func newDNSCache(maxSize int) *dnsCache {
+	return &dnsCache{maxSize: maxSize, entries: make(map[dnsCacheKey]dnsCacheEntry)}
+}
+
+// get returns the cached response for `key` with the given ID, and its TTLs
+// reduced by the time spent in the cache, or nil on a miss.  A nil cache
+// always misses.
+func (c *dnsCache) get(key dnsCacheKey, id uint16, now time.Time) []byte {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && !now.Before(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(entry.response); err != nil {
+		return nil
+	}
+	msg.ID = id
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	forEachResource(&msg, func(h *dnsmessage.ResourceHeader) {
+		if h.TTL > age {
+			h.TTL -= age
+		} else {
+			h.TTL = 0
+		}
+	})
+	response, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// put caches `response` for the smallest TTL among its records.  Truncated
+// responses, failures and responses without records are not cached.
+func (c *dnsCache) put(key dnsCacheKey, response []byte, now time.Time) {
+	if c == nil {
+		return
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		return
+	}
+	if msg.Truncated || (msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError) {
+		return
+	}
+	ttl := maxDNSCacheTTL
+	hasRecords := false
+	forEachResource(&msg, func(h *dnsmessage.ResourceHeader) {
+		hasRecords = true
+		if d := time.Duration(h.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+	})
+	if !hasRecords || ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxSize {
+		c.makeRoom(now)
+	}
+	c.entries[key] = dnsCacheEntry{response: response, stored: now, expires: now.Add(ttl)}
+}
+
+// makeRoom drops the expired entries, or an arbitrary one if none has expired.
+// It must be called with the lock held.
+func (c *dnsCache) makeRoom(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	if len(c.entries) < c.maxSize {
+		return
+	}
+	for key := range c.entries {
+		delete(c.entries, key)
+		return
+	}
+}
+
+// forEachResource calls `f` on the header of each record in `msg`, except OPT
+// pseudo-records, whose TTL field holds flags.
+func forEachResource(msg *dnsmessage.Message, f func(*dnsmessage.ResourceHeader)) {
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range section {
+			if section[i].Header.Type != dnsmessage.TypeOPT {
+				f(&section[i].Header)
+			}
+		}
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The stub answers with loopback addresses, so that tests can reach them.
+var stubAnswer = [4]byte{127, 0, 0, 1}
+var stubAnswer6 = [16]byte{15: 1}
+
+const stubTTL = 300
+
+// stubResolver is a local DNS server that answers every A and AAAA query with
+// stubAnswer and stubAnswer6, unless it's silent.  Names under "missing." don't
+// exist.
+type stubResolver struct {
+	conn    net.PacketConn
+	queries int32
+	silent  bool
+}
+
+func startStubResolver(t testing.TB, silent bool) *stubResolver {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	r := &stubResolver{conn: conn, silent: silent}
+	go r.serve()
+	return r
+}
+
+func (r *stubResolver) addr() string {
+	return r.conn.LocalAddr().String()
+}
+
+func (r *stubResolver) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&r.queries, 1)
+		if r.silent {
+			continue
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		response := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true},
+			Questions: query.Questions,
+		}
+		for _, q := range query.Questions {
+			header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: stubTTL}
+			switch {
+			case strings.HasPrefix(q.Name.String(), "missing."):
+				response.RCode = dnsmessage.RCodeNameError
+			case q.Type == dnsmessage.TypeA:
+				response.Answers = append(response.Answers, dnsmessage.Resource{
+					Header: header, Body: &dnsmessage.AResource{A: stubAnswer},
+				})
+			case q.Type == dnsmessage.TypeAAAA:
+				response.Answers = append(response.Answers, dnsmessage.Resource{
+					Header: header, Body: &dnsmessage.AAAAResource{AAAA: stubAnswer6},
+				})
+			}
+		}
+		packed, err := response.Pack()
+		if err != nil {
+			continue
+		}
+		r.conn.WriteTo(packed, addr)
+	}
+}
+
+func makeDNSQuery(t testing.TB, id uint16, name string) []byte {
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := query.Pack()
+	require.NoError(t, err)
+	return packed
+}
+
+func parseDNSResponse(t testing.TB, response []byte) dnsmessage.Message {
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(response))
+	require.True(t, msg.Response)
+	return msg
+}
+
+func TestDNSProxyUpstream(t *testing.T) {
+	stub := startStubResolver(t, false)
+	proxy, err := NewDNSProxy(stub.addr())
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	response, result, err := proxy.Query(makeDNSQuery(t, 1234, "example.com."))
+	require.NoError(t, err)
+	assert.Equal(t, DNSResultUpstream, result)
+	msg := parseDNSResponse(t, response)
+	assert.Equal(t, uint16(1234), msg.ID)
+	require.Len(t, msg.Answers, 1)
+	assert.Equal(t, stubAnswer, msg.Answers[0].Body.(*dnsmessage.AResource).A)
+}
+
+func TestDNSProxyCache(t *testing.T) {
+	stub := startStubResolver(t, false)
+	proxy, err := NewDNSProxy(stub.addr())
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	_, result, err := proxy.Query(makeDNSQuery(t, 1, "example.com."))
+	require.NoError(t, err)
+	assert.Equal(t, DNSResultUpstream, result)
+	// Names are case-insensitive.
+	response, result, err := proxy.Query(makeDNSQuery(t, 2, "EXAMPLE.com."))
+	require.NoError(t, err)
+	assert.Equal(t, DNSResultCached, result)
+	msg := parseDNSResponse(t, response)
+	assert.Equal(t, uint16(2), msg.ID)
+	require.Len(t, msg.Answers, 1)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&stub.queries))
+
+	_, result, err = proxy.Query(makeDNSQuery(t, 3, "other.example.com."))
+	require.NoError(t, err)
+	assert.Equal(t, DNSResultUpstream, result)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&stub.queries))
+}
+
+func TestDNSProxyCacheDNSSECOK(t *testing.T) {
+	stub := startStubResolver(t, false)
+	proxy, err := NewDNSProxy(stub.addr())
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	var opt dnsmessage.ResourceHeader
+	require.NoError(t, opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, true))
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+		Additionals: []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}},
+	}
+	dnssecQuery, err := query.Pack()
+	require.NoError(t, err)
+
+	_, result, err := proxy.Query(makeDNSQuery(t, 1, "example.com."))
+	require.NoError(t, err)
+	assert.Equal(t, DNSResultUpstream, result)
+	// The response without DNSSEC records doesn't answer a query with the DO bit.
+	_, result, err = proxy.Query(dnssecQuery)
+	require.NoError(t, err)
+	assert.Equal(t, DNSResultUpstream, result)
+	_, result, err = proxy.Query(dnssecQuery)
+	require.NoError(t, err)
+	assert.Equal(t, DNSResultCached, result)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&stub.queries))
+}
+
+func TestDNSProxyNoCache(t *testing.T) {
+	stub := startStubResolver(t, false)
+	proxy, err := NewDNSProxy(stub.addr(), &DNSProxyOptions{CacheSize: -1})
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	for i := 0; i < 2; i++ {
+		_, result, err := proxy.Query(makeDNSQuery(t, 1, "example.com."))
+		require.NoError(t, err)
+		assert.Equal(t, DNSResultUpstream, result)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&stub.queries))
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	stub := startStubResolver(t, false)
+	proxy, err := NewDNSProxy(stub.addr())
+	require.NoError(t, err)
+	defer proxy.Close()
+	response, _, err := proxy.Query(makeDNSQuery(t, 1, "example.com."))
+	require.NoError(t, err)
+
+	cache := newDNSCache(10)
+	key := dnsCacheKey{"example.com", dnsmessage.TypeA, dnsmessage.ClassINET, false}
+	stored := time.Now()
+	cache.put(key, response, stored)
+
+	msg := parseDNSResponse(t, cache.get(key, 7, stored.Add(100*time.Second)))
+	assert.Equal(t, uint16(7), msg.ID)
+	assert.Equal(t, uint32(stubTTL-100), msg.Answers[0].Header.TTL)
+
+	assert.Nil(t, cache.get(key, 8, stored.Add(stubTTL*time.Second)))
+}
+
+func TestDNSCacheFull(t *testing.T) {
+	stub := startStubResolver(t, false)
+	proxy, err := NewDNSProxy(stub.addr())
+	require.NoError(t, err)
+	defer proxy.Close()
+	response, _, err := proxy.Query(makeDNSQuery(t, 1, "example.com."))
+	require.NoError(t, err)
+
+	cache := newDNSCache(2)
+	now := time.Now()
+	for _, domain := range []string{"a", "b", "c"} {
+		cache.put(dnsCacheKey{domain, dnsmessage.TypeA, dnsmessage.ClassINET, false}, response, now)
+	}
+	assert.Len(t, cache.entries, 2)
+}
+
+func TestDNSProxyBlocklist(t *testing.T) {
+	stub := startStubResolver(t, false)
+	proxy, err := NewDNSProxy(stub.addr(), &DNSProxyOptions{Blocklist: []string{"Blocked.example."}})
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	for _, name := range []string{"blocked.example.", "ads.blocked.example."} {
+		response, result, err := proxy.Query(makeDNSQuery(t, 5, name))
+		require.NoError(t, err)
+		assert.Equal(t, DNSResultBlocked, result)
+		msg := parseDNSResponse(t, response)
+		assert.Equal(t, uint16(5), msg.ID)
+		assert.Equal(t, dnsmessage.RCodeNameError, msg.RCode)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&stub.queries))
+
+	_, result, err := proxy.Query(makeDNSQuery(t, 6, "notblocked.example."))
+	require.NoError(t, err)
+	assert.Equal(t, DNSResultUpstream, result)
+}
+
+func TestDNSProxyTimeout(t *testing.T) {
+	stub := startStubResolver(t, true)
+	proxy, err := NewDNSProxy(stub.addr(), &DNSProxyOptions{Timeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	_, result, err := proxy.Query(makeDNSQuery(t, 1, "example.com."))
+	assert.Error(t, err)
+	assert.Equal(t, DNSResultError, result)
+	assert.Empty(t, proxy.upstream.pending)
+}
+
+func TestDNSProxyInvalidQuery(t *testing.T) {
+	stub := startStubResolver(t, false)
+	proxy, err := NewDNSProxy(stub.addr())
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	_, result, err := proxy.Query([]byte{1, 2, 3})
+	assert.Error(t, err)
+	assert.Equal(t, DNSResultError, result)
+}
@@ -0,0 +1,161 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+)
+
+// fallbackDialTimeout limits the time to connect to the fallback server.
+const fallbackDialTimeout = 5 * time.Second
+
+// fallbackHeaderTimeout limits the time to receive the bytes needed to find the
+// access key once the first ones have arrived, when there is a fallback server.
+// Clients send them in one write, so a connection that stops short of them is
+// a probe, like "GET / HTTP/1.0\r\n\r\n", that waits for the server to answer.
+const fallbackHeaderTimeout = 2 * time.Second
+
+// Fallback holds the address of the decoy server that receives the TCP
+// connections that fail authentication, so that the port behaves like that
+// server to active probers.  It can be replaced while in use, so that it can be
+// reloaded with the config.
+type Fallback struct {
+	addr atomic.Value // string
+}
+
+// NewFallback creates a Fallback to `addr`, a host:port.  An empty address
+// disables it.
+func NewFallback(addr string) *Fallback {
+	f := &Fallback{}
+	f.Set(addr)
+	return f
+}
+
+// Set replaces the address of the fallback server.
+func (f *Fallback) Set(addr string) {
+	f.addr.Store(addr)
+}
+
+// Addr returns the address of the fallback server, or "" if disabled.  A nil
+// Fallback is disabled.
+func (f *Fallback) Addr() string {
+	if f == nil {
+		return ""
+	}
+	return f.addr.Load().(string)
+}
+
+// ValidateFallbackAddr returns an error if `addr` is not a valid address for a
+// Fallback.
+func ValidateFallbackAddr(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid fallback address %q: %v", addr, err)
+	}
+	if portNum, err := strconv.Atoi(port); err != nil || portNum <= 0 || portNum > 65535 || host == "" {
+		return fmt.Errorf("invalid fallback address %q", addr)
+	}
+	return nil
+}
+
+// partialHeaderReader moves the read deadline of `conn` to `timeout` after the
+// first bytes arrive, unless `deadline` is sooner, so that short probes reach
+// the fallback server without waiting for the handshake timeout.
+type partialHeaderReader struct {
+	io.Reader
+	conn     onet.TCPConn
+	timeout  time.Duration
+	deadline time.Time
+	started  bool
+}
+
+func (r *partialHeaderReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 && !r.started {
+		r.started = true
+		if deadline := time.Now().Add(r.timeout); deadline.Before(r.deadline) {
+			r.conn.SetReadDeadline(deadline)
+		}
+	}
+	return n, err
+}
+
+// Results of fallbacks in metrics.
+const (
+	fallbackOK        = "ok"
+	fallbackDialError = "dial_error"
+	fallbackError     = "relay_error"
+)
+
+// handleProbe takes care of a connection that failed authentication with
+// `status`.  It forwards the connection to the fallback server if there is one,
+// starting with what was read from `clientReader`, and otherwise absorbs it.
+// Connections handed to the fallback server call `release`, because it's up to
+// the fallback server to limit them, and `watchdog` applies the service's idle
+// timeout and maximum lifetime, counted from `connStart`, to their relay.
+func (s *tcpService) handleProbe(listenerPort int, clientConn onet.TCPConn, clientReader io.Reader, watchdog *connWatchdog, connStart time.Time, release func(), clientLocation, status string, proxyMetrics *metrics.ProxyMetrics) {
+	addr := s.fallback.Addr()
+	if addr == "" {
+		s.absorbProbe(listenerPort, clientConn, clientLocation, status, proxyMetrics)
+		return
+	}
+	tgtConn, err := net.DialTimeout("tcp", addr, fallbackDialTimeout)
+	if err != nil {
+		logger.Warningf("Failed to connect to fallback %v: %v", addr, err)
+		s.m.AddTCPFallback(status, fallbackDialError, listenerPort, *proxyMetrics)
+		s.absorbProbe(listenerPort, clientConn, clientLocation, status, proxyMetrics)
+		return
+	}
+	defer tgtConn.Close()
+	release()
+	watchdog.closeOnFire(tgtConn)
+	watchdog.start(s.idleTimeout, s.maxLifetime, connStart, time.Time{})
+	// The fallback server decides when the connection is over, like it would
+	// if it had accepted it.
+	clientConn.SetReadDeadline(time.Time{})
+
+	fromClientErrCh := make(chan error)
+	go func() {
+		_, fromClientErr := io.Copy(tgtConn, clientReader)
+		tgtConn.(*net.TCPConn).CloseWrite()
+		fromClientErrCh <- fromClientErr
+	}()
+	_, fromTargetErr := io.Copy(clientConn, tgtConn)
+	clientConn.CloseWrite()
+	// The session is over once the fallback server is done with it.
+	clientConn.SetReadDeadline(time.Now())
+	fromClientErr := <-fromClientErrCh
+	if netErr, ok := fromClientErr.(net.Error); ok && netErr.Timeout() {
+		fromClientErr = nil
+	}
+
+	result := fallbackOK
+	if fromClientErr != nil || fromTargetErr != nil {
+		logger.Debugf("Fallback relay failed: %v, %v", fromClientErr, fromTargetErr)
+		result = fallbackError
+	}
+	s.m.AddTCPFallback(status, result, listenerPort, *proxyMetrics)
+}
@@ -0,0 +1,211 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startDecoyServer starts a server that answers each connection with "decoy:"
+// and everything it received, once the client has closed its side.
+func startDecoyServer(t *testing.T) *net.TCPListener {
+	listener := makeLocalhostListener(t)
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request, _ := ioutil.ReadAll(conn)
+				conn.Write(append([]byte("decoy:"), request...))
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+// sendProbe sends `request` to `addr`, closes the write side, and returns the
+// response.
+func sendProbe(t *testing.T, addr *net.TCPAddr, request []byte) []byte {
+	conn, err := net.DialTCP("tcp", nil, addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(request)
+	require.NoError(t, err)
+	conn.CloseWrite()
+	response, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	return response
+}
+
+func TestTCPFallback(t *testing.T) {
+	decoy := startDecoyServer(t)
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	fallback := NewFallback(decoy.Addr().String())
+	s := NewTCPService(cipherList, nil, testMetrics, 200*time.Millisecond, &TCPServiceOptions{Fallback: fallback})
+	listener := makeLocalhostListener(t)
+	go s.Serve(onet.AdaptListener(listener))
+	addr := listener.Addr().(*net.TCPAddr)
+
+	// Longer and shorter than the bytes needed to find the key.
+	long := []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\nUser-Agent: curl/8.0\r\n\r\n")
+	short := []byte("GET / HTTP/1.0\r\n\r\n")
+	assert.Equal(t, "decoy:"+string(long), string(sendProbe(t, addr, long)))
+	assert.Equal(t, "decoy:"+string(short), string(sendProbe(t, addr, short)))
+
+	// Without a fallback, the probes are absorbed.
+	fallback.Set("")
+	assert.Empty(t, sendProbe(t, addr, long))
+
+	require.NoError(t, s.GracefulStop())
+	assert.Equal(t, []string{"ERR_CIPHER/ok", "ERR_CIPHER/ok"}, testMetrics.fallbacks)
+	assert.Equal(t, []string{"ERR_CIPHER"}, testMetrics.probeStatus)
+	assert.Equal(t, []string{"ERR_CIPHER", "ERR_CIPHER", "ERR_CIPHER"}, testMetrics.closeStatus)
+	require.Equal(t, 3, len(testMetrics.probeData))
+	assert.Equal(t, int64(len(long)), testMetrics.probeData[0].ClientProxy)
+	assert.Equal(t, int64(len("decoy:")+len(long)), testMetrics.probeData[0].ProxyClient)
+}
+
+func TestTCPFallbackShortProbe(t *testing.T) {
+	// Answers the first read, like a server answering a request.
+	decoy := makeLocalhostListener(t)
+	defer decoy.Close()
+	go func() {
+		for {
+			conn, err := decoy.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 100)
+				n, _ := conn.Read(buf)
+				conn.Write(append([]byte("decoy:"), buf[:n]...))
+			}()
+		}
+	}()
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	const readTimeout = 10 * time.Second
+	s := NewTCPService(cipherList, nil, testMetrics, readTimeout, &TCPServiceOptions{Fallback: NewFallback(decoy.Addr().String())})
+	s.(*tcpService).headerTimeout = 100 * time.Millisecond
+	listener := makeLocalhostListener(t)
+	go s.Serve(onet.AdaptListener(listener))
+
+	// The probe is shorter than the bytes needed to find the key, and waits for
+	// the answer without closing its side.
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer conn.Close()
+	probe := []byte("GET / HTTP/1.0\r\n\r\n")
+	require.Less(t, len(probe), bytesForKeyFinding)
+	start := time.Now()
+	_, err = conn.Write(probe)
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(readTimeout / 2))
+	response, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "decoy:"+string(probe), string(response))
+	assert.Less(t, time.Since(start), readTimeout/2)
+
+	require.NoError(t, s.GracefulStop())
+	assert.Equal(t, []string{"ERR_CIPHER/ok"}, testMetrics.fallbacks)
+}
+
+func TestTCPFallbackIdleTimeout(t *testing.T) {
+	// Never answers nor closes the connection.
+	decoy := makeLocalhostListener(t)
+	defer decoy.Close()
+	go func() {
+		for {
+			conn, err := decoy.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				ioutil.ReadAll(conn)
+			}()
+		}
+	}()
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	const idleTimeout = 200 * time.Millisecond
+	s := NewTCPService(cipherList, nil, testMetrics, 100*time.Millisecond, &TCPServiceOptions{
+		Fallback:    NewFallback(decoy.Addr().String()),
+		IdleTimeout: idleTimeout,
+	})
+	listener := makeLocalhostListener(t)
+	go s.Serve(onet.AdaptListener(listener))
+
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(make([]byte, 100))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(10 * idleTimeout))
+	_, err = ioutil.ReadAll(conn)
+	var netErr net.Error
+	require.False(t, errors.As(err, &netErr) && netErr.Timeout(), "Idle fallback relay wasn't closed")
+
+	require.NoError(t, s.GracefulStop())
+	assert.Equal(t, []string{"ERR_IDLE_TIMEOUT"}, testMetrics.closeStatus)
+}
+
+func TestTCPFallbackDialError(t *testing.T) {
+	// Nothing listens on the address once the listener is closed.
+	closed := makeLocalhostListener(t)
+	closed.Close()
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, 200*time.Millisecond, &TCPServiceOptions{
+		Fallback: NewFallback(closed.Addr().String()),
+	})
+	listener := makeLocalhostListener(t)
+	go s.Serve(onet.AdaptListener(listener))
+
+	assert.Empty(t, sendProbe(t, listener.Addr().(*net.TCPAddr), make([]byte, 100)))
+	require.NoError(t, s.GracefulStop())
+	assert.Equal(t, []string{"ERR_CIPHER/dial_error"}, testMetrics.fallbacks)
+	assert.Equal(t, []string{"ERR_CIPHER"}, testMetrics.probeStatus)
+}
+
+func TestValidateFallbackAddr(t *testing.T) {
+	for _, addr := range []string{"", "127.0.0.1:8080", "[::1]:443", "decoy.example:443"} {
+		assert.NoError(t, ValidateFallbackAddr(addr), addr)
+	}
+	for _, addr := range []string{"127.0.0.1", ":443", "127.0.0.1:0", "127.0.0.1:https", "127.0.0.1:65536"} {
+		assert.Error(t, ValidateFallbackAddr(addr), addr)
+	}
+	var nilFallback *Fallback
+	assert.Equal(t, "", nilFallback.Addr())
+}
@@ -39,12 +39,33 @@ type ShadowsocksMetrics interface {
 	AddOpenTCPConnection(clientLocation string)
 	AddClosedTCPConnection(clientLocation, accessKey, status string, data ProxyMetrics, timeToCipher, duration time.Duration)
 	AddTCPProbe(status, drainResult string, port int, data ProxyMetrics)
+	AddTCPFallback(status, result string, port int, data ProxyMetrics)
+	AddTCPMuxStream(accessKey, status string)
 
 	// UDP metrics
 	AddUDPPacketFromClient(clientLocation, accessKey, status string, clientProxyBytes, proxyTargetBytes int, timeToCipher time.Duration)
 	AddUDPPacketFromTarget(clientLocation, accessKey, status string, targetProxyBytes, proxyClientBytes int)
-	AddUDPNatEntry()
-	RemoveUDPNatEntry()
+	AddUDPNatEntry(accessKey string)
+	RemoveUDPNatEntry(accessKey string)
+	AddClosedUDPSession(clientLocation, accessKey string, data UDPSessionMetrics, duration time.Duration)
+	AddUDPDNSQuery(accessKey, result string)
+
+	// Target resolution metrics
+	AddResolverLookup(result string, latency time.Duration)
+
+	// Destination ACL metrics
+	AddACLHit(policy, rule, action string)
+
+	// Client limit metrics
+	AddRateLimited(proto, limit, action string)
+
+	// Replay cache metrics
+	SetReplayCacheOccupancy(active, archive int, history time.Duration)
+	AddReplayCacheRotation(reason string)
+	AddReplayCacheReplay()
+
+	// Shutdown metrics
+	SetDrainingTCPConnections(count int)
 }
 
 type shadowsocksMetrics struct {
@@ -59,6 +80,9 @@ type shadowsocksMetrics struct {
 	// TODO: Add time to first byte.
 
 	tcpProbes               *prometheus.HistogramVec
+	tcpFallbacks            *prometheus.CounterVec
+	tcpFallbackBytes        *prometheus.CounterVec
+	tcpMuxStreams           *prometheus.CounterVec
 	tcpOpenConnections      *prometheus.CounterVec
 	tcpClosedConnections    *prometheus.CounterVec
 	tcpConnectionDurationMs *prometheus.HistogramVec
@@ -66,6 +90,26 @@ type shadowsocksMetrics struct {
 	udpPacketsFromClientPerLocation *prometheus.CounterVec
 	udpAddedNatEntries              prometheus.Counter
 	udpRemovedNatEntries            prometheus.Counter
+	udpNatEntries                   *prometheus.GaugeVec
+	udpDNSQueries                   *prometheus.CounterVec
+	udpClosedSessions               *prometheus.CounterVec
+	udpSessionDurationMs            *prometheus.HistogramVec
+	udpSessionPackets               *prometheus.HistogramVec
+	udpSessionBytes                 *prometheus.HistogramVec
+
+	resolverLookups   *prometheus.CounterVec
+	resolverLatencyMs *prometheus.HistogramVec
+
+	aclHits *prometheus.CounterVec
+
+	rateLimited *prometheus.CounterVec
+
+	replayCacheEntries   *prometheus.GaugeVec
+	replayCacheHistory   prometheus.Gauge
+	replayCacheRotations *prometheus.CounterVec
+	replayCacheReplays   prometheus.Counter
+
+	tcpDrainingConnections prometheus.Gauge
 }
 
 func newShadowsocksMetrics(ipCountryDB *geoip2.Reader) *shadowsocksMetrics {
@@ -93,6 +137,24 @@ func newShadowsocksMetrics(ipCountryDB *geoip2.Reader) *shadowsocksMetrics {
 			Buckets:   []float64{0, 49, 50, 51, 73, 91},
 			Help:      "Histogram of number of bytes from client to proxy, for detecting possible probes",
 		}, []string{"port", "status", "error"}),
+		tcpFallbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "shadowsocks",
+			Subsystem: "tcp",
+			Name:      "fallbacks",
+			Help:      "Count of connections that failed authentication and were forwarded to the fallback server, per port, status and result",
+		}, []string{"port", "status", "result"}),
+		tcpFallbackBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "shadowsocks",
+			Subsystem: "tcp",
+			Name:      "fallback_bytes",
+			Help:      "Bytes relayed between clients and the fallback server, per port and direction",
+		}, []string{"port", "dir"}),
+		tcpMuxStreams: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "shadowsocks",
+			Subsystem: "tcp",
+			Name:      "mux_streams",
+			Help:      "Count of closed multiplexed streams, per status and access key",
+		}, []string{"status", "access_key"}),
 		tcpOpenConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: "shadowsocks",
 			Subsystem: "tcp",
@@ -160,6 +222,122 @@ func newShadowsocksMetrics(ipCountryDB *geoip2.Reader) *shadowsocksMetrics {
 				Name:      "nat_entries_removed",
 				Help:      "Entries removed from the UDP NAT table",
 			}),
+		udpNatEntries: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "udp",
+				Name:      "nat_entries",
+				Help:      "Current entries in the UDP NAT table, per access key",
+			}, []string{"access_key"}),
+		udpDNSQueries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "udp",
+				Name:      "dns_queries",
+				Help:      "DNS queries answered by the server, per access key and result",
+			}, []string{"access_key", "result"}),
+		udpClosedSessions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "udp",
+				Name:      "sessions_closed",
+				Help:      "UDP sessions (NAT entries) that ended, per access key and type",
+			}, []string{"access_key", "type"}),
+		udpSessionDurationMs: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "udp",
+				Name:      "session_duration_ms",
+				Help:      "UDP session (NAT entry) lifetime distributions, per type",
+				Buckets: []float64{
+					100,
+					float64(time.Second.Milliseconds()),
+					float64(10 * time.Second.Milliseconds()),
+					float64(time.Minute.Milliseconds()),
+					float64(5 * time.Minute.Milliseconds()),
+					float64(time.Hour.Milliseconds()),
+					float64(24 * time.Hour.Milliseconds()), // Day
+				},
+			}, []string{"type"}),
+		udpSessionPackets: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "udp",
+				Name:      "session_packets",
+				Help:      "Packets per UDP session, per direction and type",
+				Buckets:   []float64{0, 1, 2, 10, 100, 1000, 10000, 100000},
+			}, []string{"dir", "type"}),
+		udpSessionBytes: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "udp",
+				Name:      "session_bytes",
+				Help:      "Bytes per UDP session, per direction and type",
+				Buckets:   []float64{0, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8},
+			}, []string{"dir", "type"}),
+		resolverLookups: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "resolver",
+				Name:      "lookups",
+				Help:      "Lookups of target hostnames, per result",
+			}, []string{"result"}),
+		resolverLatencyMs: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "resolver",
+				Name:      "latency_ms",
+				Help:      "Time needed to resolve target hostnames that were not cached",
+				Buckets:   []float64{1, 10, 100, 1000, 5000},
+			}, []string{"result"}),
+		aclHits: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "acl",
+				Name:      "hits",
+				Help:      "Targets decided by ACL policies, per policy, rule and action",
+			}, []string{"policy", "rule", "action"}),
+		rateLimited: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "shadowsocks",
+				Name:      "rate_limited",
+				Help:      "Connections and packets of clients over their limits, per protocol, limit and action",
+			}, []string{"proto", "limit", "action"}),
+		replayCacheEntries: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "replay_cache",
+				Name:      "entries",
+				Help:      "Handshakes in the replay cache, per set (active or archive)",
+			}, []string{"set"}),
+		replayCacheHistory: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "replay_cache",
+				Name:      "history_seconds",
+				Help:      "How far back the replay cache remembers handshakes",
+			}),
+		replayCacheRotations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "replay_cache",
+				Name:      "rotations",
+				Help:      "Count of replay cache rotations, per reason (capacity or window)",
+			}, []string{"reason"}),
+		replayCacheReplays: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "replay_cache",
+				Name:      "replays",
+				Help:      "Count of handshakes detected as replays by the replay cache",
+			}),
+		tcpDrainingConnections: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "tcp",
+				Name:      "draining_connections",
+				Help:      "Count of TCP connections still open while the server shuts down",
+			}),
 	}
 }
 
@@ -170,8 +348,10 @@ func newShadowsocksMetrics(ipCountryDB *geoip2.Reader) *shadowsocksMetrics {
 func NewPrometheusShadowsocksMetrics(ipCountryDB *geoip2.Reader, registerer prometheus.Registerer) ShadowsocksMetrics {
 	m := newShadowsocksMetrics(ipCountryDB)
 	// TODO: Is it possible to pass where to register the collectors?
-	registerer.MustRegister(m.buildInfo, m.accessKeys, m.ports, m.tcpProbes, m.tcpOpenConnections, m.tcpClosedConnections, m.tcpConnectionDurationMs,
-		m.dataBytes, m.dataBytesPerLocation, m.timeToCipherMs, m.udpPacketsFromClientPerLocation, m.udpAddedNatEntries, m.udpRemovedNatEntries)
+	registerer.MustRegister(m.buildInfo, m.accessKeys, m.ports, m.tcpProbes, m.tcpFallbacks, m.tcpFallbackBytes, m.tcpMuxStreams, m.tcpOpenConnections, m.tcpClosedConnections, m.tcpConnectionDurationMs,
+		m.dataBytes, m.dataBytesPerLocation, m.timeToCipherMs, m.udpPacketsFromClientPerLocation, m.udpAddedNatEntries, m.udpRemovedNatEntries,
+		m.udpNatEntries, m.udpDNSQueries, m.udpClosedSessions, m.udpSessionDurationMs, m.udpSessionPackets, m.udpSessionBytes, m.resolverLookups, m.resolverLatencyMs, m.aclHits, m.rateLimited,
+		m.replayCacheEntries, m.replayCacheHistory, m.replayCacheRotations, m.replayCacheReplays, m.tcpDrainingConnections)
 	return m
 }
 
@@ -256,6 +436,21 @@ func (m *shadowsocksMetrics) AddTCPProbe(status, drainResult string, port int, d
 	m.tcpProbes.WithLabelValues(strconv.Itoa(port), status, drainResult).Observe(float64(data.ClientProxy))
 }
 
+func (m *shadowsocksMetrics) AddTCPMuxStream(accessKey, status string) {
+	m.tcpMuxStreams.WithLabelValues(status, accessKey).Inc()
+}
+
+func (m *shadowsocksMetrics) AddTCPFallback(status, result string, port int, data ProxyMetrics) {
+	portLabel := strconv.Itoa(port)
+	m.tcpFallbacks.WithLabelValues(portLabel, status, result).Inc()
+	if data.ClientProxy > 0 {
+		m.tcpFallbackBytes.WithLabelValues(portLabel, "c>p").Add(float64(data.ClientProxy))
+	}
+	if data.ProxyClient > 0 {
+		m.tcpFallbackBytes.WithLabelValues(portLabel, "p>c").Add(float64(data.ProxyClient))
+	}
+}
+
 func (m *shadowsocksMetrics) AddUDPPacketFromClient(clientLocation, accessKey, status string, clientProxyBytes, proxyTargetBytes int, timeToCipher time.Duration) {
 	m.timeToCipherMs.WithLabelValues("udp", isFound(accessKey)).Observe(timeToCipher.Seconds() * 1000)
 	m.udpPacketsFromClientPerLocation.WithLabelValues(clientLocation, status).Inc()
@@ -272,12 +467,75 @@ func (m *shadowsocksMetrics) AddUDPPacketFromTarget(clientLocation, accessKey, s
 	addIfNonZero(int64(proxyClientBytes), m.dataBytesPerLocation, "c<p", "udp", clientLocation)
 }
 
-func (m *shadowsocksMetrics) AddUDPNatEntry() {
+func (m *shadowsocksMetrics) AddUDPNatEntry(accessKey string) {
 	m.udpAddedNatEntries.Inc()
+	m.udpNatEntries.WithLabelValues(accessKey).Inc()
 }
 
-func (m *shadowsocksMetrics) RemoveUDPNatEntry() {
+func (m *shadowsocksMetrics) RemoveUDPNatEntry(accessKey string) {
 	m.udpRemovedNatEntries.Inc()
+	m.udpNatEntries.WithLabelValues(accessKey).Dec()
+}
+
+func (m *shadowsocksMetrics) AddClosedUDPSession(clientLocation, accessKey string, data UDPSessionMetrics, duration time.Duration) {
+	sessionType := "other"
+	if data.DNSOnly {
+		sessionType = "dns"
+	}
+	m.udpClosedSessions.WithLabelValues(accessKey, sessionType).Inc()
+	m.udpSessionDurationMs.WithLabelValues(sessionType).Observe(duration.Seconds() * 1000)
+	m.udpSessionPackets.WithLabelValues("p>t", sessionType).Observe(float64(data.PacketsToTarget))
+	m.udpSessionPackets.WithLabelValues("p<t", sessionType).Observe(float64(data.PacketsFromTarget))
+	m.udpSessionBytes.WithLabelValues("p>t", sessionType).Observe(float64(data.BytesToTarget))
+	m.udpSessionBytes.WithLabelValues("p<t", sessionType).Observe(float64(data.BytesFromTarget))
+}
+
+func (m *shadowsocksMetrics) AddUDPDNSQuery(accessKey, result string) {
+	m.udpDNSQueries.WithLabelValues(accessKey, result).Inc()
+}
+
+func (m *shadowsocksMetrics) AddResolverLookup(result string, latency time.Duration) {
+	m.resolverLookups.WithLabelValues(result).Inc()
+	if result != "cached" {
+		m.resolverLatencyMs.WithLabelValues(result).Observe(latency.Seconds() * 1000)
+	}
+}
+
+func (m *shadowsocksMetrics) AddACLHit(policy, rule, action string) {
+	m.aclHits.WithLabelValues(policy, rule, action).Inc()
+}
+
+func (m *shadowsocksMetrics) AddRateLimited(proto, limit, action string) {
+	m.rateLimited.WithLabelValues(proto, limit, action).Inc()
+}
+
+func (m *shadowsocksMetrics) SetReplayCacheOccupancy(active, archive int, history time.Duration) {
+	m.replayCacheEntries.WithLabelValues("active").Set(float64(active))
+	m.replayCacheEntries.WithLabelValues("archive").Set(float64(archive))
+	m.replayCacheHistory.Set(history.Seconds())
+}
+
+func (m *shadowsocksMetrics) AddReplayCacheRotation(reason string) {
+	m.replayCacheRotations.WithLabelValues(reason).Inc()
+}
+
+func (m *shadowsocksMetrics) AddReplayCacheReplay() {
+	m.replayCacheReplays.Inc()
+}
+
+func (m *shadowsocksMetrics) SetDrainingTCPConnections(count int) {
+	m.tcpDrainingConnections.Set(float64(count))
+}
+
+// UDPSessionMetrics is the traffic that a UDP NAT entry relayed, counted as
+// the payloads sent to and received from targets.
+type UDPSessionMetrics struct {
+	PacketsToTarget   int64
+	BytesToTarget     int64
+	PacketsFromTarget int64
+	BytesFromTarget   int64
+	// DNSOnly is true if all the packets were sent to port 53.
+	DNSOnly bool
 }
 
 type ProxyMetrics struct {
@@ -337,6 +595,9 @@ type NoOpMetrics struct{}
 func (m *NoOpMetrics) SetBuildInfo(version string) {}
 func (m *NoOpMetrics) AddTCPProbe(status, drainResult string, port int, data ProxyMetrics) {
 }
+func (m *NoOpMetrics) AddTCPFallback(status, result string, port int, data ProxyMetrics) {
+}
+func (m *NoOpMetrics) AddTCPMuxStream(accessKey, status string) {}
 func (m *NoOpMetrics) AddClosedTCPConnection(clientLocation, accessKey, status string, data ProxyMetrics, timeToCipher, duration time.Duration) {
 }
 func (m *NoOpMetrics) GetLocation(net.Addr) (string, error) {
@@ -348,5 +609,17 @@ func (m *NoOpMetrics) AddUDPPacketFromClient(clientLocation, accessKey, status s
 }
 func (m *NoOpMetrics) AddUDPPacketFromTarget(clientLocation, accessKey, status string, targetProxyBytes, proxyClientBytes int) {
 }
-func (m *NoOpMetrics) AddUDPNatEntry()    {}
-func (m *NoOpMetrics) RemoveUDPNatEntry() {}
+func (m *NoOpMetrics) AddUDPNatEntry(accessKey string)    {}
+func (m *NoOpMetrics) RemoveUDPNatEntry(accessKey string) {}
+func (m *NoOpMetrics) AddClosedUDPSession(clientLocation, accessKey string, data UDPSessionMetrics, duration time.Duration) {
+}
+func (m *NoOpMetrics) AddUDPDNSQuery(accessKey, result string) {}
+func (m *NoOpMetrics) AddResolverLookup(result string, latency time.Duration) {
+}
+func (m *NoOpMetrics) AddACLHit(policy, rule, action string)      {}
+func (m *NoOpMetrics) AddRateLimited(proto, limit, action string) {}
+func (m *NoOpMetrics) SetDrainingTCPConnections(count int)        {}
+func (m *NoOpMetrics) SetReplayCacheOccupancy(active, archive int, history time.Duration) {
+}
+func (m *NoOpMetrics) AddReplayCacheRotation(reason string) {}
+func (m *NoOpMetrics) AddReplayCacheReplay()                {}
@@ -21,10 +21,20 @@ func TestMethodsDontPanic(t *testing.T) {
 	ssMetrics.AddOpenTCPConnection("US")
 	ssMetrics.AddClosedTCPConnection("US", "1", "OK", proxyMetrics, 10*time.Millisecond, 100*time.Millisecond)
 	ssMetrics.AddTCPProbe("ERR_CIPHER", "eof", 443, proxyMetrics)
+	ssMetrics.AddTCPFallback("ERR_CIPHER", "ok", 443, proxyMetrics)
 	ssMetrics.AddUDPPacketFromClient("US", "2", "OK", 10, 20, 10*time.Millisecond)
 	ssMetrics.AddUDPPacketFromTarget("US", "3", "OK", 10, 20)
-	ssMetrics.AddUDPNatEntry()
-	ssMetrics.RemoveUDPNatEntry()
+	ssMetrics.AddUDPNatEntry("key-1")
+	ssMetrics.RemoveUDPNatEntry("key-1")
+	ssMetrics.AddClosedUDPSession("US", "key-1", UDPSessionMetrics{PacketsToTarget: 1, BytesToTarget: 30, DNSOnly: true}, time.Second)
+	ssMetrics.AddUDPDNSQuery("key-1", "cached")
+	ssMetrics.AddResolverLookup("ok", 10*time.Millisecond)
+	ssMetrics.AddACLHit("default", "0", "deny")
+	ssMetrics.AddRateLimited("tcp", "ip_rate", "drop")
+	ssMetrics.SetReplayCacheOccupancy(10, 20, time.Hour)
+	ssMetrics.AddReplayCacheRotation("window")
+	ssMetrics.AddReplayCacheReplay()
+	ssMetrics.SetDrainingTCPConnections(3)
 }
 
 func BenchmarkGetLocation(b *testing.B) {
@@ -112,7 +122,7 @@ func BenchmarkNAT(b *testing.B) {
 	ssMetrics := NewPrometheusShadowsocksMetrics(nil, prometheus.NewRegistry())
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		ssMetrics.AddUDPNatEntry()
-		ssMetrics.RemoveUDPNatEntry()
+		ssMetrics.AddUDPNatEntry("key-1")
+		ssMetrics.RemoveUDPNatEntry("key-1")
 	}
 }
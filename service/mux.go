@@ -0,0 +1,115 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/xtaci/smux"
+)
+
+// maxMuxStreams limits the number of concurrent streams in one multiplexed
+// connection, so that a single client can't exhaust the server's resources.
+const maxMuxStreams = 256
+
+// handleMux runs a stream multiplexer over `ssConn`, the decrypted view of the
+// client connection `clientTCPConn`, and relays each stream to the target named
+// at its start.  Once the key of `cipherEntry` expires, new streams are closed.
+// Only the traffic of the streams counts as activity for `watchdog`, so that
+// smux keepalives don't defeat the idle timeout.  The target side of
+// `proxyMetrics` accumulates the traffic of all streams, and the status of each
+// stream is reported when it closes.
+func (s *tcpService) handleMux(ssConn, clientTCPConn onet.TCPConn, watchdog *connWatchdog, cipherEntry *CipherEntry, policy *targetPolicy, proxyMetrics *metrics.ProxyMetrics) *onet.ConnectionError {
+	session, err := smux.Server(ssConn, ss.NewMuxConfig())
+	if err != nil {
+		return onet.NewConnectionError("ERR_MUX", "Failed to start multiplexer", err)
+	}
+	defer session.Close()
+	watchdog.watchStreams()
+
+	var streams sync.WaitGroup
+	var metricsMu sync.Mutex // Protects the target fields of proxyMetrics.
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			// The client closed the connection, or the session failed.
+			break
+		}
+		if session.NumStreams() > maxMuxStreams {
+			logger.Debugf("Too many multiplexed streams from %v", clientTCPConn.RemoteAddr())
+			stream.Close()
+			s.m.AddTCPMuxStream(cipherEntry.ID, "ERR_MUX_STREAMS")
+			continue
+		}
+		if cipherEntry.expiredAt(time.Now()) {
+			debugTCP(cipherEntry.ID, "Key expired, rejecting multiplexed stream from %v", clientTCPConn.RemoteAddr())
+			stream.Close()
+			s.m.AddTCPMuxStream(cipherEntry.ID, "ERR_KEY_EXPIRED")
+			continue
+		}
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			var streamMetrics metrics.ProxyMetrics
+			status := "OK"
+			if connErr := s.handleMuxStream(watchdog.trackStream(onet.AdaptHalfCloseConn(stream)), clientTCPConn, session.CloseChan(), policy, &streamMetrics); connErr != nil {
+				status = connErr.Status
+				logger.Debugf("TCP mux stream error: %v: %v", connErr.Message, connErr.Cause)
+			}
+			s.m.AddTCPMuxStream(cipherEntry.ID, status)
+			metricsMu.Lock()
+			proxyMetrics.ProxyTarget += streamMetrics.ProxyTarget
+			proxyMetrics.TargetProxy += streamMetrics.TargetProxy
+			metricsMu.Unlock()
+		}()
+	}
+	streams.Wait()
+	return nil
+}
+
+// handleMuxStream relays one stream.  `sessionClosed` is closed when the session
+// ends, so that relays waiting on their target can be released.
+func (s *tcpService) handleMuxStream(stream, clientTCPConn onet.TCPConn, sessionClosed <-chan struct{}, policy *targetPolicy, streamMetrics *metrics.ProxyMetrics) *onet.ConnectionError {
+	defer stream.Close()
+	stream.SetReadDeadline(time.Now().Add(s.readTimeout))
+	tgtAddr, err := socks.ReadAddr(stream)
+	stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		return onet.NewConnectionError("ERR_READ_ADDRESS", "Failed to get target address", err)
+	}
+	tgtConn, dialErr := s.dial(tgtAddr.String(), policy, clientTCPConn, streamMetrics)
+	if dialErr != nil {
+		return dialErr
+	}
+	defer tgtConn.Close()
+	relayDone := make(chan struct{})
+	defer close(relayDone)
+	go func() {
+		select {
+		case <-sessionClosed:
+			tgtConn.Close()
+		case <-relayDone:
+		}
+	}()
+	if _, _, err := onet.Relay(stream, tgtConn); err != nil {
+		return onet.NewConnectionError("ERR_RELAY", "Failed to relay multiplexed stream", err)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/require"
+	"github.com/xtaci/smux"
+)
+
+type muxTestConn struct {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+func TestMuxRejectsStreamsAfterExpiry(t *testing.T) {
+	echoListener := makeLocalhostListener(t)
+	defer echoListener.Close()
+	go func() {
+		for {
+			conn, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	entry := cipherList.SnapshotForClientIP(nil)[0].Value.(*CipherEntry)
+	entry.NotAfter = time.Now().Add(500 * time.Millisecond)
+	s := NewTCPService(cipherList, nil, &probeTestMetrics{}, time.Second, &TCPServiceOptions{TargetIPValidator: allowAll, Mux: true})
+	listener := makeLocalhostListener(t)
+	go s.Serve(onet.AdaptListener(listener))
+	defer s.GracefulStop()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	ssw := ss.NewShadowsocksWriter(conn, entry.Cipher)
+	_, err = ssw.Write(socks.ParseAddr(ss.MuxTargetAddr))
+	require.NoError(t, err)
+	session, err := smux.Client(&muxTestConn{ss.NewShadowsocksReader(conn, entry.Cipher), ssw, conn}, ss.NewMuxConfig())
+	require.NoError(t, err)
+	defer session.Close()
+	target := socks.ParseAddr(echoListener.Addr().String())
+
+	stream, err := session.OpenStream()
+	require.NoError(t, err)
+	_, err = stream.Write(append(target, "hello"...))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(stream, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	time.Sleep(time.Until(entry.NotAfter))
+	// The open stream keeps working, but new streams are closed.
+	expired, err := session.OpenStream()
+	require.NoError(t, err)
+	_, err = expired.Write(target)
+	require.NoError(t, err)
+	expired.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = expired.Read(buf)
+	require.ErrorIs(t, err, io.EOF)
+
+	_, err = stream.Write([]byte("again"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(stream, buf)
+	require.NoError(t, err)
+	require.Equal(t, "again", string(buf))
+}
+
+func TestMuxDisabled(t *testing.T) {
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, time.Second, &TCPServiceOptions{TargetIPValidator: allowAll})
+	listener := makeLocalhostListener(t)
+	go s.Serve(onet.AdaptListener(listener))
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	cipher := firstCipher(cipherList)
+	_, err = ss.NewShadowsocksWriter(conn, cipher).Write(socks.ParseAddr(ss.MuxTargetAddr))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	require.NoError(t, s.GracefulStop())
+	require.Equal(t, []string{"ERR_MUX_DISABLED"}, testMetrics.closeStatus)
+}
+
+func TestMuxIdleTimeout(t *testing.T) {
+	echoListener := makeLocalhostListener(t)
+	defer echoListener.Close()
+	go func() {
+		for {
+			conn, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, time.Second, &TCPServiceOptions{TargetIPValidator: allowAll, Mux: true, IdleTimeout: 300 * time.Millisecond})
+	listener := makeLocalhostListener(t)
+	go s.Serve(onet.AdaptListener(listener))
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	cipher := firstCipher(cipherList)
+	ssw := ss.NewShadowsocksWriter(conn, cipher)
+	_, err = ssw.Write(socks.ParseAddr(ss.MuxTargetAddr))
+	require.NoError(t, err)
+	// The client sends keepalives much more often than the idle timeout.
+	config := ss.NewMuxConfig()
+	config.KeepAliveInterval = 50 * time.Millisecond
+	session, err := smux.Client(&muxTestConn{ss.NewShadowsocksReader(conn, cipher), ssw, conn}, config)
+	require.NoError(t, err)
+	defer session.Close()
+
+	stream, err := session.OpenStream()
+	require.NoError(t, err)
+	_, err = stream.Write(append(socks.ParseAddr(echoListener.Addr().String()), "hello"...))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(stream, buf)
+	require.NoError(t, err)
+
+	// Once the stream is idle, the keepalives don't keep the session open.
+	// The server may reset the connection, which discarded unread keepalives.
+	stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = stream.Read(buf)
+	require.Error(t, err)
+	var netErr net.Error
+	require.False(t, errors.As(err, &netErr) && netErr.Timeout(), "Idle session wasn't closed")
+	require.NoError(t, s.GracefulStop())
+	require.Equal(t, []string{"ERR_IDLE_TIMEOUT"}, testMetrics.closeStatus)
+}
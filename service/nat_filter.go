@@ -0,0 +1,157 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// NATFilter is the filtering behavior of the UDP NAT, as defined in RFC 4787,
+// Section 5.  It decides which peers can send packets back to a client.  The
+// mapping is always endpoint-independent: each client gets a single outbound
+// socket for all of its destinations.
+type NATFilter string
+
+const (
+	// NATFilterEndpointIndependent forwards packets from any peer ("full cone").
+	// This is the default.
+	NATFilterEndpointIndependent NATFilter = "endpoint-independent"
+	// NATFilterAddressDependent only forwards packets from IP addresses that the
+	// client has sent packets to ("address-restricted cone").
+	NATFilterAddressDependent NATFilter = "address-dependent"
+	// NATFilterAddressAndPortDependent only forwards packets from the IP
+	// addresses and ports that the client has sent packets to ("port-restricted
+	// cone").
+	NATFilterAddressAndPortDependent NATFilter = "address-and-port-dependent"
+)
+
+// ParseNATFilter returns the filter with the given name.  It also accepts the
+// names "full-cone", "address-restricted" and "port-restricted".  An empty name
+// returns an empty filter, which means the default applies.
+func ParseNATFilter(name string) (NATFilter, error) {
+	switch name {
+	case "":
+		return "", nil
+	case string(NATFilterEndpointIndependent), "full-cone":
+		return NATFilterEndpointIndependent, nil
+	case string(NATFilterAddressDependent), "address-restricted":
+		return NATFilterAddressDependent, nil
+	case string(NATFilterAddressAndPortDependent), "port-restricted":
+		return NATFilterAddressAndPortDependent, nil
+	}
+	return "", fmt.Errorf("unknown NAT filter %q", name)
+}
+
+const (
+	// peerTimeout is how long a peer may reply after the client's last packet
+	// to it.  RFC 4787 (REQ-5) recommends it for the mappings of a NAT.
+	peerTimeout = 5 * time.Minute
+	// maxPeers bounds the peers recorded for a client.  Beyond it, the least
+	// recently used peer is forgotten.
+	maxPeers = 1024
+	// minPeersToPrune is the number of peers at which the expired ones are
+	// first removed.
+	minPeersToPrune = 64
+)
+
+// peerFilter records the peers that a client has sent packets to, and decides
+// whether packets from a peer may be forwarded to the client.  Peers expire
+// `timeout` after the client's last packet to them, unless it's zero.  It is
+// not safe for concurrent use.
+type peerFilter struct {
+	policy  NATFilter
+	timeout time.Duration
+	// Time of the client's last packet to each peer.
+	peers map[string]time.Time
+	// Number of peers at which the expired ones are next removed.
+	pruneAt int
+}
+
+func newPeerFilter(policy NATFilter, timeout time.Duration) peerFilter {
+	f := peerFilter{policy: policy, timeout: timeout}
+	if policy != NATFilterEndpointIndependent {
+		f.peers = make(map[string]time.Time)
+		f.pruneAt = minPeersToPrune
+	}
+	return f
+}
+
+// peerKey returns the part of `addr` that the filter matches on.
+func (f *peerFilter) peerKey(addr net.Addr) string {
+	if f.policy == NATFilterAddressDependent {
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			return udpAddr.IP.String()
+		}
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			return host
+		}
+	}
+	return addr.String()
+}
+
+// addPeer records that the client has sent a packet to `addr` at `now`.
+func (f *peerFilter) addPeer(addr net.Addr, now time.Time) {
+	if f.peers == nil {
+		return
+	}
+	key := f.peerKey(addr)
+	if _, ok := f.peers[key]; !ok && len(f.peers) >= f.pruneAt {
+		f.prune(now)
+	}
+	f.peers[key] = now
+}
+
+// prune removes the expired peers, and the least recently used one if there's
+// still no room for another.
+func (f *peerFilter) prune(now time.Time) {
+	var oldestKey string
+	var oldest time.Time
+	for key, lastSent := range f.peers {
+		if f.expired(lastSent, now) {
+			delete(f.peers, key)
+		} else if oldestKey == "" || lastSent.Before(oldest) {
+			oldestKey, oldest = key, lastSent
+		}
+	}
+	if len(f.peers) >= maxPeers {
+		delete(f.peers, oldestKey)
+	}
+	// Amortize the cost of pruning over the peers added in between.
+	f.pruneAt = 2 * len(f.peers)
+	if f.pruneAt < minPeersToPrune {
+		f.pruneAt = minPeersToPrune
+	}
+	if f.pruneAt > maxPeers {
+		f.pruneAt = maxPeers
+	}
+}
+
+// allows reports whether a packet from `addr` may be forwarded to the client
+// at `now`.
+func (f *peerFilter) allows(addr net.Addr, now time.Time) bool {
+	if f.peers == nil {
+		return true
+	}
+	lastSent, ok := f.peers[f.peerKey(addr)]
+	return ok && !f.expired(lastSent, now)
+}
+
+// expired reports whether a peer that the client last sent to at `lastSent`
+// has expired at `now`.
+func (f *peerFilter) expired(lastSent, now time.Time) bool {
+	return f.timeout > 0 && now.Sub(lastSent) >= f.timeout
+}
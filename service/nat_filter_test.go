@@ -0,0 +1,81 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNATFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		want NATFilter
+	}{
+		{"", ""},
+		{"endpoint-independent", NATFilterEndpointIndependent},
+		{"full-cone", NATFilterEndpointIndependent},
+		{"address-dependent", NATFilterAddressDependent},
+		{"address-restricted", NATFilterAddressDependent},
+		{"address-and-port-dependent", NATFilterAddressAndPortDependent},
+		{"port-restricted", NATFilterAddressAndPortDependent},
+	}
+	for _, tt := range tests {
+		got, err := ParseNATFilter(tt.name)
+		require.NoError(t, err, tt.name)
+		require.Equal(t, tt.want, got, tt.name)
+	}
+	_, err := ParseNATFilter("symmetric")
+	require.Error(t, err)
+}
+
+func TestPeerFilterExpiry(t *testing.T) {
+	f := newPeerFilter(NATFilterAddressAndPortDependent, peerTimeout)
+	peer := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	start := time.Now()
+	require.False(t, f.allows(peer, start))
+	f.addPeer(peer, start)
+	require.True(t, f.allows(peer, start.Add(peerTimeout-time.Second)))
+	require.False(t, f.allows(peer, start.Add(peerTimeout)))
+	// Another packet to the peer renews it.
+	f.addPeer(peer, start.Add(time.Minute))
+	require.True(t, f.allows(peer, start.Add(peerTimeout)))
+}
+
+func TestPeerFilterPrune(t *testing.T) {
+	f := newPeerFilter(NATFilterAddressAndPortDependent, peerTimeout)
+	start := time.Now()
+	for i := 0; i < 10*maxPeers; i++ {
+		f.addPeer(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: i}, start.Add(time.Duration(i)*time.Millisecond))
+	}
+	require.LessOrEqual(t, len(f.peers), maxPeers)
+	// The most recent peers are kept.
+	now := start.Add(10 * maxPeers * time.Millisecond)
+	require.True(t, f.allows(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 10*maxPeers - 1}, now))
+	require.False(t, f.allows(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 0}, now))
+
+	// Expired peers are removed as new ones are added.
+	later := now.Add(peerTimeout)
+	for i := 0; i < maxPeers; i++ {
+		f.addPeer(&net.UDPAddr{IP: net.ParseIP(fmt.Sprintf("198.51.100.%d", i%256)), Port: i}, later)
+	}
+	for key, lastSent := range f.peers {
+		require.Equal(t, later, lastSent, key)
+	}
+}
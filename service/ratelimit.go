@@ -0,0 +1,307 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitAction is what happens to the TCP connections of clients over
+// their limits.
+type RateLimitAction string
+
+const (
+	// RateLimitDrop closes excess connections right away.  This is the default.
+	RateLimitDrop RateLimitAction = "drop"
+	// RateLimitAbsorb reads and discards the data of excess connections until
+	// they time out, like probes, so that they look like any other failed
+	// connection.
+	RateLimitAbsorb RateLimitAction = "absorb"
+)
+
+// ParseRateLimitAction returns the action with the given name.  An empty name
+// returns RateLimitDrop.
+func ParseRateLimitAction(name string) (RateLimitAction, error) {
+	switch name {
+	case "", string(RateLimitDrop):
+		return RateLimitDrop, nil
+	case string(RateLimitAbsorb):
+		return RateLimitAbsorb, nil
+	}
+	return "", fmt.Errorf("unknown rate limit action %q", name)
+}
+
+// Labels of the limits in metrics.
+const (
+	limitIPRate            = "ip_rate"
+	limitSubnetRate        = "subnet_rate"
+	limitIPConcurrency     = "ip_concurrency"
+	limitSubnetConcurrency = "subnet_concurrency"
+)
+
+// Default sizes of the subnets that are limited together.
+const (
+	defaultSubnetBitsIPv4 = 24
+	defaultSubnetBitsIPv6 = 64
+)
+
+// defaultMaxAbsorbing limits the connections absorbed at once when
+// ClientLimits.MaxAbsorbing is not set.
+const defaultMaxAbsorbing = 1024
+
+// clientSweepInterval is how often idle clients are forgotten.
+const clientSweepInterval = time.Minute
+
+// ClientLimits configures a ClientLimiter.  Zero disables a limit.
+type ClientLimits struct {
+	// IPRate is the number of new connections per second that each client IP
+	// address may open, with bursts of up to IPBurst, which defaults to the
+	// rate rounded up.
+	IPRate  float64
+	IPBurst int
+	// SubnetRate and SubnetBurst are the same for each client subnet.
+	SubnetRate  float64
+	SubnetBurst int
+	// IPConcurrency and SubnetConcurrency limit the UDP NAT entries of each
+	// client IP address and subnet, and their TCP connections until they
+	// authenticate or are handed to the fallback.
+	IPConcurrency     int
+	SubnetConcurrency int
+	// SubnetBitsIPv4 and SubnetBitsIPv6 are the prefix lengths of the client
+	// subnets.  They default to 24 and 64.
+	SubnetBitsIPv4 int
+	SubnetBitsIPv6 int
+	// Action is what happens to the TCP connections over a limit.  Defaults to
+	// RateLimitDrop.
+	Action RateLimitAction
+	// MaxAbsorbing limits the TCP connections absorbed at once.  Further ones
+	// are dropped.  Defaults to 1024.
+	MaxAbsorbing int
+}
+
+// tokenBucket allows `rate` events per second, with bursts of up to `burst`.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last refill.
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
+
+// clientState holds the limits of a client IP address or subnet.
+type clientState struct {
+	subnet bool
+	bucket tokenBucket
+	active int
+}
+
+// ClientLimiter limits the rate of new connections, and the number of open
+// ones, of each client IP address and subnet, before they are authenticated.
+// It may be shared among services, so that the limits apply to all of them.
+type ClientLimiter struct {
+	limits ClientLimits
+	// Whether any limit is set.
+	limited bool
+	now     func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string]*clientState
+	lastSweep time.Time
+	absorbing int
+}
+
+// NewClientLimiter creates a ClientLimiter that applies `limits`.
+func NewClientLimiter(limits ClientLimits) *ClientLimiter {
+	if limits.IPRate > 0 && limits.IPBurst <= 0 {
+		limits.IPBurst = int(math.Ceil(limits.IPRate))
+	}
+	if limits.SubnetRate > 0 && limits.SubnetBurst <= 0 {
+		limits.SubnetBurst = int(math.Ceil(limits.SubnetRate))
+	}
+	if limits.SubnetBitsIPv4 <= 0 || limits.SubnetBitsIPv4 > 32 {
+		limits.SubnetBitsIPv4 = defaultSubnetBitsIPv4
+	}
+	if limits.SubnetBitsIPv6 <= 0 || limits.SubnetBitsIPv6 > 128 {
+		limits.SubnetBitsIPv6 = defaultSubnetBitsIPv6
+	}
+	if limits.Action == "" {
+		limits.Action = RateLimitDrop
+	}
+	if limits.MaxAbsorbing <= 0 {
+		limits.MaxAbsorbing = defaultMaxAbsorbing
+	}
+	return &ClientLimiter{
+		limits:  limits,
+		limited: limits.IPRate > 0 || limits.SubnetRate > 0 || limits.IPConcurrency > 0 || limits.SubnetConcurrency > 0,
+		now:     time.Now,
+		clients: make(map[string]*clientState),
+	}
+}
+
+// clientKeys returns the keys of the address and of the subnet of `ip`.
+func (l *ClientLimiter) clientKeys(ip net.IP) (string, string) {
+	bits := l.limits.SubnetBitsIPv6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, l.limits.SubnetBitsIPv4
+	}
+	subnet := ip.Mask(net.CIDRMask(bits, len(ip)*8))
+	return ip.String(), subnet.String() + "/" + strconv.Itoa(bits)
+}
+
+// bucketLimits returns the rate and burst of an address, or of a subnet.
+func (l *ClientLimiter) bucketLimits(subnet bool) (float64, int) {
+	if subnet {
+		return l.limits.SubnetRate, l.limits.SubnetBurst
+	}
+	return l.limits.IPRate, l.limits.IPBurst
+}
+
+// client returns the state of `key`, which it creates if needed.  It must be
+// called with l.mu held.
+func (l *ClientLimiter) client(key string, subnet bool, now time.Time) *clientState {
+	c, ok := l.clients[key]
+	if !ok {
+		_, burst := l.bucketLimits(subnet)
+		c = &clientState{subnet: subnet, bucket: tokenBucket{tokens: float64(burst), last: now}}
+		l.clients[key] = c
+	}
+	return c
+}
+
+// sweep forgets the clients without open connections whose buckets are full
+// again, which are the same as new clients.  It must be called with l.mu held.
+func (l *ClientLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < clientSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, c := range l.clients {
+		if c.active > 0 {
+			continue
+		}
+		rate, burst := l.bucketLimits(c.subnet)
+		c.bucket.refill(now, rate, burst)
+		if c.bucket.tokens >= float64(burst) {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// allow takes a token from the buckets of `ip` and its subnet for a new
+// connection.  It returns the exceeded limit, or "" if the connection is
+// allowed.
+func (l *ClientLimiter) allow(ip net.IP) string {
+	if l == nil || !l.limited || ip == nil || (l.limits.IPRate <= 0 && l.limits.SubnetRate <= 0) {
+		return ""
+	}
+	ipKey, subnetKey := l.clientKeys(ip)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+	var ipBucket, subnetBucket *tokenBucket
+	if l.limits.IPRate > 0 {
+		ipBucket = &l.client(ipKey, false, now).bucket
+		ipBucket.refill(now, l.limits.IPRate, l.limits.IPBurst)
+		if ipBucket.tokens < 1 {
+			return limitIPRate
+		}
+	}
+	if l.limits.SubnetRate > 0 {
+		subnetBucket = &l.client(subnetKey, true, now).bucket
+		subnetBucket.refill(now, l.limits.SubnetRate, l.limits.SubnetBurst)
+		if subnetBucket.tokens < 1 {
+			return limitSubnetRate
+		}
+	}
+	// Only take the tokens once both buckets have them.
+	if ipBucket != nil {
+		ipBucket.tokens--
+	}
+	if subnetBucket != nil {
+		subnetBucket.tokens--
+	}
+	return ""
+}
+
+// acquire counts an open connection of `ip` and its subnet.  It returns a
+// function to call once the connection is closed, or the exceeded limit.
+func (l *ClientLimiter) acquire(ip net.IP) (func(), string) {
+	if l == nil || !l.limited || ip == nil || (l.limits.IPConcurrency <= 0 && l.limits.SubnetConcurrency <= 0) {
+		return func() {}, ""
+	}
+	ipKey, subnetKey := l.clientKeys(ip)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+	ipClient := l.client(ipKey, false, now)
+	subnetClient := l.client(subnetKey, true, now)
+	if l.limits.IPConcurrency > 0 && ipClient.active >= l.limits.IPConcurrency {
+		return nil, limitIPConcurrency
+	}
+	if l.limits.SubnetConcurrency > 0 && subnetClient.active >= l.limits.SubnetConcurrency {
+		return nil, limitSubnetConcurrency
+	}
+	ipClient.active++
+	subnetClient.active++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			ipClient.active--
+			subnetClient.active--
+		})
+	}, ""
+}
+
+// admit applies all the limits to a new connection from `ip`, like allow and
+// then acquire.
+func (l *ClientLimiter) admit(ip net.IP) (func(), string) {
+	if limit := l.allow(ip); limit != "" {
+		return nil, limit
+	}
+	return l.acquire(ip)
+}
+
+// action returns the action for an excess TCP connection, and whether it
+// should be absorbed.  Then the caller must call doneAbsorbing when done.
+func (l *ClientLimiter) action() (RateLimitAction, bool) {
+	if l.limits.Action != RateLimitAbsorb {
+		return RateLimitDrop, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.absorbing >= l.limits.MaxAbsorbing {
+		return RateLimitDrop, false
+	}
+	l.absorbing++
+	return RateLimitAbsorb, true
+}
+
+func (l *ClientLimiter) doneAbsorbing() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.absorbing--
+}
@@ -0,0 +1,257 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rateLimitTestMetrics records the limited clients as "proto/limit/action".
+type rateLimitTestMetrics struct {
+	metrics.NoOpMetrics
+	mu      sync.Mutex
+	limited []string
+}
+
+func (m *rateLimitTestMetrics) AddRateLimited(proto, limit, action string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.limited = append(m.limited, proto+"/"+limit+"/"+action)
+}
+
+func (m *rateLimitTestMetrics) get() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.limited...)
+}
+
+// makeTestLimiter returns a limiter whose clock only moves with the returned
+// function.
+func makeTestLimiter(limits ClientLimits) (*ClientLimiter, func(time.Duration)) {
+	l := NewClientLimiter(limits)
+	now := time.Unix(1_000_000, 0)
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestParseRateLimitAction(t *testing.T) {
+	for name, want := range map[string]RateLimitAction{"": RateLimitDrop, "drop": RateLimitDrop, "absorb": RateLimitAbsorb} {
+		action, err := ParseRateLimitAction(name)
+		assert.NoError(t, err)
+		assert.Equal(t, want, action)
+	}
+	_, err := ParseRateLimitAction("reset")
+	assert.Error(t, err)
+}
+
+func TestClientLimiterIPRate(t *testing.T) {
+	l, advance := makeTestLimiter(ClientLimits{IPRate: 1, IPBurst: 2})
+	ip := net.ParseIP("192.0.2.1")
+	assert.Equal(t, "", l.allow(ip))
+	assert.Equal(t, "", l.allow(ip))
+	assert.Equal(t, limitIPRate, l.allow(ip))
+	// Other addresses have their own buckets.
+	assert.Equal(t, "", l.allow(net.ParseIP("192.0.2.2")))
+
+	advance(500 * time.Millisecond)
+	assert.Equal(t, limitIPRate, l.allow(ip))
+	advance(500 * time.Millisecond)
+	assert.Equal(t, "", l.allow(ip))
+	assert.Equal(t, limitIPRate, l.allow(ip))
+}
+
+func TestClientLimiterSubnetRate(t *testing.T) {
+	l, _ := makeTestLimiter(ClientLimits{IPRate: 1, SubnetRate: 1})
+	assert.Equal(t, "", l.allow(net.ParseIP("192.0.2.1")))
+	assert.Equal(t, limitSubnetRate, l.allow(net.ParseIP("192.0.2.200")))
+	assert.Equal(t, "", l.allow(net.ParseIP("192.0.3.1")))
+	assert.Equal(t, "", l.allow(net.ParseIP("2001:db8:0:1::1")))
+	assert.Equal(t, limitSubnetRate, l.allow(net.ParseIP("2001:db8:0:1::2")))
+	assert.Equal(t, "", l.allow(net.ParseIP("2001:db8:0:2::1")))
+
+	// The address keeps its token when the subnet has none.
+	assert.Equal(t, limitSubnetRate, l.allow(net.ParseIP("192.0.2.2")))
+	l.limits.SubnetRate = 0
+	assert.Equal(t, "", l.allow(net.ParseIP("192.0.2.2")))
+}
+
+func TestClientLimiterConcurrency(t *testing.T) {
+	l, _ := makeTestLimiter(ClientLimits{IPConcurrency: 1, SubnetConcurrency: 2, SubnetBitsIPv4: 16})
+	release1, limit := l.acquire(net.ParseIP("192.0.2.1"))
+	require.Equal(t, "", limit)
+	_, limit = l.acquire(net.ParseIP("192.0.2.1"))
+	assert.Equal(t, limitIPConcurrency, limit)
+	_, limit = l.acquire(net.ParseIP("192.0.3.1"))
+	require.Equal(t, "", limit)
+	_, limit = l.acquire(net.ParseIP("192.0.4.1"))
+	assert.Equal(t, limitSubnetConcurrency, limit)
+
+	// Releasing twice has no further effect.
+	release1()
+	release1()
+	release2, limit := l.acquire(net.ParseIP("192.0.4.1"))
+	require.Equal(t, "", limit)
+	_, limit = l.acquire(net.ParseIP("192.0.2.1"))
+	assert.Equal(t, limitSubnetConcurrency, limit)
+	release2()
+}
+
+func TestClientLimiterSweep(t *testing.T) {
+	l, advance := makeTestLimiter(ClientLimits{IPRate: 1, SubnetRate: 10, IPConcurrency: 5})
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"} {
+		assert.Equal(t, "", l.allow(net.ParseIP(ip)))
+	}
+	release, _ := l.acquire(net.ParseIP("198.51.100.1"))
+	assert.Equal(t, 7, len(l.clients))
+
+	advance(2 * clientSweepInterval)
+	assert.Equal(t, "", l.allow(net.ParseIP("203.0.113.1")))
+	// The clients with open connections and the new one remain.
+	assert.Equal(t, 4, len(l.clients))
+	release()
+}
+
+func TestClientLimiterDisabled(t *testing.T) {
+	var nilLimiter *ClientLimiter
+	for _, l := range []*ClientLimiter{nilLimiter, NewClientLimiter(ClientLimits{})} {
+		for i := 0; i < 10; i++ {
+			release, limit := l.admit(net.ParseIP("192.0.2.1"))
+			require.Equal(t, "", limit)
+			release()
+		}
+	}
+	// Connections without an IP address aren't limited.
+	l := NewClientLimiter(ClientLimits{IPRate: 1, IPConcurrency: 1})
+	for i := 0; i < 10; i++ {
+		_, limit := l.admit(nil)
+		require.Equal(t, "", limit)
+	}
+}
+
+// dialLimited connects to `listener` from localhost.
+func dialLimited(t *testing.T, listener *net.TCPListener) *net.TCPConn {
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	return conn
+}
+
+func TestTCPClientLimits(t *testing.T) {
+	for _, action := range []RateLimitAction{RateLimitDrop, RateLimitAbsorb} {
+		t.Run(string(action), func(t *testing.T) {
+			cipherList, err := MakeTestCiphers([]string{"asdf"})
+			require.NoError(t, err)
+			testMetrics := &rateLimitTestMetrics{}
+			const testTimeout = 200 * time.Millisecond
+			limiter := NewClientLimiter(ClientLimits{IPConcurrency: 1, Action: action})
+			s := NewTCPService(cipherList, nil, testMetrics, testTimeout, &TCPServiceOptions{ClientLimiter: limiter})
+			listener := makeLocalhostListener(t)
+			go s.Serve(onet.AdaptListener(listener))
+
+			// The first connection waits for its handshake.
+			first := dialLimited(t, listener)
+			defer first.Close()
+			require.Eventually(t, func() bool { return s.ActiveConnections() == 1 }, time.Second, 10*time.Millisecond)
+
+			second := dialLimited(t, listener)
+			defer second.Close()
+			start := time.Now()
+			_, err = second.Write([]byte("probe"))
+			require.NoError(t, err)
+			n, _ := io.Copy(io.Discard, second)
+			assert.Equal(t, int64(0), n)
+			if action == RateLimitAbsorb {
+				assert.GreaterOrEqual(t, time.Since(start), testTimeout/2, "Absorbed connection closed too early")
+			}
+			assert.Equal(t, []string{"tcp/ip_concurrency/" + string(action)}, testMetrics.get())
+
+			require.NoError(t, s.GracefulStop())
+		})
+	}
+}
+
+func TestTCPClientLimitsReleaseOnAuth(t *testing.T) {
+	echoListener := makeLocalhostListener(t)
+	defer echoListener.Close()
+	go func() {
+		for {
+			conn, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &rateLimitTestMetrics{}
+	limiter := NewClientLimiter(ClientLimits{IPConcurrency: 1})
+	s := NewTCPService(cipherList, nil, testMetrics, time.Second, &TCPServiceOptions{TargetIPValidator: allowAll, ClientLimiter: limiter})
+	listener := makeLocalhostListener(t)
+	go s.Serve(onet.AdaptListener(listener))
+
+	// Authenticated connections don't count toward the limit while they relay.
+	cipher := firstCipher(cipherList)
+	for i := 0; i < 2; i++ {
+		conn := dialLimited(t, listener)
+		defer conn.Close()
+		ssw := ss.NewShadowsocksWriter(conn, cipher)
+		_, err = ssw.Write(append(socks.ParseAddr(echoListener.Addr().String()), "hello"...))
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = io.ReadFull(ss.NewShadowsocksReader(conn, cipher), buf)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+	}
+	assert.Empty(t, testMetrics.get())
+	require.NoError(t, s.Stop())
+}
+
+func TestNATClientLimits(t *testing.T) {
+	var running sync.WaitGroup
+	testMetrics := &natTestMetrics{}
+	nat := newNATmap(timeout, testMetrics, &running)
+	nat.clientLimiter = NewClientLimiter(ClientLimits{IPConcurrency: 1})
+
+	firstConn, err := addNATClient(nat, 1, "key 1")
+	require.NoError(t, err)
+	rejectedConn, err := addNATClient(nat, 2, "key 1")
+	assert.Equal(t, errClientLimit, err)
+	if _, ok := <-rejectedConn.recv; ok {
+		t.Error("Expected the rejected target connection to be closed")
+	}
+	assert.Equal(t, []string{"udp/ip_concurrency/drop"}, testMetrics.rateLimited)
+
+	// The client's slot is released once its entry times out.
+	firstConn.recv <- packet{err: &fakeTimeoutError{}}
+	running.Wait()
+	_, err = addNATClient(nat, 3, "key 1")
+	assert.NoError(t, err)
+	nat.Close()
+}
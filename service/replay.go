@@ -15,66 +15,133 @@
 package service
 
 import (
+	"crypto/rand"
 	"encoding/binary"
 	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
 )
 
 // MaxCapacity is the largest allowed size of ReplayCache.
 //
-// Capacities in excess of 20,000 are not recommended, due to the false
-// positive rate of up to 2 * capacity / 2^32 = 1 / 100,000.  If larger
-// capacities are desired, the key type should be changed to uint64.
-const MaxCapacity = 20_000
+// Handshakes are stored as 64-bit hashes, so the false positive rate of up to
+// 2 * capacity / 2^64 is negligible at any capacity.  The limit bounds the
+// memory instead, which is approximately 40*capacity bytes for each of the two
+// sets (as measured by BenchmarkReplayCache_Creation).
+const MaxCapacity = 1_000_000
+
+// Reasons for rotating the sets of a ReplayCache in metrics.
+const (
+	replayRotationCapacity = "capacity"
+	replayRotationWindow   = "window"
+)
 
 type empty struct{}
 
+// ReplayCacheOptions holds the optional settings of a ReplayCache.
+type ReplayCacheOptions struct {
+	// Window makes the cache remember the handshakes of the last Window,
+	// instead of a number of handshakes.  The capacity still bounds the
+	// memory: when more than `capacity` handshakes arrive within a window, the
+	// cache remembers a shorter time.
+	Window time.Duration
+	// Metrics receives the occupancy of the cache and the replays it detects.
+	Metrics metrics.ShadowsocksMetrics
+}
+
 // ReplayCache allows us to check whether a handshake salt was used within
-// the last `capacity` handshakes.  It requires approximately 20*capacity
-// bytes of memory (as measured by BenchmarkReplayCache_Creation).
+// the last `capacity` handshakes, or within the last Window if set.  It keeps
+// two sets, the active one and the read-only archive, and discards the archive
+// when the active set is full or a window old.
 //
 // The nil and zero values represent a cache with capacity 0, i.e. no cache.
 type ReplayCache struct {
 	mutex    sync.Mutex
 	capacity int
-	active   map[uint32]empty
-	archive  map[uint32]empty
+	window   time.Duration
+	m        metrics.ShadowsocksMetrics
+	now      func() time.Time
+	// The SipHash key of the handshakes.
+	k0, k1  uint64
+	active  map[uint64]empty
+	archive map[uint64]empty
+	// When the handshakes of the active and archive sets started to be added.
+	activeSince  time.Time
+	archiveSince time.Time
 }
 
 // NewReplayCache returns a fresh ReplayCache that promises to remember at least
-// the most recent `capacity` handshakes.
-func NewReplayCache(capacity int) ReplayCache {
+// the most recent `capacity` handshakes, or those within the window of the
+// options, up to `capacity` per window.
+func NewReplayCache(capacity int, opts ...*ReplayCacheOptions) ReplayCache {
 	if capacity > MaxCapacity {
-		panic("ReplayCache capacity would result in too many false positives")
+		panic("ReplayCache capacity would use too much memory")
+	}
+	var options ReplayCacheOptions
+	if opts != nil {
+		if len(opts) > 1 {
+			logger.Errorf("NewReplayCache: at most one ReplayCacheOptions argument is allowed")
+		}
+		options = *opts[0]
+	}
+	if options.Metrics == nil {
+		options.Metrics = &metrics.NoOpMetrics{}
+	}
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		panic("Failed to generate the replay cache key: " + err.Error())
+	}
+	sizeHint := capacity
+	if options.Window > 0 {
+		// The cache is unlikely to fill up within a window.
+		sizeHint = 0
 	}
 	return ReplayCache{
-		capacity: capacity,
-		active:   make(map[uint32]empty, capacity),
+		capacity:    capacity,
+		window:      options.Window,
+		m:           options.Metrics,
+		now:         time.Now,
+		k0:          binary.LittleEndian.Uint64(key[:8]),
+		k1:          binary.LittleEndian.Uint64(key[8:]),
+		active:      make(map[uint64]empty, sizeHint),
+		activeSince: time.Now(),
 		// `archive` is read-only and initially empty.
 	}
 }
 
-// Trivially reduces the key and salt to a uint32, avoiding collisions
-// in case of salts with a shared prefix or suffix.  Salts are normally
-// random, but in principle a client might use a counter instead, so
-// using only the prefix or suffix is not sufficient.  Including the key
-// ID in the hash avoids accidental collisions when the same salt is used
-// by different access keys, as might happen in the case of a counter.
-//
-// Secure hashing is not required, because only authenticated handshakes
-// are added to the cache.  A hostile client could produce colliding salts,
-// but this would not impact other users.  Each map uses a new random hash
-// function, so it is not trivial for a hostile client to mount an
-// algorithmic complexity attack with nearly-colliding hashes:
-// https://dave.cheney.net/2018/05/29/how-the-go-runtime-implements-maps-efficiently-without-generics
-func preHash(id string, salt []byte) uint32 {
-	buf := [4]byte{}
-	for i := 0; i < len(id); i++ {
-		buf[i&0x3] ^= id[i]
+// hash reduces the key ID and salt to a uint64.  Including the key ID avoids
+// accidental collisions when the same salt is used by different access keys,
+// as might happen in the case of a counter.  The hash is keyed with a random
+// key, so that clients can't produce salts that collide with the handshakes of
+// other users or degrade the maps.
+func (c *ReplayCache) hash(id string, salt []byte) uint64 {
+	var buf [64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(id)))
+	msg := append(append(buf[:n], id...), salt...)
+	return sipHash24(c.k0, c.k1, msg)
+}
+
+// rotate discards the archive and moves the active set to the archive.  It
+// must be called with c.mutex held.
+func (c *ReplayCache) rotate(now time.Time) {
+	sizeHint := c.capacity
+	if c.window > 0 {
+		sizeHint = len(c.active)
 	}
-	for i, v := range salt {
-		buf[i&0x3] ^= v
+	c.archive, c.archiveSince = c.active, c.activeSince
+	c.active, c.activeSince = make(map[uint64]empty, sizeHint), now
+}
+
+// expire rotates the sets once the active one is a window old, and returns
+// whether it did.  Then the archive holds the handshakes since the start of the
+// last window at least.  It must be called with c.mutex held.
+func (c *ReplayCache) expire(now time.Time) bool {
+	if c.window <= 0 || now.Sub(c.activeSince) < c.window {
+		return false
 	}
-	return binary.BigEndian.Uint32(buf[:])
+	c.rotate(now)
+	return true
 }
 
 // Add a handshake with this key ID and salt to the cache.
@@ -84,19 +151,38 @@ func (c *ReplayCache) Add(id string, salt []byte) bool {
 		// Cache is disabled, so every salt is new.
 		return true
 	}
-	hash := preHash(id, salt)
+	hash := c.hash(id, salt)
+	now := c.now()
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	if _, ok := c.active[hash]; ok {
-		// Fast replay: `salt` is already in the active set.
-		return false
+	var rotations []string
+	if c.expire(now) {
+		rotations = append(rotations, replayRotationWindow)
+	}
+	// A fast replay, with `salt` already in the active set, isn't added again.
+	var isNew bool
+	if _, inActive := c.active[hash]; !inActive {
+		_, inArchive := c.archive[hash]
+		isNew = !inArchive
+		if len(c.active) >= c.capacity {
+			// Discard the archive and move active to archive.
+			c.rotate(now)
+			rotations = append(rotations, replayRotationCapacity)
+		}
+		c.active[hash] = empty{}
+	}
+	oldest := c.activeSince
+	if c.archive != nil {
+		oldest = c.archiveSince
+	}
+	activeCount, archiveCount := len(c.active), len(c.archive)
+	c.mutex.Unlock()
+
+	for _, reason := range rotations {
+		c.m.AddReplayCacheRotation(reason)
 	}
-	_, inArchive := c.archive[hash]
-	if len(c.active) == c.capacity {
-		// Discard the archive and move active to archive.
-		c.archive = c.active
-		c.active = make(map[uint32]empty, c.capacity)
+	if !isNew {
+		c.m.AddReplayCacheReplay()
 	}
-	c.active[hash] = empty{}
-	return !inArchive
+	c.m.SetReplayCacheOccupancy(activeCount, archiveCount, now.Sub(oldest))
+	return isNew
 }
@@ -0,0 +1,270 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A snapshot of a ReplayCache holds, in big endian:
+//
+//	magic (4 bytes) | version (1 byte) | save time in Unix seconds (8 bytes) |
+//	hash key (16 bytes) | start of the active and archive sets in Unix
+//	nanoseconds (8 bytes each, 0 without archive) | active count (4 bytes) |
+//	archive count (4 bytes) | hashes (8 bytes each) |
+//	SHA-256 of everything before it (32 bytes)
+//
+// The hash key is restored with the hashes, so they remain valid after a
+// restart.
+const (
+	replaySnapshotMagic   = "SSRC"
+	replaySnapshotVersion = 2
+	replaySnapshotHeader  = len(replaySnapshotMagic) + 1 + 8 + 16 + 8 + 8 + 4 + 4
+)
+
+// ErrStaleReplaySnapshot is returned when loading a replay cache snapshot that
+// is older than allowed.
+var ErrStaleReplaySnapshot = errors.New("replay snapshot is too old")
+
+// writeSnapshot writes the key, active and archive sets of the cache to `w`, as
+// saved at `now`.
+func (c *ReplayCache) writeSnapshot(w io.Writer, now time.Time) error {
+	// Only the active set is copied under the lock, since Add changes it.  The
+	// archive is never changed once rotated, only replaced, so it is encoded
+	// after unlocking like the copy.
+	c.mutex.Lock()
+	k0, k1 := c.k0, c.k1
+	activeSince, archiveSince := c.activeSince, c.archiveSince
+	archive := c.archive
+	active := make([]uint64, 0, len(c.active))
+	for hash := range c.active {
+		active = append(active, hash)
+	}
+	c.mutex.Unlock()
+
+	size := replaySnapshotHeader + 8*(len(active)+len(archive))
+	buf := make([]byte, size, size+sha256.Size)
+	copy(buf, replaySnapshotMagic)
+	buf[4] = replaySnapshotVersion
+	binary.BigEndian.PutUint64(buf[5:], uint64(now.Unix()))
+	binary.BigEndian.PutUint64(buf[13:], k0)
+	binary.BigEndian.PutUint64(buf[21:], k1)
+	binary.BigEndian.PutUint64(buf[29:], uint64(activeSince.UnixNano()))
+	if archive != nil {
+		binary.BigEndian.PutUint64(buf[37:], uint64(archiveSince.UnixNano()))
+	}
+	binary.BigEndian.PutUint32(buf[45:], uint32(len(active)))
+	binary.BigEndian.PutUint32(buf[49:], uint32(len(archive)))
+	i := replaySnapshotHeader
+	for _, hash := range active {
+		binary.BigEndian.PutUint64(buf[i:], hash)
+		i += 8
+	}
+	for hash := range archive {
+		binary.BigEndian.PutUint64(buf[i:], hash)
+		i += 8
+	}
+	checksum := sha256.Sum256(buf)
+	buf = append(buf, checksum[:]...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readSnapshotContent reads one snapshot from `r`, and returns it without the
+// checksum once verified.  It returns io.EOF if `r` ends before the snapshot.
+func readSnapshotContent(r io.Reader) ([]byte, error) {
+	content := make([]byte, replaySnapshotHeader)
+	if _, err := io.ReadFull(r, content); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errors.New("replay snapshot is truncated")
+		}
+		return nil, err
+	}
+	if string(content[:len(replaySnapshotMagic)]) != replaySnapshotMagic {
+		return nil, errors.New("not a replay snapshot")
+	}
+	if version := content[4]; version != replaySnapshotVersion {
+		return nil, fmt.Errorf("unsupported replay snapshot version %v", version)
+	}
+	activeCount := int(binary.BigEndian.Uint32(content[45:]))
+	archiveCount := int(binary.BigEndian.Uint32(content[49:]))
+	if activeCount > MaxCapacity || archiveCount > MaxCapacity {
+		return nil, errors.New("replay snapshot has the wrong size")
+	}
+	data := append(content, make([]byte, 8*(activeCount+archiveCount)+sha256.Size)...)
+	if _, err := io.ReadFull(r, data[replaySnapshotHeader:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errors.New("replay snapshot is truncated")
+		}
+		return nil, err
+	}
+	content, checksum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if expected := sha256.Sum256(content); !bytes.Equal(checksum, expected[:]) {
+		return nil, errors.New("replay snapshot is corrupted")
+	}
+	return content, nil
+}
+
+// readSnapshot restores the cache from the snapshot in `r`, unless it was saved
+// more than `maxAge` before `now`.  Zero `maxAge` accepts snapshots of any age.
+// The cache must not have been used yet.
+func (c *ReplayCache) readSnapshot(r io.Reader, maxAge time.Duration, now time.Time) error {
+	content, err := readSnapshotContent(r)
+	if errors.Is(err, io.EOF) {
+		return errors.New("replay snapshot is truncated")
+	} else if err != nil {
+		return err
+	}
+	if n, _ := io.ReadFull(r, make([]byte, 1)); n != 0 {
+		return errors.New("replay snapshot has the wrong size")
+	}
+	saved := time.Unix(int64(binary.BigEndian.Uint64(content[5:])), 0)
+	if age := now.Sub(saved); maxAge > 0 && age > maxAge {
+		return fmt.Errorf("%w: saved %v ago", ErrStaleReplaySnapshot, age.Round(time.Second))
+	}
+	if c == nil || c.capacity == 0 {
+		return nil
+	}
+	activeCount := int(binary.BigEndian.Uint32(content[45:]))
+	archiveCount := int(binary.BigEndian.Uint32(content[49:]))
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.active) != 0 || c.archive != nil {
+		return errors.New("replay cache is already in use")
+	}
+	// The sets are restored as they were, and the next Add rotates them if
+	// they are too old or the active one is over the capacity of this cache.
+	c.k0 = binary.BigEndian.Uint64(content[13:])
+	c.k1 = binary.BigEndian.Uint64(content[21:])
+	c.activeSince = time.Unix(0, int64(binary.BigEndian.Uint64(content[29:])))
+	c.active = make(map[uint64]empty, activeCount)
+	i := replaySnapshotHeader
+	for ; i < replaySnapshotHeader+8*activeCount; i += 8 {
+		c.active[binary.BigEndian.Uint64(content[i:])] = empty{}
+	}
+	if archiveSince := binary.BigEndian.Uint64(content[37:]); archiveSince != 0 {
+		c.archiveSince = time.Unix(0, int64(archiveSince))
+		c.archive = make(map[uint64]empty, archiveCount)
+		for ; i < len(content); i += 8 {
+			c.archive[binary.BigEndian.Uint64(content[i:])] = empty{}
+		}
+	}
+	return nil
+}
+
+// mergeSnapshot adds the handshakes of the snapshot `content` that the cache
+// doesn't have to its active set, as if they were added now, and returns how
+// many it added.
+func (c *ReplayCache) mergeSnapshot(content []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if binary.BigEndian.Uint64(content[13:]) != c.k0 || binary.BigEndian.Uint64(content[21:]) != c.k1 {
+		return 0, errors.New("replay snapshot has a different hash key")
+	}
+	now := c.now()
+	c.expire(now)
+	added := 0
+	for i := replaySnapshotHeader; i < len(content); i += 8 {
+		hash := binary.BigEndian.Uint64(content[i:])
+		if _, inActive := c.active[hash]; inActive {
+			continue
+		}
+		if _, inArchive := c.archive[hash]; inArchive {
+			continue
+		}
+		if len(c.active) >= c.capacity {
+			c.rotate(now)
+		}
+		c.active[hash] = empty{}
+		added++
+	}
+	return added, nil
+}
+
+// WriteSnapshot writes the handshakes in the cache, and the key of their
+// hashes, to `w`, so that another process can merge them with MergeSnapshots.
+func (c *ReplayCache) WriteSnapshot(w io.Writer) error {
+	return c.writeSnapshot(w, time.Now())
+}
+
+// MergeSnapshots adds the handshakes of the snapshots written to `r` by
+// WriteSnapshot, until `r` ends, and returns how many were new.  It lets a
+// process learn the last handshakes of the process it replaces, which must use
+// the same hash key, i.e. this cache must have loaded a snapshot of the other.
+func (c *ReplayCache) MergeSnapshots(r io.Reader) (int, error) {
+	if c == nil || c.capacity == 0 {
+		_, err := io.Copy(ioutil.Discard, r)
+		return 0, err
+	}
+	total := 0
+	for {
+		content, err := readSnapshotContent(r)
+		if errors.Is(err, io.EOF) {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+		added, err := c.mergeSnapshot(content)
+		total += added
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// SaveSnapshot saves the handshakes in the cache, and the key of their hashes,
+// to `filename`, so that a new process can load them with LoadSnapshot.  The
+// file is replaced atomically.
+func (c *ReplayCache) SaveSnapshot(filename string) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := c.writeSnapshot(f, time.Now()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// LoadSnapshot restores the handshakes saved in `filename` by SaveSnapshot.  It
+// must be called before the cache is used.  It returns an error wrapping
+// ErrStaleReplaySnapshot, and loads nothing, if the snapshot was saved more
+// than `maxAge` ago.  Zero `maxAge` accepts snapshots of any age.
+func (c *ReplayCache) LoadSnapshot(filename string, maxAge time.Duration) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.readSnapshot(f, maxAge, time.Now())
+}
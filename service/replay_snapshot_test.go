@@ -0,0 +1,173 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplayCache_Snapshot(t *testing.T) {
+	salts := makeSalts(15)
+	cache := NewReplayCache(10)
+	for _, salt := range salts {
+		cache.Add(keyID, salt)
+	}
+	snapshotFile := filepath.Join(t.TempDir(), "replay.snapshot")
+	if err := cache.SaveSnapshot(snapshotFile); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+
+	// The capacity may change across restarts.
+	restored := NewReplayCache(20)
+	if err := restored.LoadSnapshot(snapshotFile, time.Hour); err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+	for i, salt := range salts {
+		if restored.Add(keyID, salt) {
+			t.Errorf("Salt %v was accepted after restoring", i)
+		}
+	}
+
+	// The restored handshakes are forgotten like any others.
+	restored = NewReplayCache(5)
+	if err := restored.LoadSnapshot(snapshotFile, 0); err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+	for _, salt := range makeSalts(10) {
+		if !restored.Add(keyID, salt) {
+			t.Error("New salt rejected")
+		}
+	}
+	if !restored.Add(keyID, salts[0]) {
+		t.Error("Restored salt should have been forgotten")
+	}
+}
+
+func TestReplayCache_StaleSnapshot(t *testing.T) {
+	salts := makeSalts(1)
+	cache := NewReplayCache(10)
+	cache.Add(keyID, salts[0])
+	var buf bytes.Buffer
+	now := time.Now()
+	if err := cache.writeSnapshot(&buf, now.Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewReplayCache(10)
+	err := restored.readSnapshot(bytes.NewReader(buf.Bytes()), time.Hour, now)
+	if !errors.Is(err, ErrStaleReplaySnapshot) {
+		t.Errorf("Expected stale snapshot, got %v", err)
+	}
+	if !restored.Add(keyID, salts[0]) {
+		t.Error("Stale snapshot was loaded")
+	}
+
+	restored = NewReplayCache(10)
+	if err := restored.readSnapshot(bytes.NewReader(buf.Bytes()), 3*time.Hour, now); err != nil {
+		t.Errorf("readSnapshot failed: %v", err)
+	}
+	if restored.Add(keyID, salts[0]) {
+		t.Error("Snapshot was not loaded")
+	}
+}
+
+func TestReplayCache_CorruptedSnapshot(t *testing.T) {
+	cache := NewReplayCache(10)
+	for _, salt := range makeSalts(5) {
+		cache.Add(keyID, salt)
+	}
+	var buf bytes.Buffer
+	if err := cache.writeSnapshot(&buf, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+
+	corrupted := append([]byte{}, snapshot...)
+	corrupted[replaySnapshotHeader] ^= 1
+	truncated := snapshot[:len(snapshot)-4]
+	for name, data := range map[string][]byte{"corrupted": corrupted, "truncated": truncated, "empty": {}} {
+		restored := NewReplayCache(10)
+		if err := restored.readSnapshot(bytes.NewReader(data), 0, time.Now()); err == nil {
+			t.Errorf("Expected error for %v snapshot", name)
+		}
+		if len(restored.archive) != 0 {
+			t.Errorf("The %v snapshot was loaded", name)
+		}
+	}
+
+	if err := cache.readSnapshot(bytes.NewReader(snapshot), 0, time.Now()); err == nil {
+		t.Error("Expected error for a cache already in use")
+	}
+	if err := cache.LoadSnapshot(filepath.Join(t.TempDir(), "missing"), 0); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected missing file, got %v", err)
+	}
+}
+
+func TestReplayCache_MergeSnapshots(t *testing.T) {
+	salts := makeSalts(10)
+	cache := NewReplayCache(20)
+	cache.Add(keyID, salts[0])
+	snapshotFile := filepath.Join(t.TempDir(), "replay.snapshot")
+	if err := cache.SaveSnapshot(snapshotFile); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	restored := NewReplayCache(20)
+	if err := restored.LoadSnapshot(snapshotFile, 0); err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+
+	// The old cache keeps adding handshakes after the snapshot, and sends them
+	// more than once.
+	var buf bytes.Buffer
+	for _, salt := range salts[1:5] {
+		cache.Add(keyID, salt)
+	}
+	if err := cache.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, salt := range salts[5:] {
+		cache.Add(keyID, salt)
+	}
+	if err := cache.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshots := buf.Bytes()
+	added, err := restored.MergeSnapshots(bytes.NewReader(snapshots))
+	if err != nil {
+		t.Fatalf("MergeSnapshots failed: %v", err)
+	}
+	if added != len(salts)-1 {
+		t.Errorf("Merged %v handshakes, expected %v", added, len(salts)-1)
+	}
+	for i, salt := range salts {
+		if restored.Add(keyID, salt) {
+			t.Errorf("Salt %v was accepted after merging", i)
+		}
+	}
+
+	// The hashes of another key are meaningless.
+	other := NewReplayCache(20)
+	if _, err := other.MergeSnapshots(bytes.NewReader(snapshots)); err == nil {
+		t.Error("Expected error for a snapshot with a different key")
+	}
+	if _, err := restored.MergeSnapshots(bytes.NewReader(snapshots[:len(snapshots)-4])); err == nil {
+		t.Error("Expected error for a truncated snapshot")
+	}
+}
@@ -17,6 +17,9 @@ package service
 import (
 	"encoding/binary"
 	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
 )
 
 const keyID = "the key"
@@ -91,6 +94,106 @@ func TestReplayCache_Archive(t *testing.T) {
 	}
 }
 
+type replayTestMetrics struct {
+	metrics.NoOpMetrics
+	rotations map[string]int
+	replays   int
+	active    int
+	archive   int
+	history   time.Duration
+}
+
+func (m *replayTestMetrics) SetReplayCacheOccupancy(active, archive int, history time.Duration) {
+	m.active, m.archive, m.history = active, archive, history
+}
+
+func (m *replayTestMetrics) AddReplayCacheRotation(reason string) {
+	if m.rotations == nil {
+		m.rotations = make(map[string]int)
+	}
+	m.rotations[reason]++
+}
+
+func (m *replayTestMetrics) AddReplayCacheReplay() {
+	m.replays++
+}
+
+func TestReplayCache_Window(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := &replayTestMetrics{}
+	cache := NewReplayCache(100, &ReplayCacheOptions{Window: time.Hour, Metrics: m})
+	cache.now = func() time.Time { return now }
+	cache.activeSince = now
+	salts := makeSalts(2)
+	for _, salt := range salts {
+		if !cache.Add(keyID, salt) {
+			t.Error("Addition of a new vector should succeed")
+		}
+	}
+
+	now = now.Add(59 * time.Minute)
+	if cache.Add(keyID, salts[0]) {
+		t.Error("Replay within the window should fail")
+	}
+	// The first window is over, so the vectors move to the archive.
+	now = now.Add(2 * time.Minute)
+	if cache.Add(keyID, salts[1]) {
+		t.Error("Replay from the archive should fail")
+	}
+	// The second window is over too, so only the vector added again in it is
+	// remembered.
+	now = now.Add(61 * time.Minute)
+	if !cache.Add(keyID, salts[0]) {
+		t.Error("Vector should have been forgotten after two windows")
+	}
+	if cache.Add(keyID, salts[1]) {
+		t.Error("Vector added in the last window should be remembered")
+	}
+
+	if m.rotations[replayRotationWindow] != 2 || m.rotations[replayRotationCapacity] != 0 {
+		t.Errorf("Wrong rotations: %v", m.rotations)
+	}
+	if m.replays != 3 {
+		t.Errorf("Expected 3 replays, got %v", m.replays)
+	}
+	if m.active != 2 || m.archive != 1 || m.history != 61*time.Minute {
+		t.Errorf("Wrong occupancy: %v active, %v archived, %v history", m.active, m.archive, m.history)
+	}
+}
+
+func TestReplayCache_WindowCapacity(t *testing.T) {
+	m := &replayTestMetrics{}
+	cache := NewReplayCache(2, &ReplayCacheOptions{Window: time.Hour, Metrics: m})
+	salts := makeSalts(3)
+	for _, salt := range salts {
+		if !cache.Add(keyID, salt) {
+			t.Error("Addition of a new vector should succeed")
+		}
+	}
+	// The capacity bounds the memory within a window.
+	if m.rotations[replayRotationCapacity] != 1 {
+		t.Errorf("Wrong rotations: %v", m.rotations)
+	}
+	if m.active != 1 || m.archive != 2 {
+		t.Errorf("Wrong occupancy: %v active, %v archived", m.active, m.archive)
+	}
+	if cache.Add(keyID, salts[0]) {
+		t.Error("Archived vector should be remembered")
+	}
+}
+
+func TestReplayCache_KeyedHash(t *testing.T) {
+	cache1 := NewReplayCache(10)
+	cache2 := NewReplayCache(10)
+	salt := makeSalts(1)[0]
+	if cache1.hash(keyID, salt) == cache2.hash(keyID, salt) {
+		t.Error("Caches should use different hash keys")
+	}
+	if cache1.hash("a", []byte("bc")) == cache1.hash("ab", []byte("c")) {
+		t.Error("Key ID and salt should be hashed unambiguously")
+	}
+}
+
 // Benchmark to determine the memory usage of ReplayCache.
 // Note that NewReplayCache only allocates the active set,
 // so the eventual memory usage will be roughly double.
@@ -0,0 +1,423 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// IPPreference selects which address family is used first when a target
+// hostname has both IPv4 and IPv6 addresses.
+type IPPreference string
+
+const (
+	// IPPreferenceNone keeps the order of the resolver.
+	IPPreferenceNone IPPreference = ""
+	IPPreferenceIPv4 IPPreference = "ipv4"
+	IPPreferenceIPv6 IPPreference = "ipv6"
+)
+
+// ParseIPPreference returns the IPPreference called `name`.  The empty name
+// returns IPPreferenceNone.
+func ParseIPPreference(name string) (IPPreference, error) {
+	switch pref := IPPreference(strings.ToLower(name)); pref {
+	case IPPreferenceNone, IPPreferenceIPv4, IPPreferenceIPv6:
+		return pref, nil
+	}
+	return "", fmt.Errorf("unknown IP preference %q", name)
+}
+
+// Results of a Resolver lookup, for metrics.
+const (
+	resolverResultOK       = "ok"
+	resolverResultCached   = "cached"
+	resolverResultNotFound = "not_found"
+	resolverResultError    = "error"
+)
+
+const (
+	defaultResolverCacheSize   = 10_000
+	defaultResolverSystemTTL   = time.Minute
+	defaultResolverNegativeTTL = 30 * time.Second
+)
+
+// ResolverOptions holds the optional settings of a Resolver.
+type ResolverOptions struct {
+	// Upstream is the UDP host:port of the DNS server to query.  Empty uses the
+	// system resolver.
+	Upstream string
+	// Timeout for each lookup.  Defaults to 5 seconds.
+	Timeout time.Duration
+	// CacheSize is the maximum number of cached hostnames.  Defaults to 10,000.
+	// Negative disables the cache.
+	CacheSize int
+	// SystemTTL is how long the answers of the system resolver, which doesn't
+	// report TTLs, are cached.  Defaults to 1 minute.
+	SystemTTL time.Duration
+	// NegativeTTL is how long hostnames that don't exist are cached.  Defaults
+	// to 30 seconds.
+	NegativeTTL time.Duration
+}
+
+// Resolver resolves the hostnames of targets, caching the addresses and the
+// hostnames that don't exist.  Concurrent lookups of the same hostname share
+// a single query.  A Resolver may be shared by several services.
+type Resolver struct {
+	m           metrics.ShadowsocksMetrics
+	upstream    *dnsUpstream
+	timeout     time.Duration
+	systemTTL   time.Duration
+	negativeTTL time.Duration
+	maxSize     int
+
+	mu       sync.Mutex
+	cache    map[string]resolverEntry
+	inflight map[string]*resolverCall
+}
+
+type resolverEntry struct {
+	ips     []net.IP // Empty if the hostname doesn't exist.
+	expires time.Time
+}
+
+// resolverCall is a lookup in progress.  `ips` and `err` are set before `done`
+// is closed.
+type resolverCall struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+// NewResolver creates a Resolver that reports lookups to `m`.
+func NewResolver(m metrics.ShadowsocksMetrics, opts ...*ResolverOptions) (*Resolver, error) {
+	r := &Resolver{
+		m:           m,
+		timeout:     defaultDNSTimeout,
+		systemTTL:   defaultResolverSystemTTL,
+		negativeTTL: defaultResolverNegativeTTL,
+		maxSize:     defaultResolverCacheSize,
+		cache:       make(map[string]resolverEntry),
+		inflight:    make(map[string]*resolverCall),
+	}
+	upstream := ""
+	if opts != nil {
+		if len(opts) > 1 {
+			logger.Errorf("NewResolver: at most one ResolverOptions argument is allowed")
+		}
+		upstream = opts[0].Upstream
+		if opts[0].Timeout > 0 {
+			r.timeout = opts[0].Timeout
+		}
+		if opts[0].CacheSize != 0 {
+			r.maxSize = opts[0].CacheSize
+		}
+		if opts[0].SystemTTL > 0 {
+			r.systemTTL = opts[0].SystemTTL
+		}
+		if opts[0].NegativeTTL > 0 {
+			r.negativeTTL = opts[0].NegativeTTL
+		}
+	}
+	if upstream != "" {
+		u, err := newDNSUpstream(upstream, r.timeout)
+		if err != nil {
+			return nil, err
+		}
+		r.upstream = u
+	}
+	return r, nil
+}
+
+// Close releases the socket of the upstream resolver, if any.
+func (r *Resolver) Close() error {
+	if r.upstream == nil {
+		return nil
+	}
+	return r.upstream.Close()
+}
+
+// LookupIP returns the addresses of `host`, ordered by `pref`.  It returns IP
+// literals as they are.
+func (r *Resolver) LookupIP(ctx context.Context, host string, pref IPPreference) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	host = canonicalDomain(host)
+	if ips, ok, err := r.lookupCached(host, pref); ok {
+		return ips, err
+	}
+
+	r.mu.Lock()
+	call, ok := r.inflight[host]
+	if !ok {
+		call = &resolverCall{done: make(chan struct{})}
+		r.inflight[host] = call
+		go r.resolve(host, call)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-call.done:
+		if call.err != nil {
+			return nil, call.err
+		}
+		return orderIPs(call.ips, pref), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// lookupCached returns the cached result for `host`, if any.  `host` must be
+// canonical.
+func (r *Resolver) lookupCached(host string, pref IPPreference) ([]net.IP, bool, error) {
+	r.mu.Lock()
+	entry, ok := r.cache[host]
+	if ok && !time.Now().Before(entry.expires) {
+		delete(r.cache, host)
+		ok = false
+	}
+	r.mu.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+	r.m.AddResolverLookup(resolverResultCached, 0)
+	if len(entry.ips) == 0 {
+		return nil, true, notFoundError(host)
+	}
+	return orderIPs(entry.ips, pref), true, nil
+}
+
+// isCached reports whether LookupIP would return right away for `host`.
+func (r *Resolver) isCached(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	host = canonicalDomain(host)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.cache[host]
+	return ok && time.Now().Before(entry.expires)
+}
+
+// resolve looks up `host` on behalf of all the callers waiting on `call`, and
+// caches the result.
+func (r *Resolver) resolve(host string, call *resolverCall) {
+	start := time.Now()
+	ips, ttl, err := r.query(host)
+	var dnsErr *net.DNSError
+	notFound := errors.As(err, &dnsErr) && dnsErr.IsNotFound
+	switch {
+	case err == nil:
+		r.m.AddResolverLookup(resolverResultOK, time.Since(start))
+	case notFound:
+		r.m.AddResolverLookup(resolverResultNotFound, time.Since(start))
+		ttl = r.negativeTTL
+	default:
+		r.m.AddResolverLookup(resolverResultError, time.Since(start))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if (err == nil || notFound) && ttl > 0 && r.maxSize > 0 {
+		if _, ok := r.cache[host]; !ok && len(r.cache) >= r.maxSize {
+			r.makeRoom()
+		}
+		r.cache[host] = resolverEntry{ips: ips, expires: time.Now().Add(ttl)}
+	}
+	delete(r.inflight, host)
+	call.ips, call.err = ips, err
+	close(call.done)
+}
+
+// makeRoom drops the expired entries, or an arbitrary one if none has expired.
+// It must be called with the lock held.
+func (r *Resolver) makeRoom() {
+	now := time.Now()
+	for host, entry := range r.cache {
+		if !now.Before(entry.expires) {
+			delete(r.cache, host)
+		}
+	}
+	if len(r.cache) < r.maxSize {
+		return
+	}
+	for host := range r.cache {
+		delete(r.cache, host)
+		return
+	}
+}
+
+// query returns the addresses of `host` and how long they may be cached.
+func (r *Resolver) query(host string) ([]net.IP, time.Duration, error) {
+	if r.upstream != nil {
+		return r.queryUpstream(host)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, r.systemTTL, nil
+}
+
+// queryUpstream asks the upstream resolver for the A and AAAA records of
+// `host` concurrently.  The TTL is the smallest among the records.
+func (r *Resolver) queryUpstream(host string) ([]net.IP, time.Duration, error) {
+	type answer struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	qtypes := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	answers := make(chan answer, len(qtypes))
+	for _, qtype := range qtypes {
+		go func(qtype dnsmessage.Type) {
+			ips, ttl, err := r.queryType(host, qtype)
+			answers <- answer{ips, ttl, err}
+		}(qtype)
+	}
+	var ips []net.IP
+	ttl := maxDNSCacheTTL
+	var err error
+	for range qtypes {
+		a := <-answers
+		if a.err != nil {
+			err = a.err
+			continue
+		}
+		if len(a.ips) > 0 {
+			ips = append(ips, a.ips...)
+			if a.ttl < ttl {
+				ttl = a.ttl
+			}
+		}
+	}
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+	if err == nil {
+		err = notFoundError(host)
+	}
+	return nil, 0, err
+}
+
+// queryType returns the records of type `qtype` for `host`.  A name without
+// records of that type is not an error.
+func (r *Resolver) queryType(host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	response, err := r.upstream.exchange(packed)
+	if err != nil {
+		return nil, 0, err
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse DNS response: %v", err)
+	}
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, notFoundError(host)
+	default:
+		return nil, 0, fmt.Errorf("DNS lookup of %v failed: %v", host, msg.RCode)
+	}
+	var ips []net.IP
+	ttl := maxDNSCacheTTL
+	for _, resource := range msg.Answers {
+		var ip net.IP
+		switch body := resource.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		default:
+			// CNAME records lead to the addresses, which are in the answer too.
+			continue
+		}
+		ips = append(ips, ip)
+		if d := time.Duration(resource.Header.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	return ips, ttl, nil
+}
+
+// resolveUDPAddr resolves the host:port `addr` to its first address in the
+// order of `pref`.
+func (r *Resolver) resolveUDPAddr(addr string, pref IPPreference) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupIP(context.Background(), host, pref)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ips[0], Port: port}, nil
+}
+
+func notFoundError(host string) error {
+	return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// orderIPs returns a copy of `ips` with the preferred family first, keeping the
+// order within each family.
+func orderIPs(ips []net.IP, pref IPPreference) []net.IP {
+	ordered := make([]net.IP, 0, len(ips))
+	if pref == IPPreferenceNone {
+		return append(ordered, ips...)
+	}
+	preferIPv4 := pref == IPPreferenceIPv4
+	for _, ip := range ips {
+		if (ip.To4() != nil) == preferIPv4 {
+			ordered = append(ordered, ip)
+		}
+	}
+	for _, ip := range ips {
+		if (ip.To4() != nil) != preferIPv4 {
+			ordered = append(ordered, ip)
+		}
+	}
+	return ordered
+}
@@ -0,0 +1,195 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resolverTestMetrics records the results of the lookups.
+type resolverTestMetrics struct {
+	metrics.NoOpMetrics
+	mu      sync.Mutex
+	results []string
+}
+
+func (m *resolverTestMetrics) AddResolverLookup(result string, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.results = append(m.results, result)
+}
+
+func startStubResolverClient(t *testing.T, stub *stubResolver, m metrics.ShadowsocksMetrics) *Resolver {
+	resolver, err := NewResolver(m, &ResolverOptions{Upstream: stub.addr(), Timeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	t.Cleanup(func() { resolver.Close() })
+	return resolver
+}
+
+var (
+	stubIPv4 = net.IP(stubAnswer[:])
+	stubIPv6 = net.IP(stubAnswer6[:])
+)
+
+func TestParseIPPreference(t *testing.T) {
+	for name, expected := range map[string]IPPreference{
+		"":     IPPreferenceNone,
+		"ipv4": IPPreferenceIPv4,
+		"IPv6": IPPreferenceIPv6,
+	} {
+		pref, err := ParseIPPreference(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, pref)
+	}
+	_, err := ParseIPPreference("ipv5")
+	assert.Error(t, err)
+}
+
+func TestOrderIPs(t *testing.T) {
+	v4a, v4b := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	v6a, v6b := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	ips := []net.IP{v6a, v4a, v6b, v4b}
+	assert.Equal(t, ips, orderIPs(ips, IPPreferenceNone))
+	assert.Equal(t, []net.IP{v4a, v4b, v6a, v6b}, orderIPs(ips, IPPreferenceIPv4))
+	assert.Equal(t, []net.IP{v6a, v6b, v4a, v4b}, orderIPs(ips, IPPreferenceIPv6))
+}
+
+func TestResolverUpstream(t *testing.T) {
+	stub := startStubResolver(t, false)
+	m := &resolverTestMetrics{}
+	resolver := startStubResolverClient(t, stub, m)
+
+	ips, err := resolver.LookupIP(context.Background(), "example.com", IPPreferenceIPv6)
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{stubIPv6, stubIPv4}, ips)
+	// The A and AAAA queries.
+	assert.Equal(t, int32(2), atomic.LoadInt32(&stub.queries))
+
+	ips, err = resolver.LookupIP(context.Background(), "Example.com.", IPPreferenceIPv4)
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{stubIPv4, stubIPv6}, ips)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&stub.queries))
+	assert.Equal(t, []string{resolverResultOK, resolverResultCached}, m.results)
+}
+
+func TestResolverIPLiteral(t *testing.T) {
+	stub := startStubResolver(t, false)
+	resolver := startStubResolverClient(t, stub, &metrics.NoOpMetrics{})
+
+	ips, err := resolver.LookupIP(context.Background(), "2001:db8::1", IPPreferenceIPv4)
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("2001:db8::1")}, ips)
+	assert.True(t, resolver.isCached("192.0.2.1"))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&stub.queries))
+}
+
+func TestResolverNegativeCache(t *testing.T) {
+	stub := startStubResolver(t, false)
+	m := &resolverTestMetrics{}
+	resolver := startStubResolverClient(t, stub, m)
+
+	for i := 0; i < 2; i++ {
+		_, err := resolver.LookupIP(context.Background(), "missing.example", IPPreferenceNone)
+		var dnsErr *net.DNSError
+		require.True(t, errors.As(err, &dnsErr))
+		assert.True(t, dnsErr.IsNotFound)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&stub.queries))
+	assert.Equal(t, []string{resolverResultNotFound, resolverResultCached}, m.results)
+}
+
+func TestResolverConcurrent(t *testing.T) {
+	stub := startStubResolver(t, false)
+	resolver := startStubResolverClient(t, stub, &metrics.NoOpMetrics{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := resolver.LookupIP(context.Background(), "example.com", IPPreferenceNone)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&stub.queries))
+}
+
+func TestResolverError(t *testing.T) {
+	stub := startStubResolver(t, true)
+	m := &resolverTestMetrics{}
+	resolver := startStubResolverClient(t, stub, m)
+
+	_, err := resolver.LookupIP(context.Background(), "example.com", IPPreferenceNone)
+	assert.Error(t, err)
+	// Failures are not cached.
+	assert.False(t, resolver.isCached("example.com"))
+	assert.Equal(t, []string{resolverResultError}, m.results)
+}
+
+func TestResolverSystem(t *testing.T) {
+	resolver, err := NewResolver(&metrics.NoOpMetrics{})
+	require.NoError(t, err)
+	defer resolver.Close()
+
+	ips, err := resolver.LookupIP(context.Background(), "localhost", IPPreferenceNone)
+	require.NoError(t, err)
+	require.NotEmpty(t, ips)
+	assert.True(t, ips[0].IsLoopback())
+	assert.True(t, resolver.isCached("localhost"))
+}
+
+func TestTCPDialResolver(t *testing.T) {
+	stub := startStubResolver(t, false)
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	resolver := startStubResolverClient(t, stub, &metrics.NoOpMetrics{})
+	s := NewTCPService(nil, nil, &metrics.NoOpMetrics{}, timeout, &TCPServiceOptions{
+		Resolver:          resolver,
+		TargetIPValidator: allowAll,
+	}).(*tcpService)
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// The IPv6 address is tried first, but there's no listener there.
+	conn, dialErr := s.dial(net.JoinHostPort("example.com", port), &targetPolicy{ipPreference: IPPreferenceIPv6}, nil, &metrics.ProxyMetrics{})
+	require.Nil(t, dialErr)
+	assert.Equal(t, listener.Addr().String(), conn.RemoteAddr().String())
+	conn.Close()
+
+	_, dialErr = s.dial(net.JoinHostPort("missing.example", port), &targetPolicy{}, nil, &metrics.ProxyMetrics{})
+	require.NotNil(t, dialErr)
+	assert.Equal(t, "ERR_RESOLVE_ADDRESS", dialErr.Status)
+}
@@ -69,13 +69,20 @@ var serverSaltLabel = []byte("outline-server-salt")
 // This is useful to prevent the server from accepting its own output in a
 // reflection attack.
 func NewServerSaltGenerator(secret string) ServerSaltGenerator {
+	return NewServerSaltGeneratorFromKey([]byte(secret))
+}
+
+// NewServerSaltGeneratorFromKey is like NewServerSaltGenerator, but derives
+// the marking key from a raw Shadowsocks key, for ciphers created with
+// ss.NewCipherFromKey.
+func NewServerSaltGeneratorFromKey(key []byte) ServerSaltGenerator {
 	// Shadowsocks already uses HKDF-SHA1 to derive the AEAD key, so we use
 	// the same derivation with a different "info" to generate our HMAC key.
-	keySource := hkdf.New(crypto.SHA1.New, []byte(secret), nil, serverSaltLabel)
+	keySource := hkdf.New(crypto.SHA1.New, key, nil, serverSaltLabel)
 	// The key can be any size, but matching the block size is most efficient.
-	key := make([]byte, crypto.SHA1.Size())
-	io.ReadFull(keySource, key)
-	return serverSaltGenerator{key}
+	hmacKey := make([]byte, crypto.SHA1.Size())
+	io.ReadFull(keySource, hmacKey)
+	return serverSaltGenerator{hmacKey}
 }
 
 func (sg serverSaltGenerator) splitSalt(salt []byte) (prefix, mark []byte, err error) {
@@ -111,6 +111,25 @@ func TestServerSaltDifferentCiphers(t *testing.T) {
 	}
 }
 
+// Test that a generator built from a raw key behaves like one built from
+// a secret with the same bytes, and differs from other keys.
+func TestServerSaltFromKey(t *testing.T) {
+	ssg1 := NewServerSaltGeneratorFromKey([]byte("test"))
+	ssg2 := NewServerSaltGenerator("test")
+	ssg3 := NewServerSaltGeneratorFromKey([]byte("other"))
+
+	salt := make([]byte, 32)
+	if err := ssg1.GetSalt(salt); err != nil {
+		t.Fatal(err)
+	}
+	if !ssg1.IsServerSalt(salt) || !ssg2.IsServerSalt(salt) {
+		t.Error("Server salt was not recognized")
+	}
+	if ssg3.IsServerSalt(salt) {
+		t.Error("Different keys should not recognize each other")
+	}
+}
+
 func TestServerSaltShort(t *testing.T) {
 	ssg := NewServerSaltGenerator("test")
 
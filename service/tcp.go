@@ -17,6 +17,7 @@ package service
 import (
 	"bytes"
 	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -63,12 +64,15 @@ func debugTCP(cipherID, template string, val interface{}) {
 // required = saltSize + 2 + cipher.TagSize, the number of bytes needed to authenticate the connection.
 const bytesForKeyFinding = 50
 
+// findAccessKey reads the start of the connection to find the key that
+// encrypted it.  The returned reader starts with the bytes read, even if no key
+// matches, so that they can be forwarded to a Fallback.
 func findAccessKey(clientReader io.Reader, clientIP net.IP, cipherList CipherList) (*CipherEntry, io.Reader, []byte, time.Duration, error) {
 	// We snapshot the list because it may be modified while we use it.
 	ciphers := cipherList.SnapshotForClientIP(clientIP)
 	firstBytes := make([]byte, bytesForKeyFinding)
 	if n, err := io.ReadFull(clientReader, firstBytes); err != nil {
-		return nil, clientReader, nil, 0, fmt.Errorf("Reading header failed after %d bytes: %v", n, err)
+		return nil, io.MultiReader(bytes.NewReader(firstBytes[:n]), clientReader), nil, 0, fmt.Errorf("Reading header failed after %d bytes: %v", n, err)
 	}
 
 	findStartTime := time.Now()
@@ -76,7 +80,7 @@ func findAccessKey(clientReader io.Reader, clientIP net.IP, cipherList CipherLis
 	timeToCipher := time.Now().Sub(findStartTime)
 	if entry == nil {
 		// TODO: Ban and log client IPs with too many failures too quick to protect against DoS.
-		return nil, clientReader, nil, timeToCipher, fmt.Errorf("Could not find valid TCP cipher")
+		return nil, io.MultiReader(bytes.NewReader(firstBytes), clientReader), nil, timeToCipher, fmt.Errorf("Could not find valid TCP cipher")
 	}
 
 	// Move the active cipher to the front, so that the search is quicker next time.
@@ -89,8 +93,13 @@ func findAccessKey(clientReader io.Reader, clientIP net.IP, cipherList CipherLis
 func findEntry(firstBytes []byte, ciphers []*list.Element) (*CipherEntry, *list.Element) {
 	// To hold the decrypted chunk length.
 	chunkLenBuf := [2]byte{}
+	now := time.Now()
 	for _, elt := range ciphers {
 		entry := elt.Value.(*CipherEntry)
+		if !entry.ValidAt(now) {
+			// Keys outside of their validity are treated as unknown.
+			continue
+		}
 		id, cipher := entry.ID, entry.Cipher
 		saltsize := cipher.SaltSize()
 		salt := firstBytes[:saltsize]
@@ -122,11 +131,58 @@ type tcpService struct {
 	replayCache       *ReplayCache
 	targetIPValidator onet.TargetIPValidator
 	dialTarget        TargetDialer
+	idleTimeout       time.Duration
+	maxLifetime       time.Duration
+	resolver          *Resolver
+	ipPreference      IPPreference
+	acl               *ACLPolicy
+	blockedPorts      *onet.PortBlocklist
+	clientLimiter     *ClientLimiter
+	fallback          *Fallback
+	mux               bool
+	natFilter         NATFilter
+	// headerTimeout is fallbackHeaderTimeout, except in tests.
+	headerTimeout time.Duration
+	connsMu       sync.Mutex // Protects .conns
+	conns         map[*connWatchdog]struct{}
 }
 
 type TCPServiceOptions struct {
 	DialTarget        TargetDialer
 	TargetIPValidator onet.TargetIPValidator
+	// IdleTimeout closes relayed connections that have had no traffic in either
+	// direction for this long.  Zero means no limit.
+	IdleTimeout time.Duration
+	// MaxLifetime closes relayed connections this long after they were accepted.
+	// Zero means no limit.
+	MaxLifetime time.Duration
+	// Resolver resolves the hostnames of targets before DialTarget is called
+	// with each address in turn.  It may be shared among services.  Nil leaves
+	// hostnames to DialTarget.
+	Resolver *Resolver
+	// IPPreference chooses which address family is dialed first, unless the
+	// client's key overrides it.  It requires a Resolver.
+	IPPreference IPPreference
+	// ACL decides which targets clients may reach, before TargetIPValidator,
+	// unless the client's key overrides it.  Nil allows all targets.
+	ACL *ACLPolicy
+	// BlockedPorts holds the target ports that no client may reach, with
+	// status ERR_PORT_BLOCKED.  It may be shared among services.  Nil blocks
+	// nothing.
+	BlockedPorts *onet.PortBlocklist
+	// Fallback receives the connections that fail authentication, instead of
+	// absorbing them.  Nil disables it.
+	Fallback *Fallback
+	// ClientLimiter limits the connections of each client IP address and
+	// subnet as soon as they are accepted, before any trial decryption.  It may
+	// be shared among services.  Nil disables the limits.
+	ClientLimiter *ClientLimiter
+	// NATFilter decides which peers can reply to UDP-over-TCP clients, unless
+	// the client's key overrides it.  Defaults to NATFilterEndpointIndependent.
+	NATFilter NATFilter
+	// Mux accepts the connections to ss.MuxTargetAddr, which carry multiplexed
+	// streams.  Otherwise they fail with status ERR_MUX_DISABLED.
+	Mux bool
 }
 
 // NewTCPService creates a default TCPService
@@ -140,6 +196,15 @@ func NewTCPService(
 	// Init the default options and override with any provided.
 	var dialTarget TargetDialer = DefaultDialTarget
 	var targetIPValidator onet.TargetIPValidator = onet.RequirePublicIP
+	var idleTimeout, maxLifetime time.Duration
+	var resolver *Resolver
+	var ipPreference IPPreference
+	var acl *ACLPolicy
+	var blockedPorts *onet.PortBlocklist
+	var clientLimiter *ClientLimiter
+	var fallback *Fallback
+	var mux bool
+	natFilter := NATFilterEndpointIndependent
 	if opts != nil {
 		if len(opts) > 1 {
 			logger.Errorf(
@@ -151,6 +216,18 @@ func NewTCPService(
 		if opts[0].TargetIPValidator != nil {
 			targetIPValidator = opts[0].TargetIPValidator
 		}
+		idleTimeout = opts[0].IdleTimeout
+		maxLifetime = opts[0].MaxLifetime
+		resolver = opts[0].Resolver
+		ipPreference = opts[0].IPPreference
+		acl = opts[0].ACL
+		blockedPorts = opts[0].BlockedPorts
+		clientLimiter = opts[0].ClientLimiter
+		fallback = opts[0].Fallback
+		mux = opts[0].Mux
+		if opts[0].NATFilter != "" {
+			natFilter = opts[0].NATFilter
+		}
 	}
 	return &tcpService{
 		ciphers:           ciphers,
@@ -159,6 +236,18 @@ func NewTCPService(
 		replayCache:       replayCache,
 		targetIPValidator: targetIPValidator,
 		dialTarget:        dialTarget,
+		idleTimeout:       idleTimeout,
+		maxLifetime:       maxLifetime,
+		resolver:          resolver,
+		ipPreference:      ipPreference,
+		acl:               acl,
+		blockedPorts:      blockedPorts,
+		clientLimiter:     clientLimiter,
+		fallback:          fallback,
+		mux:               mux,
+		natFilter:         natFilter,
+		headerTimeout:     fallbackHeaderTimeout,
+		conns:             make(map[*connWatchdog]struct{}),
 	}
 }
 
@@ -172,6 +261,11 @@ type TCPService interface {
 	Stop() error
 	// GracefulStop calls Stop(), and then blocks until all resources have been cleaned up.
 	GracefulStop() error
+	// ActiveConnections returns the number of client connections being handled.
+	ActiveConnections() int
+	// CloseConnections closes all the client connections being handled.  They
+	// report the status ERR_SHUTDOWN.
+	CloseConnections()
 }
 
 func (s *tcpService) SetTargetIPValidator(targetIPValidator onet.TargetIPValidator) {
@@ -227,21 +321,30 @@ func (s *tcpService) Serve(listener onet.TCPListener) error {
 			logger.Errorf("Accept failed: %v", err)
 			continue
 		}
+		release, limit := s.clientLimiter.admit(remoteIP(clientTCPConn))
+		if limit != "" {
+			s.rejectClient(clientTCPConn, limit)
+			continue
+		}
 
 		s.running.Add(1)
 		go func() {
 			defer s.running.Done()
+			defer release()
 			defer func() {
 				if r := recover(); r != nil {
 					logger.Errorf("Panic in TCP handler: %v", r)
 				}
 			}()
-			s.handleConnection(listener.Addr().(*net.TCPAddr).Port, clientTCPConn)
+			s.handleConnection(listener.Addr().(*net.TCPAddr).Port, clientTCPConn, release)
 		}()
 	}
 }
 
-func (s *tcpService) handleConnection(listenerPort int, clientTCPConn onet.TCPConn) {
+// handleConnection authenticates and relays `clientTCPConn`.  It calls `release`
+// to free the client's ClientLimiter slot once the connection is authenticated
+// or handed to the fallback.
+func (s *tcpService) handleConnection(listenerPort int, clientTCPConn onet.TCPConn, release func()) {
 	clientLocation, err := s.m.GetLocation(clientTCPConn.RemoteAddr())
 	if err != nil {
 		logger.Warningf("Failed location lookup: %v", err)
@@ -254,14 +357,27 @@ func (s *tcpService) handleConnection(listenerPort int, clientTCPConn onet.TCPCo
 	// Set a deadline to receive the address to the target.
 	clientTCPConn.SetReadDeadline(connStart.Add(s.readTimeout))
 	var proxyMetrics metrics.ProxyMetrics
-	clientConn := metrics.MeasureConn(clientTCPConn, &proxyMetrics.ProxyClient, &proxyMetrics.ClientProxy)
-	cipherEntry, clientReader, clientSalt, timeToCipher, keyErr := findAccessKey(clientConn, remoteIP(clientTCPConn), s.ciphers)
+	watchdog := newConnWatchdog()
+	watchdog.closeOnFire(clientTCPConn)
+	s.addConn(watchdog)
+	defer s.removeConn(watchdog)
+	clientConn := metrics.MeasureConn(watchdog.track(clientTCPConn), &proxyMetrics.ProxyClient, &proxyMetrics.ClientProxy)
+	var headerReader io.Reader = clientConn
+	if s.fallback.Addr() != "" {
+		headerReader = &partialHeaderReader{Reader: clientConn, conn: clientTCPConn, timeout: s.headerTimeout, deadline: connStart.Add(s.readTimeout)}
+	}
+	cipherEntry, clientReader, clientSalt, timeToCipher, keyErr := findAccessKey(headerReader, remoteIP(clientTCPConn), s.ciphers)
+	if keyErr == nil {
+		release()
+		// The rest of the handshake has the usual deadline.
+		clientTCPConn.SetReadDeadline(connStart.Add(s.readTimeout))
+	}
 
 	connError := func() *onet.ConnectionError {
 		if keyErr != nil {
 			logger.Debugf("Failed to find a valid cipher after reading %v bytes: %v", proxyMetrics.ClientProxy, keyErr)
 			const status = "ERR_CIPHER"
-			s.absorbProbe(listenerPort, clientConn, clientLocation, status, &proxyMetrics)
+			s.handleProbe(listenerPort, clientConn, clientReader, watchdog, connStart, release, clientLocation, status, &proxyMetrics)
 			return onet.NewConnectionError(status, "Failed to find a valid cipher", keyErr)
 		}
 
@@ -274,7 +390,7 @@ func (s *tcpService) handleConnection(listenerPort int, clientTCPConn onet.TCPCo
 			} else {
 				status = "ERR_REPLAY_CLIENT"
 			}
-			s.absorbProbe(listenerPort, clientConn, clientLocation, status, &proxyMetrics)
+			s.handleProbe(listenerPort, clientConn, clientReader, watchdog, connStart, release, clientLocation, status, &proxyMetrics)
 			logger.Debugf(status+": %v in %s sent %d bytes", clientTCPConn.RemoteAddr(), clientLocation, proxyMetrics.ClientProxy)
 			return onet.NewConnectionError(status, "Replay detected", nil)
 		}
@@ -288,17 +404,32 @@ func (s *tcpService) handleConnection(listenerPort int, clientTCPConn onet.TCPCo
 			io.Copy(ioutil.Discard, clientConn)
 			return onet.NewConnectionError("ERR_READ_ADDRESS", "Failed to get target address", err)
 		}
+		// Limit the time the relay may hold resources, now that the read deadline is gone.
+		idleTimeout, maxLifetime := s.relayTimeouts(cipherEntry)
+		watchdog.start(idleTimeout, maxLifetime, connStart, cipherEntry.closeTime())
+
+		ssw := ss.NewShadowsocksWriter(clientConn, cipherEntry.Cipher)
+		ssw.SetSaltGenerator(cipherEntry.SaltGenerator)
+		policy := s.targetPolicyFor(cipherEntry)
+		switch tgtAddr.String() {
+		case ss.MuxTargetAddr:
+			if !s.mux {
+				return onet.NewConnectionError("ERR_MUX_DISABLED", "Multiplexing is disabled", nil)
+			}
+			return s.handleMux(onet.WrapConn(clientConn, ssr, ssw), clientTCPConn, watchdog, cipherEntry, policy, &proxyMetrics)
+		case ss.UDPOverTCPTargetAddr:
+			return s.handleUDPOverTCP(ssr, ssw, clientTCPConn, cipherEntry, clientLocation, policy, &proxyMetrics)
+		}
 
-		tgtConn, dialErr := s.dialTarget(tgtAddr.String(), clientTCPConn, &proxyMetrics, s.targetIPValidator)
+		tgtConn, dialErr := s.dial(tgtAddr.String(), policy, clientTCPConn, &proxyMetrics)
 		if dialErr != nil {
 			// We don't drain so dial errors and invalid addresses are communicated quickly.
 			return dialErr
 		}
 		defer tgtConn.Close()
+		watchdog.closeOnFire(tgtConn)
 
 		// logger.Debugf("proxy %s <-> %s", clientTCPConn.RemoteAddr().String(), tgtConn.RemoteAddr().String())
-		ssw := ss.NewShadowsocksWriter(clientConn, cipherEntry.Cipher)
-		ssw.SetSaltGenerator(cipherEntry.SaltGenerator)
 
 		fromClientErrCh := make(chan error)
 		go func() {
@@ -328,6 +459,10 @@ func (s *tcpService) handleConnection(listenerPort int, clientTCPConn onet.TCPCo
 		}
 		return nil
 	}()
+	if timeoutErr := watchdog.connError(); timeoutErr != nil {
+		// Closing the connections made the handler fail, so report the cause instead.
+		connError = timeoutErr
+	}
 
 	connDuration := time.Now().Sub(connStart)
 	status := "OK"
@@ -344,6 +479,67 @@ func (s *tcpService) handleConnection(listenerPort int, clientTCPConn onet.TCPCo
 	// logger.Debugf("Done with status %v, duration %v", status, connDuration)
 }
 
+// targetPolicyFor returns the target settings for clients that use
+// `cipherEntry`.  The settings of the access key take precedence over the
+// service's.
+func (s *tcpService) targetPolicyFor(cipherEntry *CipherEntry) *targetPolicy {
+	policy := &targetPolicy{ipPreference: s.ipPreference, acl: s.acl, blockedPorts: s.blockedPorts, m: s.m}
+	if cipherEntry.IPPreference != IPPreferenceNone {
+		policy.ipPreference = cipherEntry.IPPreference
+	}
+	if cipherEntry.ACL != nil {
+		policy.acl = cipherEntry.ACL
+	}
+	return policy
+}
+
+// dial connects to the host:port `tgtAddr` with DialTarget, if `policy`
+// allows it.  With a resolver, a hostname is resolved first, and its addresses
+// are tried in the order of the IP preference until one connects.
+func (s *tcpService) dial(tgtAddr string, policy *targetPolicy, clientTCPConn onet.TCPConn, proxyMetrics *metrics.ProxyMetrics) (onet.TCPConn, *onet.ConnectionError) {
+	check := policy.check("tcp", tgtAddr, s.targetIPValidator)
+	if connErr := check.checkHost(); connErr != nil {
+		return nil, connErr
+	}
+	host, port, err := net.SplitHostPort(tgtAddr)
+	if s.resolver == nil || err != nil {
+		return s.dialTarget(tgtAddr, clientTCPConn, proxyMetrics, check.checkIP)
+	}
+	ips, err := s.resolver.LookupIP(context.Background(), host, policy.ipPreference)
+	if err != nil {
+		return nil, onet.NewConnectionError("ERR_RESOLVE_ADDRESS", fmt.Sprintf("Failed to resolve target address %v", tgtAddr), err)
+	}
+	var dialErr *onet.ConnectionError
+	for _, ip := range ips {
+		var tgtConn onet.TCPConn
+		tgtConn, dialErr = s.dialTarget(net.JoinHostPort(ip.String(), port), clientTCPConn, proxyMetrics, check.checkIP)
+		if dialErr == nil {
+			return tgtConn, nil
+		}
+	}
+	return nil, dialErr
+}
+
+// relayTimeouts returns the idle timeout and maximum lifetime for relays that use
+// `cipherEntry`, zero meaning no limit.  The settings of the access key take
+// precedence over the service's.
+func (s *tcpService) relayTimeouts(cipherEntry *CipherEntry) (idleTimeout, maxLifetime time.Duration) {
+	return keyTimeout(cipherEntry.IdleTimeout, s.idleTimeout), keyTimeout(cipherEntry.MaxLifetime, s.maxLifetime)
+}
+
+// keyTimeout applies the timeout `keyValue` of an access key to the service's
+// `serviceValue`: zero inherits it, and negative values remove the limit.
+func keyTimeout(keyValue, serviceValue time.Duration) time.Duration {
+	switch {
+	case keyValue < 0:
+		return 0
+	case keyValue > 0:
+		return keyValue
+	default:
+		return serviceValue
+	}
+}
+
 // Keep the connection open until we hit the authentication deadline to protect against probing attacks
 // `proxyMetrics` is a pointer because its value is being mutated by `clientConn`.
 func (s *tcpService) absorbProbe(listenerPort int, clientConn io.ReadCloser, clientLocation, status string, proxyMetrics *metrics.ProxyMetrics) {
@@ -353,6 +549,25 @@ func (s *tcpService) absorbProbe(listenerPort int, clientConn io.ReadCloser, cli
 	s.m.AddTCPProbe(status, drainResult, listenerPort, *proxyMetrics)
 }
 
+// rejectClient drops or absorbs a connection whose client is over `limit`,
+// without spawning a goroutine per connection beyond the absorbing limit.
+func (s *tcpService) rejectClient(clientTCPConn onet.TCPConn, limit string) {
+	action, absorb := s.clientLimiter.action()
+	s.m.AddRateLimited("tcp", limit, string(action))
+	if !absorb {
+		clientTCPConn.Close()
+		return
+	}
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		defer s.clientLimiter.doneAbsorbing()
+		defer clientTCPConn.Close()
+		clientTCPConn.SetReadDeadline(time.Now().Add(s.readTimeout))
+		io.Copy(ioutil.Discard, clientTCPConn)
+	}()
+}
+
 func drainErrToString(drainErr error) string {
 	netErr, ok := drainErr.(net.Error)
 	switch {
@@ -380,3 +595,31 @@ func (s *tcpService) GracefulStop() error {
 	s.running.Wait()
 	return err
 }
+
+func (s *tcpService) addConn(w *connWatchdog) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	s.conns[w] = struct{}{}
+}
+
+// removeConn forgets and releases the watchdog of a finished connection.
+func (s *tcpService) removeConn(w *connWatchdog) {
+	s.connsMu.Lock()
+	delete(s.conns, w)
+	s.connsMu.Unlock()
+	w.stop()
+}
+
+func (s *tcpService) ActiveConnections() int {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	return len(s.conns)
+}
+
+func (s *tcpService) CloseConnections() {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	for w := range s.conns {
+		w.fire("ERR_SHUTDOWN")
+	}
+}
@@ -126,6 +126,28 @@ func TestCompatibleCiphers(t *testing.T) {
 	}
 }
 
+func TestFindAccessKeyValidity(t *testing.T) {
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	entry := cipherList.SnapshotForClientIP(nil)[0].Value.(*CipherEntry)
+	var stream bytes.Buffer
+	_, err = ss.NewShadowsocksWriter(&stream, entry.Cipher).Write(ss.MakeTestPayload(50))
+	require.NoError(t, err)
+
+	for _, window := range []struct{ notBefore, notAfter time.Time }{
+		{time.Now().Add(time.Hour), time.Time{}},
+		{time.Time{}, time.Now().Add(-time.Hour)},
+	} {
+		entry.NotBefore, entry.NotAfter = window.notBefore, window.notAfter
+		_, _, _, _, err := findAccessKey(bytes.NewReader(stream.Bytes()), nil, cipherList)
+		require.Error(t, err, "Key valid in [%v, %v) was accepted", window.notBefore, window.notAfter)
+	}
+	entry.NotBefore, entry.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	found, _, _, _, err := findAccessKey(bytes.NewReader(stream.Bytes()), nil, cipherList)
+	require.NoError(t, err)
+	require.Equal(t, entry, found)
+}
+
 // Fake DuplexConn
 // 1-way pipe, representing the upstream flow as seen by the server.
 type conn struct {
@@ -222,6 +244,11 @@ type probeTestMetrics struct {
 	probeData   []metrics.ProxyMetrics
 	probeStatus []string
 	closeStatus []string
+	// Fallbacks as "status/result".
+	fallbacks []string
+	// Statuses of the UDP-over-TCP datagrams.
+	udpClientStatus []string
+	udpTargetStatus []string
 }
 
 func (m *probeTestMetrics) AddTCPProbe(status, drainResult string, port int, data metrics.ProxyMetrics) {
@@ -230,6 +257,13 @@ func (m *probeTestMetrics) AddTCPProbe(status, drainResult string, port int, dat
 	m.probeStatus = append(m.probeStatus, status)
 	m.mu.Unlock()
 }
+func (m *probeTestMetrics) AddTCPFallback(status, result string, port int, data metrics.ProxyMetrics) {
+	m.mu.Lock()
+	m.probeData = append(m.probeData, data)
+	m.fallbacks = append(m.fallbacks, status+"/"+result)
+	m.mu.Unlock()
+}
+func (m *probeTestMetrics) AddTCPMuxStream(accessKey, status string) {}
 func (m *probeTestMetrics) AddClosedTCPConnection(clientLocation, accessKey, status string, data metrics.ProxyMetrics, timeToCipher, duration time.Duration) {
 	m.mu.Lock()
 	m.closeStatus = append(m.closeStatus, status)
@@ -244,11 +278,24 @@ func (m *probeTestMetrics) SetNumAccessKeys(numKeys int, numPorts int) {
 func (m *probeTestMetrics) AddOpenTCPConnection(clientLocation string) {
 }
 func (m *probeTestMetrics) AddUDPPacketFromClient(clientLocation, accessKey, status string, clientProxyBytes, proxyTargetBytes int, timeToCipher time.Duration) {
+	m.mu.Lock()
+	m.udpClientStatus = append(m.udpClientStatus, status)
+	m.mu.Unlock()
 }
 func (m *probeTestMetrics) AddUDPPacketFromTarget(clientLocation, accessKey, status string, targetProxyBytes, proxyClientBytes int) {
+	m.mu.Lock()
+	m.udpTargetStatus = append(m.udpTargetStatus, status)
+	m.mu.Unlock()
+}
+func (m *probeTestMetrics) AddUDPNatEntry(accessKey string)    {}
+func (m *probeTestMetrics) RemoveUDPNatEntry(accessKey string) {}
+func (m *probeTestMetrics) AddClosedUDPSession(clientLocation, accessKey string, data metrics.UDPSessionMetrics, duration time.Duration) {
+}
+func (m *probeTestMetrics) AddUDPDNSQuery(accessKey, result string) {}
+func (m *probeTestMetrics) AddResolverLookup(result string, latency time.Duration) {
 }
-func (m *probeTestMetrics) AddUDPNatEntry()    {}
-func (m *probeTestMetrics) RemoveUDPNatEntry() {}
+func (m *probeTestMetrics) AddACLHit(policy, rule, action string)      {}
+func (m *probeTestMetrics) AddRateLimited(proto, limit, action string) {}
 
 func (m *probeTestMetrics) countStatuses() map[string]int {
 	counts := make(map[string]int)
@@ -714,3 +761,29 @@ func TestTCPEarlyStop(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestTCPBlockedPorts(t *testing.T) {
+	ranges, err := onet.ParseBlockedPorts(onet.DefaultBlockedPorts)
+	require.NoError(t, err)
+	dialed := false
+	dialTarget := func(tgtAddr string, clientTCPConn onet.TCPConn, proxyMetrics *metrics.ProxyMetrics, targetIPValidator onet.TargetIPValidator) (onet.TCPConn, *onet.ConnectionError) {
+		dialed = true
+		return nil, onet.NewConnectionError("ERR_CONNECT", "Not dialing in tests", nil)
+	}
+	s := NewTCPService(nil, nil, &probeTestMetrics{}, timeout, &TCPServiceOptions{
+		DialTarget:   dialTarget,
+		BlockedPorts: onet.NewPortBlocklist(ranges),
+	}).(*tcpService)
+	policy := s.targetPolicyFor(&CipherEntry{})
+
+	for _, tgtAddr := range []string{"192.0.2.1:25", "mail.example:587"} {
+		_, dialErr := s.dial(tgtAddr, policy, nil, &metrics.ProxyMetrics{})
+		require.NotNil(t, dialErr)
+		require.Equal(t, "ERR_PORT_BLOCKED", dialErr.Status)
+	}
+	require.False(t, dialed, "Blocked targets should not be dialed")
+
+	_, dialErr := s.dial("192.0.2.1:443", policy, nil, &metrics.ProxyMetrics{})
+	require.Equal(t, "ERR_CONNECT", dialErr.Status)
+	require.True(t, dialed)
+}
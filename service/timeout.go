@@ -0,0 +1,191 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+)
+
+// connWatchdog closes a relayed connection once no bytes have flowed in either
+// direction for the idle timeout, once it reaches its maximum lifetime, or when
+// the service shuts down.  Every byte of a relay passes through the client
+// connection, so watching that connection is enough to detect activity.
+type connWatchdog struct {
+	lastActivity int64 // Unix time in nanoseconds.  Accessed atomically.
+	// Non-zero once only the streams count as activity.  Accessed atomically.
+	streamsOnly int32
+	mu          sync.Mutex
+	closers     []io.Closer // Closed when the watchdog fires.
+	status      string      // Non-empty once the watchdog has fired.
+	done        chan struct{}
+}
+
+func newConnWatchdog() *connWatchdog {
+	w := &connWatchdog{done: make(chan struct{})}
+	w.touch()
+	return w
+}
+
+func (w *connWatchdog) touch() {
+	atomic.StoreInt64(&w.lastActivity, time.Now().UnixNano())
+}
+
+// track returns a view of `conn` that records activity on the watchdog.
+func (w *connWatchdog) track(conn onet.TCPConn) onet.TCPConn {
+	return &watchedConn{TCPConn: conn, w: w}
+}
+
+// watchStreams stops counting the traffic of the tracked connections as
+// activity, because it carries multiplexed streams whose keepalive frames would
+// keep an idle session open.  Only the streams returned by trackStream count.
+func (w *connWatchdog) watchStreams() {
+	atomic.StoreInt32(&w.streamsOnly, 1)
+}
+
+// trackStream returns a view of `stream`, multiplexed in a tracked connection,
+// that records activity on the watchdog.
+func (w *connWatchdog) trackStream(stream onet.TCPConn) onet.TCPConn {
+	return &watchedConn{TCPConn: stream, w: w, stream: true}
+}
+
+// start begins watching.  A zero `idleTimeout` or `maxLifetime` disables that
+// limit, and the lifetime is counted from `connStart`.  The watchdog also fires
+// at `keyExpiry`, unless it's zero.  start must be called at most once, and stop
+// must be called afterwards to release the watchdog.
+func (w *connWatchdog) start(idleTimeout, maxLifetime time.Duration, connStart, keyExpiry time.Time) {
+	if idleTimeout <= 0 && maxLifetime <= 0 && keyExpiry.IsZero() {
+		return
+	}
+	w.touch()
+	go func() {
+		timer := time.NewTimer(w.nextCheck(idleTimeout, maxLifetime, connStart, keyExpiry))
+		defer timer.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case now := <-timer.C:
+				if !keyExpiry.IsZero() && !now.Before(keyExpiry) {
+					w.fire("ERR_KEY_EXPIRED")
+					return
+				}
+				if maxLifetime > 0 && now.Sub(connStart) >= maxLifetime {
+					w.fire("ERR_MAX_LIFETIME")
+					return
+				}
+				if idleTimeout > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&w.lastActivity))) >= idleTimeout {
+					w.fire("ERR_IDLE_TIMEOUT")
+					return
+				}
+				timer.Reset(w.nextCheck(idleTimeout, maxLifetime, connStart, keyExpiry))
+			}
+		}
+	}()
+}
+
+// nextCheck returns the time until the watchdog could next fire.
+func (w *connWatchdog) nextCheck(idleTimeout, maxLifetime time.Duration, connStart, keyExpiry time.Time) time.Duration {
+	var deadline time.Time
+	if idleTimeout > 0 {
+		deadline = time.Unix(0, atomic.LoadInt64(&w.lastActivity)).Add(idleTimeout)
+	}
+	if maxLifetime > 0 {
+		if lifetimeDeadline := connStart.Add(maxLifetime); deadline.IsZero() || lifetimeDeadline.Before(deadline) {
+			deadline = lifetimeDeadline
+		}
+	}
+	if !keyExpiry.IsZero() && (deadline.IsZero() || keyExpiry.Before(deadline)) {
+		deadline = keyExpiry
+	}
+	return time.Until(deadline)
+}
+
+// stop releases the watchdog.  It is safe to call even if start wasn't.
+func (w *connWatchdog) stop() {
+	close(w.done)
+}
+
+// closeOnFire registers `c` to be closed when the watchdog fires, or closes it
+// immediately if the watchdog has already fired.
+func (w *connWatchdog) closeOnFire(c io.Closer) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.status != "" {
+		c.Close()
+		return
+	}
+	w.closers = append(w.closers, c)
+}
+
+// fire closes the registered connections, and records `status` as the reason.
+// Only the first call has any effect.
+func (w *connWatchdog) fire(status string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.status != "" {
+		return
+	}
+	w.status = status
+	for _, c := range w.closers {
+		c.Close()
+	}
+}
+
+// connError returns the error for the reason the watchdog closed the connection, or nil
+// if the watchdog hasn't fired.
+func (w *connWatchdog) connError() *onet.ConnectionError {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch w.status {
+	case "ERR_IDLE_TIMEOUT":
+		return onet.NewConnectionError(w.status, "Connection was idle for too long", nil)
+	case "ERR_MAX_LIFETIME":
+		return onet.NewConnectionError(w.status, "Connection reached its maximum lifetime", nil)
+	case "ERR_KEY_EXPIRED":
+		return onet.NewConnectionError(w.status, "Access key expired", nil)
+	case "ERR_SHUTDOWN":
+		return onet.NewConnectionError(w.status, "Server shut down before the connection finished", nil)
+	}
+	return nil
+}
+
+type watchedConn struct {
+	onet.TCPConn
+	w      *connWatchdog
+	stream bool
+}
+
+func (c *watchedConn) onActivity(n int) {
+	if n > 0 && (c.stream || atomic.LoadInt32(&c.w.streamsOnly) == 0) {
+		c.w.touch()
+	}
+}
+
+func (c *watchedConn) Read(b []byte) (int, error) {
+	n, err := c.TCPConn.Read(b)
+	c.onActivity(n)
+	return n, err
+}
+
+func (c *watchedConn) Write(b []byte) (int, error) {
+	n, err := c.TCPConn.Write(b)
+	c.onActivity(n)
+	return n, err
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeCloser struct {
+	closed chan struct{}
+}
+
+func newFakeCloser() *fakeCloser {
+	return &fakeCloser{closed: make(chan struct{})}
+}
+
+func (c *fakeCloser) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func (c *fakeCloser) waitClosed(t *testing.T) {
+	select {
+	case <-c.closed:
+	case <-time.After(time.Second):
+		t.Fatal("Watchdog didn't close the connection")
+	}
+}
+
+func TestWatchdogIdleTimeout(t *testing.T) {
+	w := newConnWatchdog()
+	defer w.stop()
+	c := newFakeCloser()
+	w.closeOnFire(c)
+	w.start(50*time.Millisecond, 0, time.Now(), time.Time{})
+	// Activity postpones the timeout.
+	for i := 0; i < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+		w.touch()
+	}
+	require.Nil(t, w.connError())
+	c.waitClosed(t)
+	require.Equal(t, "ERR_IDLE_TIMEOUT", w.connError().Status)
+}
+
+func TestWatchdogMaxLifetime(t *testing.T) {
+	w := newConnWatchdog()
+	defer w.stop()
+	c := newFakeCloser()
+	w.closeOnFire(c)
+	w.start(time.Hour, 50*time.Millisecond, time.Now(), time.Time{})
+	c.waitClosed(t)
+	require.Equal(t, "ERR_MAX_LIFETIME", w.connError().Status)
+
+	// Connections registered afterwards are closed immediately.
+	late := newFakeCloser()
+	w.closeOnFire(late)
+	late.waitClosed(t)
+}
+
+func TestWatchdogKeyExpiry(t *testing.T) {
+	w := newConnWatchdog()
+	defer w.stop()
+	c := newFakeCloser()
+	w.closeOnFire(c)
+	w.start(time.Hour, time.Hour, time.Now(), time.Now().Add(50*time.Millisecond))
+	c.waitClosed(t)
+	require.Equal(t, "ERR_KEY_EXPIRED", w.connError().Status)
+}
+
+func TestWatchdogDisabled(t *testing.T) {
+	w := newConnWatchdog()
+	c := newFakeCloser()
+	w.closeOnFire(c)
+	w.start(0, 0, time.Now(), time.Time{})
+	time.Sleep(20 * time.Millisecond)
+	w.stop()
+	require.Nil(t, w.connError())
+	select {
+	case <-c.closed:
+		t.Fatal("Disabled watchdog closed the connection")
+	default:
+	}
+}
+
+func TestRelayTimeouts(t *testing.T) {
+	s := &tcpService{idleTimeout: time.Minute, maxLifetime: time.Hour}
+	idle, lifetime := s.relayTimeouts(&CipherEntry{})
+	require.Equal(t, time.Minute, idle)
+	require.Equal(t, time.Hour, lifetime)
+	idle, lifetime = s.relayTimeouts(&CipherEntry{IdleTimeout: time.Second})
+	require.Equal(t, time.Second, idle)
+	require.Equal(t, time.Hour, lifetime)
+	// Negative values disable the limit.
+	idle, lifetime = s.relayTimeouts(&CipherEntry{IdleTimeout: time.Second, MaxLifetime: -1})
+	require.Equal(t, time.Second, idle)
+	require.Equal(t, time.Duration(0), lifetime)
+}
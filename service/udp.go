@@ -20,6 +20,7 @@ import (
 	"net"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	onet "github.com/Jigsaw-Code/outline-ss-server/net"
@@ -50,13 +51,19 @@ func debugUDPAddr(addr net.Addr, template string, val interface{}) {
 
 // Decrypts src into dst. It tries each cipher until it finds one that authenticates
 // correctly. dst and src must not overlap.
-func findAccessKeyUDP(clientIP net.IP, dst, src []byte, cipherList CipherList) ([]byte, string, *ss.Cipher, error) {
+func findAccessKeyUDP(clientIP net.IP, dst, src []byte, cipherList CipherList) ([]byte, *CipherEntry, error) {
 	// Try each cipher until we find one that authenticates successfully. This assumes that all ciphers are AEAD.
 	// We snapshot the list because it may be modified while we use it.
 	snapshot := cipherList.SnapshotForClientIP(clientIP)
+	now := time.Now()
 	for ci, entry := range snapshot {
-		id, cipher := entry.Value.(*CipherEntry).ID, entry.Value.(*CipherEntry).Cipher
-		buf, err := ss.Unpack(dst, src, cipher)
+		cipherEntry := entry.Value.(*CipherEntry)
+		if !cipherEntry.ValidAt(now) {
+			// Keys outside of their validity are treated as unknown.
+			continue
+		}
+		id := cipherEntry.ID
+		buf, err := ss.Unpack(dst, src, cipherEntry.Cipher)
 		if err != nil {
 			debugUDP(id, "Failed to unpack: %v", err)
 			continue
@@ -64,25 +71,127 @@ func findAccessKeyUDP(clientIP net.IP, dst, src []byte, cipherList CipherList) (
 		debugUDP(id, "Found cipher at index %d", ci)
 		// Move the active cipher to the front, so that the search is quicker next time.
 		cipherList.MarkUsedByClientIP(entry, clientIP)
-		return buf, id, cipher, nil
+		return buf, cipherEntry, nil
 	}
-	return nil, "", nil, errors.New("could not find valid cipher")
+	return nil, nil, errors.New("could not find valid cipher")
 }
 
 type udpService struct {
-	mu                sync.RWMutex // Protects .clientConn and .stopped
+	mu                sync.RWMutex // Protects .clientConn, .nm, .stopped and .draining
 	clientConn        net.PacketConn
+	nm                *natmap
 	stopped           bool
+	draining          bool
+	done              chan struct{} // Closed by Stop.
 	natTimeout        time.Duration
 	ciphers           CipherList
 	m                 metrics.ShadowsocksMetrics
 	running           sync.WaitGroup
 	targetIPValidator onet.TargetIPValidator
+	numReaders        int
+	batchIO           bool
+	natFilter         NATFilter
+	natLimits         natLimits
+	replayFilter      *UDPReplayFilter
+	dnsProxy          *DNSProxy
+	dnsClients        *dnsClients
+	resolver          *Resolver
+	ipPreference      IPPreference
+	acl               *ACLPolicy
+	blockedPorts      *onet.PortBlocklist
+	clientLimiter     *ClientLimiter
+	// Packets waiting for the resolver, which must be forwarded before the NAT
+	// table is closed.
+	forwarding     sync.WaitGroup
+	pendingLookups int32 // Accessed atomically.
+}
+
+type UDPServiceOptions struct {
+	// NumReaders is the number of goroutines that read and forward packets from
+	// the client socket concurrently.  Defaults to 1.
+	NumReaders int
+	// BatchIO reads and writes several datagrams per system call on the client
+	// socket, where supported (Linux).
+	BatchIO bool
+	// NATFilter decides which peers can reply to a client, unless the client's
+	// key overrides it.  Defaults to NATFilterEndpointIndependent.
+	NATFilter NATFilter
+	// MaxNATEntries and MaxNATEntriesPerKey limit the number of clients with
+	// a NAT entry, in total and per access key.  Each entry holds a socket.
+	// Zero means no limit.  CipherEntry.MaxNATEntries overrides the limit of
+	// its key.
+	MaxNATEntries       int
+	MaxNATEntriesPerKey int
+	// EvictNATEntries makes room for new clients by evicting the least recently
+	// active entry, instead of dropping their packets with ERR_NAT_LIMIT.
+	EvictNATEntries bool
+	// ReplayFilter rejects packets whose salt was seen recently.  It may be
+	// shared among services.  Nil disables it.  Packets that the server itself
+	// encrypted are always rejected.
+	ReplayFilter *UDPReplayFilter
+	// DNSProxy answers the packets to port 53 itself, instead of forwarding
+	// them to the target.  It may be shared among services.  Nil disables it.
+	DNSProxy *DNSProxy
+	// Resolver resolves the hostnames of targets without blocking the readers.
+	// It may be shared among services.  Nil uses the system resolver
+	// synchronously.
+	Resolver *Resolver
+	// IPPreference chooses the address family of targets with both, unless the
+	// client's key overrides it.
+	IPPreference IPPreference
+	// ACL decides which targets clients may reach, before the
+	// TargetIPValidator, unless the client's key overrides it.  Nil allows all
+	// targets.
+	ACL *ACLPolicy
+	// BlockedPorts holds the target ports that no client may reach, with
+	// status ERR_PORT_BLOCKED.  It may be shared among services.  Nil blocks
+	// nothing.
+	BlockedPorts *onet.PortBlocklist
+	// ClientLimiter limits the packets from new client addresses, before any
+	// trial decryption, and the NAT entries of each client IP address and
+	// subnet.  It may be shared among services.  Nil disables the limits.
+	ClientLimiter *ClientLimiter
 }
 
 // NewUDPService creates a UDPService
-func NewUDPService(natTimeout time.Duration, cipherList CipherList, m metrics.ShadowsocksMetrics) UDPService {
-	return &udpService{natTimeout: natTimeout, ciphers: cipherList, m: m, targetIPValidator: onet.RequirePublicIP}
+func NewUDPService(natTimeout time.Duration, cipherList CipherList, m metrics.ShadowsocksMetrics, opts ...*UDPServiceOptions) UDPService {
+	numReaders := 1
+	batchIO := false
+	natFilter := NATFilterEndpointIndependent
+	var limits natLimits
+	var replayFilter *UDPReplayFilter
+	var dnsProxy *DNSProxy
+	var resolver *Resolver
+	var ipPreference IPPreference
+	var acl *ACLPolicy
+	var blockedPorts *onet.PortBlocklist
+	var clientLimiter *ClientLimiter
+	if opts != nil {
+		if len(opts) > 1 {
+			logger.Errorf(
+				"NewUDPService: at most one UDPServiceOptions argument is allowed")
+		}
+		if opts[0].NumReaders > 0 {
+			numReaders = opts[0].NumReaders
+		}
+		batchIO = opts[0].BatchIO
+		if opts[0].NATFilter != "" {
+			natFilter = opts[0].NATFilter
+		}
+		limits = natLimits{
+			maxEntries:       opts[0].MaxNATEntries,
+			maxEntriesPerKey: opts[0].MaxNATEntriesPerKey,
+			evict:            opts[0].EvictNATEntries,
+		}
+		replayFilter = opts[0].ReplayFilter
+		dnsProxy = opts[0].DNSProxy
+		resolver = opts[0].Resolver
+		ipPreference = opts[0].IPPreference
+		acl = opts[0].ACL
+		blockedPorts = opts[0].BlockedPorts
+		clientLimiter = opts[0].ClientLimiter
+	}
+	return &udpService{natTimeout: natTimeout, done: make(chan struct{}), ciphers: cipherList, m: m, targetIPValidator: onet.RequirePublicIP, numReaders: numReaders, batchIO: batchIO, natFilter: natFilter, natLimits: limits, replayFilter: replayFilter, dnsProxy: dnsProxy, dnsClients: newDNSClients(natTimeout), resolver: resolver, ipPreference: ipPreference, acl: acl, blockedPorts: blockedPorts, clientLimiter: clientLimiter}
 }
 
 // UDPService is a running UDP shadowsocks proxy that can be stopped.
@@ -93,6 +202,11 @@ type UDPService interface {
 	Serve(clientConn net.PacketConn) error
 	// Stop closes the clientConn and prevents further forwarding of packets.
 	Stop() error
+	// Drain stops reading from the clientConn, but keeps relaying the replies
+	// of the existing NAT entries until they expire or Stop is called.
+	Drain() error
+	// ActiveNATEntries returns the number of NAT entries.
+	ActiveNATEntries() int
 	// GracefulStop calls Stop(), and then blocks until all resources have been cleaned up.
 	GracefulStop() error
 }
@@ -110,18 +224,44 @@ func (s *udpService) Serve(clientConn net.PacketConn) error {
 		clientConn.Close()
 		return errors.New("Serve can only be called once")
 	}
-	if s.stopped {
+	if s.stopped || s.draining {
 		s.mu.Unlock()
 		return clientConn.Close()
 	}
+	nm := newNATmap(s.natTimeout, s.m, &s.running)
+	nm.limits = s.natLimits
+	nm.clientLimiter = s.clientLimiter
 	s.clientConn = clientConn
+	s.nm = nm
 	s.running.Add(1)
 	s.mu.Unlock()
 	defer s.running.Done()
 
-	nm := newNATmap(s.natTimeout, s.m, &s.running)
-	defer nm.Close()
-	cipherBuf := make([]byte, serverUDPBufferSize)
+	clientWriter := newPacketWriter(clientConn, s.batchIO)
+	var readers sync.WaitGroup
+	for i := 0; i < s.numReaders; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			clientReader := newPacketReader(clientConn, s.batchIO)
+			defer clientReader.Close()
+			s.readPackets(clientReader, clientWriter, nm)
+		}()
+	}
+	readers.Wait()
+	s.forwarding.Wait()
+	// After Drain, the entries relay the replies until they expire or the
+	// service is stopped.
+	<-s.done
+	nm.Close()
+	return nil
+}
+
+// readPackets forwards the packets from `clientReader` until the service is
+// stopped, and replies through `clientWriter`.  Several readers can share the
+// client socket and `nm`, so that a slow packet, e.g. one waiting for DNS
+// resolution, doesn't stall the others.
+func (s *udpService) readPackets(clientReader packetReader, clientWriter net.PacketConn, nm *natmap) {
 	textBuf := make([]byte, serverUDPBufferSize)
 
 	stopped := false
@@ -135,10 +275,11 @@ func (s *udpService) Serve(clientConn net.PacketConn) error {
 			}()
 
 			// Attempt to read an upstream packet.
-			clientProxyBytes, clientAddr, err := clientConn.ReadFrom(cipherBuf)
+			cipherData, clientAddr, err := clientReader.ReadPacket()
+			clientProxyBytes := len(cipherData)
 			if err != nil {
 				s.mu.RLock()
-				stopped = s.stopped
+				stopped = s.stopped || s.draining
 				s.mu.RUnlock()
 				if stopped {
 					return nil
@@ -151,7 +292,12 @@ func (s *udpService) Serve(clientConn net.PacketConn) error {
 			keyID := ""
 			var proxyTargetBytes int
 			var timeToCipher time.Duration
+			// Set if the packet is forwarded in the background, which reports it.
+			deferred := false
 			defer func() {
+				if deferred {
+					return
+				}
 				status := "OK"
 				if connError != nil {
 					logger.Debugf("UDP Error: %v: %v", connError.Message, connError.Cause)
@@ -168,44 +314,53 @@ func (s *udpService) Serve(clientConn net.PacketConn) error {
 				logger.Debugf("UDP(%v): Outbound packet has %d bytes", clientAddr, clientProxyBytes)
 			}
 
-			cipherData := cipherBuf[:clientProxyBytes]
-			var payload []byte
-			var tgtUDPAddr *net.UDPAddr
+			var textData []byte
+			fwd := &udpForward{nm: nm, clientAddr: clientAddr, clientWriter: clientWriter}
 			targetConn := nm.Get(clientAddr.String())
 			if targetConn == nil {
-				var locErr error
-				clientLocation, locErr = s.m.GetLocation(clientAddr)
-				if locErr != nil {
-					logger.Warningf("Failed location lookup: %v", locErr)
-				}
-				debugUDPAddr(clientAddr, "Got location \"%s\"", clientLocation)
-
-				ip := clientAddr.(*net.UDPAddr).IP
-				var textData []byte
-				var cipher *ss.Cipher
+				// Clients whose queries were answered by the DNS proxy have no NAT
+				// entry, but their key is remembered.
 				unpackStart := time.Now()
-				textData, keyID, cipher, err = findAccessKeyUDP(ip, textBuf, cipherData, s.ciphers)
+				var cipherEntry *CipherEntry
+				textData, cipherEntry, clientLocation = s.dnsClients.unpack(clientAddr.String(), textBuf, cipherData, unpackStart)
 				timeToCipher = time.Now().Sub(unpackStart)
+				if cipherEntry == nil {
+					ip := clientAddr.(*net.UDPAddr).IP
+					if limit := s.clientLimiter.allow(ip); limit != "" {
+						s.m.AddRateLimited("udp", limit, string(RateLimitDrop))
+						return onet.NewConnectionError("ERR_RATE_LIMITED", "Too many packets from new client addresses", nil)
+					}
+					var locErr error
+					clientLocation, locErr = s.m.GetLocation(clientAddr)
+					if locErr != nil {
+						logger.Warningf("Failed location lookup: %v", locErr)
+					}
+					debugUDPAddr(clientAddr, "Got location \"%s\"", clientLocation)
 
-				if err != nil {
-					return onet.NewConnectionError("ERR_CIPHER", "Failed to unpack initial packet", err)
-				}
+					unpackStart = time.Now()
+					textData, cipherEntry, err = findAccessKeyUDP(ip, textBuf, cipherData, s.ciphers)
+					timeToCipher = time.Now().Sub(unpackStart)
 
-				var onetErr *onet.ConnectionError
-				if payload, tgtUDPAddr, onetErr = s.validatePacket(textData); onetErr != nil {
-					return onetErr
+					if err != nil {
+						return onet.NewConnectionError("ERR_CIPHER", "Failed to unpack initial packet", err)
+					}
 				}
-
-				udpConn, err := net.ListenPacket("udp", "")
-				if err != nil {
-					return onet.NewConnectionError("ERR_CREATE_SOCKET", "Failed to create UDP socket", err)
+				keyID = cipherEntry.ID
+				salt := cipherData[:cipherEntry.Cipher.SaltSize()]
+				if onetErr := s.checkReplay(keyID, cipherEntry.SaltGenerator, salt); onetErr != nil {
+					return onetErr
 				}
-				targetConn = nm.Add(clientAddr, clientConn, cipher, udpConn, clientLocation, keyID)
+				fwd.cipherEntry = cipherEntry
+				fwd.cipher, fwd.saltGenerator = cipherEntry.Cipher, cipherEntry.SaltGenerator
+				fwd.policy = s.targetPolicyFor(cipherEntry.IPPreference, cipherEntry.ACL)
 			} else {
 				clientLocation = targetConn.clientLocation
+				if targetConn.keyExpired(time.Now()) {
+					return onet.NewConnectionError("ERR_KEY_EXPIRED", "Access key expired", nil)
+				}
 
 				unpackStart := time.Now()
-				textData, err := ss.Unpack(nil, cipherData, targetConn.cipher)
+				textData, err = ss.Unpack(nil, cipherData, targetConn.cipher)
 				timeToCipher = time.Now().Sub(unpackStart)
 				if err != nil {
 					return onet.NewConnectionError("ERR_CIPHER", "Failed to unpack data from client", err)
@@ -213,20 +368,271 @@ func (s *udpService) Serve(clientConn net.PacketConn) error {
 
 				// The key ID is known with confidence once decryption succeeds.
 				keyID = targetConn.keyID
+				salt := cipherData[:targetConn.cipher.SaltSize()]
+				if onetErr := s.checkReplay(keyID, targetConn.saltGenerator, salt); onetErr != nil {
+					return onetErr
+				}
+				fwd.targetConn = targetConn
+				fwd.cipher, fwd.saltGenerator = targetConn.cipher, targetConn.saltGenerator
+				fwd.policy = s.targetPolicyFor(targetConn.ipPreference, targetConn.acl)
+			}
+			fwd.clientLocation, fwd.keyID = clientLocation, keyID
 
-				var onetErr *onet.ConnectionError
-				if payload, tgtUDPAddr, onetErr = s.validatePacket(textData); onetErr != nil {
+			tgtAddr, payload, onetErr := splitPacket(textData)
+			if onetErr != nil {
+				return onetErr
+			}
+			if s.needsLookup(tgtAddr) {
+				// Resolve the hostname without holding up the next packets.
+				if onetErr := s.forwardAsync(fwd, tgtAddr, payload, clientProxyBytes, timeToCipher); onetErr != nil {
 					return onetErr
 				}
+				deferred = true
+				return nil
+			}
+			proxyTargetBytes, onetErr = s.forward(fwd, tgtAddr, payload)
+			return onetErr
+		}()
+	}
+}
+
+// maxPendingLookups limits the packets of a service waiting for the resolver.
+const maxPendingLookups = 1024
+
+// udpForward holds what is needed to forward a packet from a client.
+type udpForward struct {
+	nm             *natmap
+	clientAddr     net.Addr
+	clientWriter   net.PacketConn
+	clientLocation string
+	keyID          string
+	cipher         *ss.Cipher
+	saltGenerator  ServerSaltGenerator
+	policy         *targetPolicy
+	// The client's NAT entry, or nil if this is its first packet.  Then
+	// cipherEntry is set instead, to create the entry.
+	targetConn  *natconn
+	cipherEntry *CipherEntry
+}
+
+// targetPolicyFor returns the target settings of a key, whose IP preference
+// and ACL may override the service's.
+func (s *udpService) targetPolicyFor(keyPreference IPPreference, keyACL *ACLPolicy) *targetPolicy {
+	policy := &targetPolicy{ipPreference: s.ipPreference, acl: s.acl, blockedPorts: s.blockedPorts, m: s.m}
+	if keyPreference != IPPreferenceNone {
+		policy.ipPreference = keyPreference
+	}
+	if keyACL != nil {
+		policy.acl = keyACL
+	}
+	return policy
+}
+
+// needsLookup reports whether forwarding to `tgtAddr` has to wait for the
+// resolver.
+func (s *udpService) needsLookup(tgtAddr socks.Addr) bool {
+	if s.resolver == nil || tgtAddr[0] != socks.AtypDomainName {
+		return false
+	}
+	host, _, err := net.SplitHostPort(tgtAddr.String())
+	return err == nil && !s.resolver.isCached(host)
+}
+
+// forward sends `payload` to `tgtAddr`, creating the client's NAT entry if
+// needed, and returns the number of bytes sent.
+func (s *udpService) forward(fwd *udpForward, tgtAddr socks.Addr, payload []byte) (int, *onet.ConnectionError) {
+	tgtUDPAddr, onetErr := resolveTarget(tgtAddr, s.resolver, fwd.policy, s.targetIPValidator)
+	if onetErr != nil {
+		return 0, onetErr
+	}
+	if fwd.targetConn != nil && !fwd.targetConn.allowsTarget(tgtUDPAddr, time.Now()) {
+		return 0, onet.NewConnectionError("ERR_KEY_EXPIRED", "Access key expired", nil)
+	}
+	if s.isProxiedDNS(tgtUDPAddr) {
+		// Answer without creating a NAT entry, which needs a socket.
+		if fwd.targetConn == nil {
+			s.dnsClients.add(fwd.clientAddr.String(), fwd.cipherEntry, fwd.clientLocation, time.Now())
+		}
+		s.proxyDNS(payload, fwd.clientAddr, tgtUDPAddr, fwd.clientWriter, fwd.cipher, fwd.saltGenerator, fwd.clientLocation, fwd.keyID)
+		return len(payload), nil
+	}
+
+	targetConn := fwd.targetConn
+	if targetConn == nil {
+		natFilter := s.natFilter
+		if fwd.cipherEntry.NATFilter != "" {
+			natFilter = fwd.cipherEntry.NATFilter
+		}
+		udpConn, err := net.ListenPacket("udp", "")
+		if err != nil {
+			return 0, onet.NewConnectionError("ERR_CREATE_SOCKET", "Failed to create UDP socket", err)
+		}
+		targetConn, err = fwd.nm.Add(fwd.clientAddr, fwd.clientWriter, fwd.cipherEntry, udpConn, fwd.clientLocation, natFilter)
+		if err == errClientLimit {
+			return 0, onet.NewConnectionError("ERR_RATE_LIMITED", "Too many UDP NAT entries for the client", err)
+		} else if err != nil {
+			return 0, onet.NewConnectionError("ERR_NAT_LIMIT", "Too many UDP NAT entries", err)
+		}
+	}
+
+	debugUDPAddr(fwd.clientAddr, "Proxy exit %v", targetConn.LocalAddr())
+	proxyTargetBytes, err := targetConn.WriteTo(payload, tgtUDPAddr) // accept only UDPAddr despite the signature
+	if err != nil {
+		return proxyTargetBytes, onet.NewConnectionError("ERR_WRITE", "Failed to write to target", err)
+	}
+	return proxyTargetBytes, nil
+}
+
+// forwardAsync forwards `payload` in the background, once the hostname of
+// `tgtAddr` is resolved, and then reports the packet's metrics.
+func (s *udpService) forwardAsync(fwd *udpForward, tgtAddr socks.Addr, payload []byte, clientProxyBytes int, timeToCipher time.Duration) *onet.ConnectionError {
+	if atomic.AddInt32(&s.pendingLookups, 1) > maxPendingLookups {
+		atomic.AddInt32(&s.pendingLookups, -1)
+		return onet.NewConnectionError("ERR_RESOLVE_ADDRESS", "Too many packets waiting for the resolver", nil)
+	}
+	// Both are in the reader's buffer, which is reused for the next packet.
+	tgtAddr = append(socks.Addr(nil), tgtAddr...)
+	payload = append([]byte(nil), payload...)
+	s.forwarding.Add(1)
+	go func() {
+		defer s.forwarding.Done()
+		defer atomic.AddInt32(&s.pendingLookups, -1)
+		proxyTargetBytes, connError := s.forward(fwd, tgtAddr, payload)
+		status := "OK"
+		if connError != nil {
+			logger.Debugf("UDP Error: %v: %v", connError.Message, connError.Cause)
+			status = connError.Status
+		}
+		s.m.AddUDPPacketFromClient(fwd.clientLocation, fwd.keyID, status, clientProxyBytes, proxyTargetBytes, timeToCipher)
+	}()
+	return nil
+}
+
+// isProxiedDNS reports whether packets to `tgtAddr` are answered by the DNS proxy.
+func (s *udpService) isProxiedDNS(tgtAddr *net.UDPAddr) bool {
+	return s.dnsProxy != nil && tgtAddr.Port == 53
+}
+
+// maxDNSClients bounds the clients remembered by dnsClients.
+const maxDNSClients = 10_000
+
+// dnsClients remembers the keys of the clients whose queries were answered by
+// the DNS proxy, which don't get NAT entries, so that their next packets don't
+// need trial decryption or count as new clients for the ClientLimiter.
+type dnsClients struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	clients map[string]dnsClient
+}
+
+type dnsClient struct {
+	cipherEntry    *CipherEntry
+	clientLocation string
+	expires        time.Time
+}
+
+func newDNSClients(timeout time.Duration) *dnsClients {
+	return &dnsClients{timeout: timeout, clients: make(map[string]dnsClient)}
+}
+
+// add remembers that the client at `clientAddr` uses `cipherEntry`, until the
+// timeout after `now`.  When full, expired clients are dropped, or an arbitrary
+// one if there are none.
+func (c *dnsClients) add(clientAddr string, cipherEntry *CipherEntry, clientLocation string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.clients[clientAddr]; !ok && len(c.clients) >= maxDNSClients {
+		for addr, client := range c.clients {
+			if !now.Before(client.expires) {
+				delete(c.clients, addr)
+			}
+		}
+		for addr := range c.clients {
+			if len(c.clients) < maxDNSClients {
+				break
 			}
+			delete(c.clients, addr)
+		}
+	}
+	c.clients[clientAddr] = dnsClient{cipherEntry, clientLocation, now.Add(c.timeout)}
+}
 
-			debugUDPAddr(clientAddr, "Proxy exit %v", targetConn.LocalAddr())
-			proxyTargetBytes, err = targetConn.WriteTo(payload, tgtUDPAddr) // accept only UDPAddr despite the signature
+// unpack decrypts the packet `src` from `clientAddr` into `dst` with the key
+// remembered for the client, and returns the plaintext, the key and the
+// client's location.  The key is nil if the client isn't remembered, its key
+// isn't valid at `now`, or the packet doesn't decrypt with it.
+func (c *dnsClients) unpack(clientAddr string, dst, src []byte, now time.Time) ([]byte, *CipherEntry, string) {
+	c.mu.Lock()
+	client, ok := c.clients[clientAddr]
+	if ok && !now.Before(client.expires) {
+		delete(c.clients, clientAddr)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok || !client.cipherEntry.ValidAt(now) {
+		return nil, nil, ""
+	}
+	buf, err := ss.Unpack(dst, src, client.cipherEntry.Cipher)
+	if err != nil {
+		return nil, nil, ""
+	}
+	return buf, client.cipherEntry, client.clientLocation
+}
+
+// proxyDNS answers `query` through the DNS proxy in the background, so that
+// the upstream resolver doesn't stall the reader.  The response appears to
+// come from `tgtAddr`, the resolver that the client chose.
+func (s *udpService) proxyDNS(query []byte, clientAddr net.Addr, tgtAddr *net.UDPAddr, clientConn net.PacketConn,
+	cipher *ss.Cipher, saltGenerator ServerSaltGenerator, clientLocation, keyID string) {
+	// `query` is in the reader's buffer, which is reused for the next packet.
+	query = append([]byte(nil), query...)
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		response, result, err := s.dnsProxy.Query(query)
+		s.m.AddUDPDNSQuery(keyID, result)
+		if err != nil {
+			debugUDPAddr(clientAddr, "DNS query failed: %v", err)
+			return
+		}
+
+		status := "OK"
+		var proxyClientBytes int
+		connError := func() *onet.ConnectionError {
+			lazySlice := udpPool.LazySlice()
+			pkt := lazySlice.Acquire()
+			defer lazySlice.Release()
+			bodyStart := clientBodyStart(cipher)
+			if len(response) > len(pkt)-bodyStart-cipher.TagSize() {
+				return onet.NewConnectionError("ERR_PACK", "DNS response is too large", nil)
+			}
+			copy(pkt[bodyStart:], response)
+			buf, err := packForClient(pkt, len(response), tgtAddr, cipher, saltGenerator)
 			if err != nil {
-				return onet.NewConnectionError("ERR_WRITE", "Failed to write to target", err)
+				return onet.NewConnectionError("ERR_PACK", "Failed to pack data to client", err)
+			}
+			proxyClientBytes, err = clientConn.WriteTo(buf, clientAddr)
+			if err != nil {
+				return onet.NewConnectionError("ERR_WRITE", "Failed to write to client", err)
 			}
 			return nil
 		}()
+		if connError != nil {
+			logger.Debugf("UDP Error: %v: %v", connError.Message, connError.Cause)
+			status = connError.Status
+		}
+		s.m.AddUDPPacketFromTarget(clientLocation, keyID, status, len(response), proxyClientBytes)
+	}()
+}
+
+// checkReplay rejects packets with a salt that the server created, which have
+// been reflected back, and packets with a salt seen recently for the same key.
+func (s *udpService) checkReplay(keyID string, saltGenerator ServerSaltGenerator, salt []byte) *onet.ConnectionError {
+	if saltGenerator.IsServerSalt(salt) {
+		return onet.NewConnectionError("ERR_REPLAY_SERVER", "Server replay detected", nil)
+	}
+	if !s.replayFilter.Add(keyID, salt) {
+		return onet.NewConnectionError("ERR_REPLAY_CLIENT", "Client replay detected", nil)
 	}
 	return nil
 }
@@ -234,34 +640,88 @@ func (s *udpService) Serve(clientConn net.PacketConn) error {
 // Given the decrypted contents of a UDP packet, return
 // the payload and the destination address, or an error if
 // this packet cannot or should not be forwarded.
-func (s *udpService) validatePacket(textData []byte) ([]byte, *net.UDPAddr, *onet.ConnectionError) {
+func validatePacket(textData []byte, resolver *Resolver, policy *targetPolicy, targetIPValidator onet.TargetIPValidator) ([]byte, *net.UDPAddr, *onet.ConnectionError) {
+	tgtAddr, payload, onetErr := splitPacket(textData)
+	if onetErr != nil {
+		return nil, nil, onetErr
+	}
+	tgtUDPAddr, onetErr := resolveTarget(tgtAddr, resolver, policy, targetIPValidator)
+	if onetErr != nil {
+		return nil, nil, onetErr
+	}
+	return payload, tgtUDPAddr, nil
+}
+
+// splitPacket returns the destination address and the payload of the
+// decrypted contents of a UDP packet.
+func splitPacket(textData []byte) (socks.Addr, []byte, *onet.ConnectionError) {
 	tgtAddr := socks.SplitAddr(textData)
 	if tgtAddr == nil {
 		return nil, nil, onet.NewConnectionError("ERR_READ_ADDRESS", "Failed to get target address", nil)
 	}
+	return tgtAddr, textData[len(tgtAddr):], nil
+}
 
-	tgtUDPAddr, err := net.ResolveUDPAddr("udp", tgtAddr.String())
+// resolveTarget returns the address of `tgtAddr`, or an error if packets
+// cannot or should not be sent to it according to `policy` and
+// `targetIPValidator`.  It uses the system resolver if `resolver` is nil.
+func resolveTarget(tgtAddr socks.Addr, resolver *Resolver, policy *targetPolicy, targetIPValidator onet.TargetIPValidator) (*net.UDPAddr, *onet.ConnectionError) {
+	check := policy.check("udp", tgtAddr.String(), targetIPValidator)
+	if err := check.checkHost(); err != nil {
+		return nil, err
+	}
+	var tgtUDPAddr *net.UDPAddr
+	var err error
+	if resolver == nil {
+		tgtUDPAddr, err = net.ResolveUDPAddr("udp", tgtAddr.String())
+	} else {
+		tgtUDPAddr, err = resolver.resolveUDPAddr(tgtAddr.String(), policy.ipPreference)
+	}
 	if err != nil {
-		return nil, nil, onet.NewConnectionError("ERR_RESOLVE_ADDRESS", fmt.Sprintf("Failed to resolve target address %v", tgtAddr), err)
+		return nil, onet.NewConnectionError("ERR_RESOLVE_ADDRESS", fmt.Sprintf("Failed to resolve target address %v", tgtAddr), err)
 	}
-	if err := s.targetIPValidator(tgtUDPAddr.IP); err != nil {
-		return nil, nil, err
+	if err := check.checkIP(tgtUDPAddr.IP); err != nil {
+		return nil, err
 	}
-
-	payload := textData[len(tgtAddr):]
-	return payload, tgtUDPAddr, nil
+	return tgtUDPAddr, nil
 }
 
 func (s *udpService) Stop() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.stopped = true
+	if !s.stopped {
+		s.stopped = true
+		close(s.done)
+	}
 	if s.clientConn == nil {
 		return nil
 	}
 	return s.clientConn.Close()
 }
 
+func (s *udpService) Drain() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+	if s.clientConn == nil {
+		return nil
+	}
+	// Wake up the readers.  The clientConn stays open for the replies.
+	return s.clientConn.SetReadDeadline(time.Now())
+}
+
+func (s *udpService) ActiveNATEntries() int {
+	s.mu.RLock()
+	nm := s.nm
+	s.mu.RUnlock()
+	if nm == nil {
+		return 0
+	}
+	nm.RLock()
+	defer nm.RUnlock()
+	return len(nm.keyConn)
+}
+
 func (s *udpService) GracefulStop() error {
 	err := s.Stop()
 	s.running.Wait()
@@ -275,26 +735,115 @@ func isDNS(addr net.Addr) bool {
 
 type natconn struct {
 	net.PacketConn
-	cipher *ss.Cipher
-	keyID  string
+	cipher        *ss.Cipher
+	keyID         string
+	saltGenerator ServerSaltGenerator
+	// IP preference of the key, or IPPreferenceNone to use the service's.
+	ipPreference IPPreference
+	// ACL policy of the key, or nil to use the service's.
+	acl *ACLPolicy
 	// We store the client location in the NAT map to avoid recomputing it
 	// for every downstream packet in a UDP-based connection.
 	clientLocation string
 	// NAT timeout to apply for non-DNS packets.
 	defaultTimeout time.Duration
+	// Guards readDeadline and filter, since several readers can write through
+	// the same entry.
+	mu sync.Mutex
 	// Current read deadline of PacketConn.  Used to avoid decreasing the
 	// deadline.  Initially zero.
 	readDeadline time.Time
+	// Peers that may reply to the client.
+	filter peerFilter
+	// Set once the entry has been evicted or the table closed, after which the
+	// deadline is no longer extended.
+	expired bool
+	// Unix time in nanoseconds of the last packet from the client.  Accessed
+	// atomically.
+	lastActive int64
+	// Session traffic, for metrics.  The counters are accessed atomically, and
+	// sentNonDNS is guarded by mu.
+	created           time.Time
+	packetsToTarget   int64
+	bytesToTarget     int64
+	packetsFromTarget int64
+	bytesFromTarget   int64
+	sentNonDNS        bool
 	// If the connection has only sent one DNS query, it will close
 	// if it receives a DNS response.
 	fastClose sync.Once
+	// Releases the entry's slot in the client limits once it's removed.
+	release func()
+	// When the entry must be closed because its key expires, or zero.
+	closeTime time.Time
+	// When the key expires, or zero.  After that, the client can only send to
+	// `targets`, which records the destinations of keys that expire, up to the
+	// maxPeers most recently used.  Guarded by mu.
+	notAfter time.Time
+	targets  peerFilter
+	// Set if the entry lives as long as its owner, e.g. a UDP-over-TCP
+	// connection, instead of expiring after the NAT timeout.
+	persistent bool
+}
+
+// newNATconn returns an entry that relays the packets of a client with the key
+// of `cipherEntry` through `pc`.  `filter` decides which peers can reply.
+func newNATconn(pc net.PacketConn, cipherEntry *CipherEntry, clientLocation string, filter NATFilter, timeout time.Duration) *natconn {
+	entry := &natconn{
+		PacketConn:     pc,
+		cipher:         cipherEntry.Cipher,
+		keyID:          cipherEntry.ID,
+		saltGenerator:  cipherEntry.SaltGenerator,
+		ipPreference:   cipherEntry.IPPreference,
+		acl:            cipherEntry.ACL,
+		closeTime:      cipherEntry.closeTime(),
+		notAfter:       cipherEntry.NotAfter,
+		clientLocation: clientLocation,
+		defaultTimeout: timeout,
+		filter:         newPeerFilter(filter, peerTimeout),
+		lastActive:     time.Now().UnixNano(),
+		created:        time.Now(),
+	}
+	if !cipherEntry.NotAfter.IsZero() {
+		entry.targets = newPeerFilter(NATFilterAddressAndPortDependent, 0)
+	}
+	return entry
+}
+
+// keyExpired reports whether the entry must be closed at `now` because its key
+// has expired.
+func (c *natconn) keyExpired(now time.Time) bool {
+	return !c.closeTime.IsZero() && !now.Before(c.closeTime)
+}
+
+// allowsTarget reports whether the client may send to `addr` at `now`.  Once
+// the key has expired, only the recent targets it sent to before are allowed.
+func (c *natconn) allowsTarget(addr net.Addr, now time.Time) bool {
+	if c.notAfter.IsZero() || now.Before(c.notAfter) {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.targets.allows(addr, now)
 }
 
 func (c *natconn) onWrite(addr net.Addr) {
 	// Fast close is only allowed if there has been exactly one write,
 	// and it was a DNS query.
 	isDNS := isDNS(addr)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.filter.addPeer(addr, now)
+	c.targets.addPeer(addr, now)
+	atomic.StoreInt64(&c.lastActive, now.UnixNano())
 	isFirstWrite := c.readDeadline.IsZero()
+	if !isDNS {
+		c.sentNonDNS = true
+	}
+	if c.persistent {
+		return
+	}
 	if !isDNS || !isFirstWrite {
 		// Disable fast close.  (Idempotent.)
 		c.fastClose.Do(func() {})
@@ -307,13 +856,16 @@ func (c *natconn) onWrite(addr net.Addr) {
 	}
 
 	newDeadline := time.Now().Add(timeout)
-	if newDeadline.After(c.readDeadline) {
+	if !c.expired && newDeadline.After(c.readDeadline) {
 		c.readDeadline = newDeadline
 		c.SetReadDeadline(newDeadline)
 	}
 }
 
 func (c *natconn) onRead(addr net.Addr) {
+	if c.persistent {
+		return
+	}
 	c.fastClose.Do(func() {
 		if isDNS(addr) {
 			// The next ReadFrom() should time out immediately.
@@ -324,29 +876,100 @@ func (c *natconn) onRead(addr net.Addr) {
 
 func (c *natconn) WriteTo(buf []byte, dst net.Addr) (int, error) {
 	c.onWrite(dst)
-	return c.PacketConn.WriteTo(buf, dst)
+	n, err := c.PacketConn.WriteTo(buf, dst)
+	if err == nil {
+		atomic.AddInt64(&c.packetsToTarget, 1)
+		atomic.AddInt64(&c.bytesToTarget, int64(n))
+	}
+	return n, err
+}
+
+// onDelivered counts a packet of `n` bytes from a target that was relayed to
+// the client.
+func (c *natconn) onDelivered(n int) {
+	atomic.AddInt64(&c.packetsFromTarget, 1)
+	atomic.AddInt64(&c.bytesFromTarget, int64(n))
+}
+
+// sessionMetrics returns the traffic relayed so far.
+func (c *natconn) sessionMetrics() metrics.UDPSessionMetrics {
+	c.mu.Lock()
+	sentNonDNS := c.sentNonDNS
+	c.mu.Unlock()
+	data := metrics.UDPSessionMetrics{
+		PacketsToTarget:   atomic.LoadInt64(&c.packetsToTarget),
+		BytesToTarget:     atomic.LoadInt64(&c.bytesToTarget),
+		PacketsFromTarget: atomic.LoadInt64(&c.packetsFromTarget),
+		BytesFromTarget:   atomic.LoadInt64(&c.bytesFromTarget),
+	}
+	data.DNSOnly = data.PacketsToTarget > 0 && !sentNonDNS
+	return data
+}
+
+// expire makes the pending and future reads time out, so that timedCopy
+// removes the entry.
+func (c *natconn) expire() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expired = true
+	return c.SetReadDeadline(time.Now())
+}
+
+// errNATFiltered is returned by natconn.ReadFrom for packets from peers that
+// the filter doesn't allow.
+var errNATFiltered = errors.New("packet from a peer that the client hasn't sent to")
+
+func (c *natconn) allows(addr net.Addr) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.filter.allows(addr, time.Now())
 }
 
 func (c *natconn) ReadFrom(buf []byte) (int, net.Addr, error) {
 	n, addr, err := c.PacketConn.ReadFrom(buf)
 	if err == nil {
+		if !c.allows(addr) {
+			return n, addr, errNATFiltered
+		}
 		c.onRead(addr)
 	}
 	return n, addr, err
 }
 
+// natLimits bounds the size of a NAT table.  Zero means no limit.
+type natLimits struct {
+	maxEntries       int
+	maxEntriesPerKey int
+	// evict makes room for new entries by evicting the least recently active
+	// entry, instead of rejecting the new ones.
+	evict bool
+}
+
+// errNATLimit is returned by natmap.Add when a limit has been reached and
+// eviction is disabled.
+var errNATLimit = errors.New("NAT table limit reached")
+
+// errClientLimit is returned by natmap.Add when the client has too many
+// entries for its IP address or subnet.
+var errClientLimit = errors.New("client connection limit reached")
+
 // Packet NAT table
 type natmap struct {
 	sync.RWMutex
-	keyConn map[string]*natconn
-	timeout time.Duration
-	metrics metrics.ShadowsocksMetrics
-	running *sync.WaitGroup
+	keyConn    map[string]*natconn
+	keyEntries map[string]int // Number of entries per access key ID.
+	limits     natLimits
+	// Limits the entries of each client IP address and subnet, or nil.
+	clientLimiter *ClientLimiter
+	timeout       time.Duration
+	metrics       metrics.ShadowsocksMetrics
+	running       *sync.WaitGroup
 }
 
 func newNATmap(timeout time.Duration, sm metrics.ShadowsocksMetrics, running *sync.WaitGroup) *natmap {
 	m := &natmap{metrics: sm, running: running}
 	m.keyConn = make(map[string]*natconn)
+	m.keyEntries = make(map[string]int)
 	m.timeout = timeout
 	return m
 }
@@ -357,48 +980,136 @@ func (m *natmap) Get(key string) *natconn {
 	return m.keyConn[key]
 }
 
-func (m *natmap) set(key string, pc net.PacketConn, cipher *ss.Cipher, keyID, clientLocation string) *natconn {
-	entry := &natconn{
-		PacketConn:     pc,
-		cipher:         cipher,
-		keyID:          keyID,
-		clientLocation: clientLocation,
-		defaultTimeout: m.timeout,
-	}
+// set adds an entry for `key`, unless there is one already.  It returns the
+// entry for `key`, and whether it was added, or errNATLimit if there's no room,
+// or errClientLimit if the client has too many entries.
+func (m *natmap) set(key string, clientIP net.IP, pc net.PacketConn, cipherEntry *CipherEntry, clientLocation string, filter NATFilter) (*natconn, bool, error) {
+	keyID := cipherEntry.ID
+	entry := newNATconn(pc, cipherEntry, clientLocation, filter, m.timeout)
 
 	m.Lock()
 	defer m.Unlock()
 
+	if existing, ok := m.keyConn[key]; ok {
+		return existing, false, nil
+	}
+	release, limit := m.clientLimiter.acquire(clientIP)
+	if limit != "" {
+		m.metrics.AddRateLimited("udp", limit, string(RateLimitDrop))
+		return nil, false, errClientLimit
+	}
+	if err := m.makeRoom(keyID, m.keyLimit(cipherEntry)); err != nil {
+		release()
+		return nil, false, err
+	}
+	entry.release = release
 	m.keyConn[key] = entry
-	return entry
+	m.keyEntries[keyID]++
+	return entry, true, nil
 }
 
-func (m *natmap) del(key string) net.PacketConn {
+// keyLimit returns the maximum number of entries for `cipherEntry`'s key.  Zero
+// or negative means no limit.
+func (m *natmap) keyLimit(cipherEntry *CipherEntry) int {
+	if cipherEntry.MaxNATEntries != 0 {
+		return cipherEntry.MaxNATEntries
+	}
+	return m.limits.maxEntriesPerKey
+}
+
+// makeRoom ensures that an entry for `keyID`, which can have up to `keyLimit`
+// entries, fits within the limits, evicting entries if allowed.  It must be
+// called with the lock held.
+func (m *natmap) makeRoom(keyID string, keyLimit int) error {
+	if keyLimit > 0 && m.keyEntries[keyID] >= keyLimit {
+		if !m.limits.evict {
+			return errNATLimit
+		}
+		m.evictOldest(func(entry *natconn) bool { return entry.keyID == keyID })
+	}
+	if m.limits.maxEntries > 0 && len(m.keyConn) >= m.limits.maxEntries {
+		if !m.limits.evict {
+			return errNATLimit
+		}
+		m.evictOldest(func(*natconn) bool { return true })
+	}
+	return nil
+}
+
+// evictOldest removes the least recently active of the entries that match,
+// and expires it.  It scans the whole table, so it must only be called when
+// the table is full.  It must be called with the lock held.
+func (m *natmap) evictOldest(match func(*natconn) bool) {
+	var oldestKey string
+	var oldest *natconn
+	for key, entry := range m.keyConn {
+		if match(entry) && (oldest == nil || atomic.LoadInt64(&entry.lastActive) < atomic.LoadInt64(&oldest.lastActive)) {
+			oldestKey, oldest = key, entry
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	logger.Debugf("UDP(%v): Evicting NAT entry", oldestKey)
+	m.remove(oldestKey, oldest)
+	oldest.expire()
+}
+
+// remove deletes the entry for `key`, which must be `entry`.  It must be called
+// with the lock held.
+func (m *natmap) remove(key string, entry *natconn) {
+	delete(m.keyConn, key)
+	if m.keyEntries[entry.keyID]--; m.keyEntries[entry.keyID] <= 0 {
+		delete(m.keyEntries, entry.keyID)
+	}
+}
+
+// del removes `entry` from the map, if it is still the entry for `key`.
+func (m *natmap) del(key string, entry *natconn) {
 	m.Lock()
 	defer m.Unlock()
 
-	entry, ok := m.keyConn[key]
-	if ok {
-		delete(m.keyConn, key)
-		return entry
+	if m.keyConn[key] == entry {
+		m.remove(key, entry)
 	}
-	return nil
 }
 
-func (m *natmap) Add(clientAddr net.Addr, clientConn net.PacketConn, cipher *ss.Cipher, targetConn net.PacketConn, clientLocation, keyID string) *natconn {
-	entry := m.set(clientAddr.String(), targetConn, cipher, keyID, clientLocation)
+// Add starts relaying the packets from `targetConn` that `filter` allows back to
+// the client.  If another reader has added an entry for `clientAddr` in the
+// meantime, Add closes `targetConn` and returns the existing entry instead.
+// If the table is full, Add closes `targetConn` and returns errNATLimit, or
+// errClientLimit if the client has too many entries.
+func (m *natmap) Add(clientAddr net.Addr, clientConn net.PacketConn, cipherEntry *CipherEntry, targetConn net.PacketConn, clientLocation string, filter NATFilter) (*natconn, error) {
+	keyID := cipherEntry.ID
+	var clientIP net.IP
+	if udpAddr, ok := clientAddr.(*net.UDPAddr); ok {
+		clientIP = udpAddr.IP
+	}
+	entry, added, err := m.set(clientAddr.String(), clientIP, targetConn, cipherEntry, clientLocation, filter)
+	if !added {
+		targetConn.Close()
+		return entry, err
+	}
 
-	m.metrics.AddUDPNatEntry()
+	m.metrics.AddUDPNatEntry(keyID)
+	var expiryTimer *time.Timer
+	if !entry.closeTime.IsZero() {
+		expiryTimer = time.AfterFunc(time.Until(entry.closeTime), func() { entry.expire() })
+	}
 	m.running.Add(1)
 	go func() {
 		timedCopy(clientAddr, clientConn, entry, keyID, m.metrics)
-		m.metrics.RemoveUDPNatEntry()
-		if pc := m.del(clientAddr.String()); pc != nil {
-			pc.Close()
+		if expiryTimer != nil {
+			expiryTimer.Stop()
 		}
+		m.metrics.RemoveUDPNatEntry(keyID)
+		m.del(clientAddr.String(), entry)
+		entry.Close()
+		entry.release()
+		m.metrics.AddClosedUDPSession(entry.clientLocation, keyID, entry.sessionMetrics(), time.Since(entry.created))
 		m.running.Done()
 	}()
-	return entry
+	return entry, nil
 }
 
 func (m *natmap) Close() error {
@@ -406,9 +1117,8 @@ func (m *natmap) Close() error {
 	defer m.Unlock()
 
 	var err error
-	now := time.Now()
-	for _, pc := range m.keyConn {
-		if e := pc.SetReadDeadline(now); e != nil {
+	for _, entry := range m.keyConn {
+		if e := entry.expire(); e != nil {
 			err = e
 		}
 	}
@@ -419,17 +1129,49 @@ func (m *natmap) Close() error {
 // and serializing an IPv6 address from the example range.
 var maxAddrLen int = len(socks.ParseAddr("[2001:db8::1]:12345"))
 
+// clientBodyStart returns where the body of a packet to the client starts in
+// the buffer passed to packForClient.  It leaves enough room at the beginning
+// of the packet for the salt and a max-length header (i.e. IPv6).
+func clientBodyStart(cipher *ss.Cipher) int {
+	return cipher.SaltSize() + maxAddrLen
+}
+
+// packForClient encrypts in place the body of a packet from `srcAddr` to the
+// client, which occupies `bodyLen` bytes of `pkt` after clientBodyStart().  It
+// returns the encrypted packet, a subslice of `pkt`.
+func packForClient(pkt []byte, bodyLen int, srcAddr net.Addr, cipher *ss.Cipher, saltGenerator ServerSaltGenerator) ([]byte, error) {
+	bodyStart := clientBodyStart(cipher)
+	socksAddr := socks.ParseAddr(srcAddr.String())
+	addrStart := bodyStart - len(socksAddr)
+	// `plainTextBuf` concatenates the SOCKS address and body:
+	// [padding?][salt][address][body][tag][unused]
+	// |-- addrStart -|[plaintextBuf ]
+	plaintextBuf := pkt[addrStart : bodyStart+bodyLen]
+	copy(plaintextBuf, socksAddr)
+
+	// saltStart is 0 if srcAddr is IPv6.
+	saltStart := addrStart - cipher.SaltSize()
+	// `packBuf` adds space for the salt and tag.
+	// `buf` shows the space that was used.
+	// [padding?][salt][address][body][tag][unused]
+	//           [            packBuf             ]
+	//           [          buf           ]
+	packBuf := pkt[saltStart:]
+	// Encrypt in-place, marking the salt so that the packet can't be reflected back.
+	return ss.PackWithSaltGenerator(packBuf, plaintextBuf, cipher, saltGenerator)
+}
+
 // copy from target to client until read timeout
 func timedCopy(clientAddr net.Addr, clientConn net.PacketConn, targetConn *natconn,
 	keyID string, sm metrics.ShadowsocksMetrics) {
 	// pkt is used for in-place encryption of downstream UDP packets, with the layout
 	// [padding?][salt][address][body][tag][extra]
 	// Padding is only used if the address is IPv4.
-	pkt := make([]byte, serverUDPBufferSize)
+	lazySlice := udpPool.LazySlice()
+	pkt := lazySlice.Acquire()
+	defer lazySlice.Release()
 
-	saltSize := targetConn.cipher.SaltSize()
-	// Leave enough room at the beginning of the packet for a max-length header (i.e. IPv6).
-	bodyStart := saltSize + maxAddrLen
+	bodyStart := clientBodyStart(targetConn.cipher)
 
 	expired := false
 	for {
@@ -444,6 +1186,10 @@ func timedCopy(clientAddr net.Addr, clientConn net.PacketConn, targetConn *natco
 			// |--     bodyStart     --|[      readBuf    ]
 			readBuf := pkt[bodyStart:]
 			bodyLen, raddr, err = targetConn.ReadFrom(readBuf)
+			if err == errNATFiltered {
+				debugUDPAddr(clientAddr, "Filtered response from %v", raddr)
+				return onet.NewConnectionError("ERR_NAT_FILTERED", "Dropped packet from unexpected peer", nil)
+			}
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok {
 					if netErr.Timeout() {
@@ -455,23 +1201,7 @@ func timedCopy(clientAddr net.Addr, clientConn net.PacketConn, targetConn *natco
 			}
 
 			debugUDPAddr(clientAddr, "Got response from %v", raddr)
-			srcAddr := socks.ParseAddr(raddr.String())
-			addrStart := bodyStart - len(srcAddr)
-			// `plainTextBuf` concatenates the SOCKS address and body:
-			// [padding?][salt][address][body][tag][unused]
-			// |-- addrStart -|[plaintextBuf ]
-			plaintextBuf := pkt[addrStart : bodyStart+bodyLen]
-			copy(plaintextBuf, srcAddr)
-
-			// saltStart is 0 if raddr is IPv6.
-			saltStart := addrStart - saltSize
-			// `packBuf` adds space for the salt and tag.
-			// `buf` shows the space that was used.
-			// [padding?][salt][address][body][tag][unused]
-			//           [            packBuf             ]
-			//           [          buf           ]
-			packBuf := pkt[saltStart:]
-			buf, err := ss.Pack(packBuf, plaintextBuf, targetConn.cipher) // Encrypt in-place
+			buf, err := packForClient(pkt, bodyLen, raddr, targetConn.cipher, targetConn.saltGenerator)
 			if err != nil {
 				return onet.NewConnectionError("ERR_PACK", "Failed to pack data to client", err)
 			}
@@ -479,6 +1209,7 @@ func timedCopy(clientAddr net.Addr, clientConn net.PacketConn, targetConn *natco
 			if err != nil {
 				return onet.NewConnectionError("ERR_WRITE", "Failed to write to client", err)
 			}
+			targetConn.onDelivered(bodyLen)
 			return nil
 		}()
 		status := "OK"
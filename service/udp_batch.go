@@ -0,0 +1,59 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+
+	"github.com/Jigsaw-Code/outline-ss-server/slicepool"
+)
+
+// udpBatchSize is the largest number of datagrams read or written in a single
+// system call when batching is enabled.
+const udpBatchSize = 16
+
+// udpPool stores the byte slices that client datagrams are read into.
+var udpPool = slicepool.MakePool(serverUDPBufferSize)
+
+// packetReader reads datagrams from the client socket.
+type packetReader interface {
+	// ReadPacket returns the next datagram and its source.  The datagram is only
+	// valid until the next call.
+	ReadPacket() ([]byte, net.Addr, error)
+	// Close releases the buffers.  It doesn't close the socket.
+	Close()
+}
+
+// simplePacketReader reads one datagram per system call.
+type simplePacketReader struct {
+	conn net.PacketConn
+	buf  slicepool.LazySlice
+	data []byte
+}
+
+func newSimplePacketReader(conn net.PacketConn) *simplePacketReader {
+	r := &simplePacketReader{conn: conn, buf: udpPool.LazySlice()}
+	r.data = r.buf.Acquire()
+	return r
+}
+
+func (r *simplePacketReader) ReadPacket() ([]byte, net.Addr, error) {
+	n, addr, err := r.conn.ReadFrom(r.data)
+	return r.data[:n], addr, err
+}
+
+func (r *simplePacketReader) Close() {
+	r.buf.Release()
+}
@@ -0,0 +1,205 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/Jigsaw-Code/outline-ss-server/slicepool"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// batchConn reads and writes several datagrams per system call.  The messages
+// of the ipv4 and ipv6 packages are the same type, so both implement it.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// newBatchConn returns a batchConn for `conn`, from the package that matches
+// its address family.  Dual-stack IPv6 sockets also take IPv4 addresses.
+func newBatchConn(conn *net.UDPConn) batchConn {
+	if socketDomain(conn) == unix.AF_INET6 {
+		return ipv6.NewPacketConn(conn)
+	}
+	return ipv4.NewPacketConn(conn)
+}
+
+// socketDomain returns the address family of `conn`, or 0 if it is unknown.
+func socketDomain(conn *net.UDPConn) int {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	domain := 0
+	rawConn.Control(func(fd uintptr) {
+		domain, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+	})
+	if err != nil {
+		return 0
+	}
+	return domain
+}
+
+// newPacketReader returns a reader for `conn`.  If `batch` is set and `conn`
+// is a UDP socket, the reader uses recvmmsg to read up to udpBatchSize
+// datagrams per system call.
+func newPacketReader(conn net.PacketConn, batch bool) packetReader {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !batch || !ok {
+		return newSimplePacketReader(conn)
+	}
+	r := &batchPacketReader{
+		conn: newBatchConn(udpConn),
+		msgs: make([]ipv4.Message, udpBatchSize),
+		bufs: make([]slicepool.LazySlice, udpBatchSize),
+	}
+	for i := range r.msgs {
+		r.bufs[i] = udpPool.LazySlice()
+		r.msgs[i].Buffers = [][]byte{r.bufs[i].Acquire()}
+	}
+	return r
+}
+
+type batchPacketReader struct {
+	conn batchConn
+	msgs []ipv4.Message
+	bufs []slicepool.LazySlice
+	// msgs[next:count] have been read but not returned yet.
+	next, count int
+}
+
+func (r *batchPacketReader) ReadPacket() ([]byte, net.Addr, error) {
+	for r.next == r.count {
+		n, err := r.conn.ReadBatch(r.msgs, 0)
+		if err != nil {
+			r.next, r.count = 0, 0
+			return nil, nil, err
+		}
+		r.next, r.count = 0, n
+	}
+	msg := &r.msgs[r.next]
+	r.next++
+	return msg.Buffers[0][:msg.N], msg.Addr, nil
+}
+
+func (r *batchPacketReader) Close() {
+	for i := range r.bufs {
+		r.bufs[i].Release()
+	}
+}
+
+// newPacketWriter returns a view of `conn` for writing to clients.  If `batch`
+// is set and `conn` is a UDP socket, concurrent writes are combined and sent
+// with sendmmsg.
+func newPacketWriter(conn net.PacketConn, batch bool) net.PacketConn {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !batch || !ok {
+		return conn
+	}
+	return &batchPacketWriter{
+		PacketConn: conn,
+		conn:       newBatchConn(udpConn),
+		msgs:       make([]ipv4.Message, 0, udpBatchSize),
+	}
+}
+
+// batchPacketWriter sends the datagrams that are written while another write
+// is in progress together, in one system call.  One writer at a time flushes
+// the pending datagrams, and hands over to a waiting writer when it is done, so
+// a single caller doesn't end up sending everyone's datagrams indefinitely.
+type batchPacketWriter struct {
+	net.PacketConn
+	conn     batchConn
+	mu       sync.Mutex
+	pending  []*pendingWrite
+	flushing bool
+	msgs     []ipv4.Message // Only used by the flushing writer.
+}
+
+type pendingWrite struct {
+	msg ipv4.Message
+	err error
+	// Receives false once the datagram has been sent, or true if the writer
+	// must flush the pending datagrams, including its own.
+	done chan bool
+}
+
+func (w *batchPacketWriter) WriteTo(b []byte, addr net.Addr) (int, error) {
+	p := &pendingWrite{
+		msg:  ipv4.Message{Buffers: [][]byte{b}, Addr: addr},
+		done: make(chan bool, 1),
+	}
+	w.mu.Lock()
+	w.pending = append(w.pending, p)
+	flush := !w.flushing
+	w.flushing = true
+	w.mu.Unlock()
+
+	if !flush {
+		flush = <-p.done
+	}
+	if flush {
+		w.flush()
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+	return len(b), nil
+}
+
+// flush sends the pending datagrams, and then hands over to the next writer.
+func (w *batchPacketWriter) flush() {
+	w.mu.Lock()
+	batch := w.pending
+	w.pending = nil
+	w.mu.Unlock()
+
+	for len(batch) > 0 {
+		chunk := batch
+		if len(chunk) > udpBatchSize {
+			chunk = chunk[:udpBatchSize]
+		}
+		w.msgs = w.msgs[:0]
+		for _, p := range chunk {
+			w.msgs = append(w.msgs, p.msg)
+		}
+		n, err := w.conn.WriteBatch(w.msgs, 0)
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		if err != nil && n < len(chunk) {
+			// The datagram after the last one sent failed.  Skip it.
+			chunk[n].err = err
+			n++
+		}
+		for _, p := range chunk[:n] {
+			p.done <- false
+		}
+		batch = batch[n:]
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) > 0 {
+		w.pending[0].done <- true
+	} else {
+		w.flushing = false
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func listenLocalUDP(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	return conn
+}
+
+func TestBatchPacketReader(t *testing.T) {
+	serverConn := listenLocalUDP(t)
+	defer serverConn.Close()
+	senderConn := listenLocalUDP(t)
+	defer senderConn.Close()
+
+	reader := newPacketReader(serverConn, true)
+	defer reader.Close()
+	_, ok := reader.(*batchPacketReader)
+	require.True(t, ok, "Expected a batch reader")
+
+	// Queue more datagrams than fit in one batch.
+	const numPackets = udpBatchSize + 3
+	for i := 0; i < numPackets; i++ {
+		_, err := senderConn.WriteTo([]byte(fmt.Sprintf("packet %d", i)), serverConn.LocalAddr())
+		require.NoError(t, err)
+	}
+	serverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < numPackets; i++ {
+		data, addr, err := reader.ReadPacket()
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("packet %d", i), string(data))
+		require.Equal(t, senderConn.LocalAddr().String(), addr.String())
+	}
+}
+
+func TestBatchPacketWriter(t *testing.T) {
+	serverConn := listenLocalUDP(t)
+	defer serverConn.Close()
+	receiverConn := listenLocalUDP(t)
+	defer receiverConn.Close()
+
+	writer := newPacketWriter(serverConn, true)
+	_, ok := writer.(*batchPacketWriter)
+	require.True(t, ok, "Expected a batch writer")
+
+	const numWriters = 8
+	const numPackets = 20
+	var wg sync.WaitGroup
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < numPackets; j++ {
+				payload := []byte(fmt.Sprintf("writer %d packet %d", i, j))
+				n, err := writer.WriteTo(payload, receiverConn.LocalAddr())
+				if err != nil || n != len(payload) {
+					t.Errorf("WriteTo failed: %d, %v", n, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	received := make(map[string]bool)
+	buf := make([]byte, 100)
+	receiverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(received) < numWriters*numPackets {
+		n, addr, err := receiverConn.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, serverConn.LocalAddr().String(), addr.String())
+		received[string(buf[:n])] = true
+	}
+}
+
+func TestBatchPacketWriterDualStack(t *testing.T) {
+	// Like the server's sockets, which are IPv6 and also take IPv4 clients.
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: 0})
+	require.NoError(t, err)
+	defer serverConn.Close()
+	if socketDomain(serverConn) != unix.AF_INET6 {
+		t.Skip("IPv6 is not available")
+	}
+	serverPort := serverConn.LocalAddr().(*net.UDPAddr).Port
+	writer := newPacketWriter(serverConn, true)
+	_, ok := writer.(*batchPacketWriter)
+	require.True(t, ok, "Expected a batch writer")
+	reader := newPacketReader(serverConn, true)
+	defer reader.Close()
+
+	receivers := []*net.UDPConn{listenLocalUDP(t)}
+	if ipv6Conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback}); err == nil {
+		receivers = append(receivers, ipv6Conn)
+	}
+	for _, receiverConn := range receivers {
+		defer receiverConn.Close()
+		// Reply to the address that the batch reader returns, as the server does.
+		serverIP := receiverConn.LocalAddr().(*net.UDPAddr).IP
+		_, err := receiverConn.WriteTo([]byte("request"), &net.UDPAddr{IP: serverIP, Port: serverPort})
+		require.NoError(t, err)
+		serverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, clientAddr, err := reader.ReadPacket()
+		require.NoError(t, err)
+		_, err = writer.WriteTo([]byte("response"), clientAddr)
+		require.NoError(t, err, "Failed to write to %v", clientAddr)
+
+		buf := make([]byte, 100)
+		receiverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := receiverConn.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, "response", string(buf[:n]))
+	}
+}
+
+func TestPacketReaderNoBatch(t *testing.T) {
+	conn := listenLocalUDP(t)
+	defer conn.Close()
+	reader := newPacketReader(conn, false)
+	defer reader.Close()
+	_, ok := reader.(*simplePacketReader)
+	require.True(t, ok, "Expected a simple reader")
+	require.Equal(t, net.PacketConn(conn), newPacketWriter(conn, false))
+}
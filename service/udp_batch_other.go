@@ -0,0 +1,31 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package service
+
+import "net"
+
+// newPacketReader returns a reader for `conn`.  Batching is only supported on
+// Linux, so `batch` is ignored.
+func newPacketReader(conn net.PacketConn, batch bool) packetReader {
+	return newSimplePacketReader(conn)
+}
+
+// newPacketWriter returns `conn`.  Batching is only supported on Linux, so
+// `batch` is ignored.
+func newPacketWriter(conn net.PacketConn, batch bool) net.PacketConn {
+	return conn
+}
@@ -0,0 +1,137 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io"
+	"net"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// maxUDPOverTCPFrameSize is the size of the largest UDP-over-TCP frame.
+const maxUDPOverTCPFrameSize = ss.UDPOverTCPFrameHeaderSize + 0xffff
+
+// handleUDPOverTCP relays the datagrams framed in the decrypted client stream
+// (see ss.UDPOverTCPTargetAddr) through a single UDP socket.  The TCP connection
+// takes the place of the client address of a NAT entry: the entry lives until
+// the client closes the connection, so the NAT timeout and entry limits don't
+// apply, but the NAT filter, the key validity and the UDP metrics do, as in
+// udpService.  Rejected datagrams are dropped without closing the connection.
+func (s *tcpService) handleUDPOverTCP(clientReader io.Reader, clientWriter io.Writer, clientTCPConn onet.TCPConn, cipherEntry *CipherEntry, clientLocation string, policy *targetPolicy, proxyMetrics *metrics.ProxyMetrics) *onet.ConnectionError {
+	udpConn, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return onet.NewConnectionError("ERR_CREATE_SOCKET", "Failed to create UDP socket", err)
+	}
+	natFilter := s.natFilter
+	if cipherEntry.NATFilter != "" {
+		natFilter = cipherEntry.NATFilter
+	}
+	targetConn := newNATconn(udpConn, cipherEntry, clientLocation, natFilter, 0)
+	targetConn.persistent = true
+	keyID := cipherEntry.ID
+	s.m.AddUDPNatEntry(keyID)
+
+	fromTargetDone := make(chan struct{})
+	go func() {
+		defer close(fromTargetDone)
+		proxyMetrics.TargetProxy += copyUDPOverTCPFromTarget(clientWriter, targetConn, s.m)
+	}()
+
+	var connError *onet.ConnectionError
+	buf := make([]byte, maxUDPOverTCPFrameSize)
+	for {
+		textData, err := ss.ReadUDPOverTCPFrame(clientReader, buf)
+		if err != nil {
+			if err != io.EOF {
+				connError = onet.NewConnectionError("ERR_RELAY_CLIENT", "Failed to relay traffic from client", err)
+			}
+			break
+		}
+		proxyTargetBytes, onetErr := s.forwardUDPOverTCP(targetConn, textData, policy)
+		proxyMetrics.ProxyTarget += int64(proxyTargetBytes)
+		status := "OK"
+		if onetErr != nil {
+			debugUDPAddr(clientTCPConn.RemoteAddr(), "Dropped datagram: %v", onetErr.Message)
+			status = onetErr.Status
+		}
+		s.m.AddUDPPacketFromClient(clientLocation, keyID, status, len(textData), proxyTargetBytes, 0)
+	}
+	targetConn.Close()
+	<-fromTargetDone
+	s.m.RemoveUDPNatEntry(keyID)
+	s.m.AddClosedUDPSession(clientLocation, keyID, targetConn.sessionMetrics(), time.Since(targetConn.created))
+	return connError
+}
+
+// forwardUDPOverTCP sends the datagram `textData`, which starts with the target
+// address, through `targetConn`, and returns the number of bytes sent.
+func (s *tcpService) forwardUDPOverTCP(targetConn *natconn, textData []byte, policy *targetPolicy) (int, *onet.ConnectionError) {
+	payload, tgtUDPAddr, onetErr := validatePacket(textData, s.resolver, policy, s.targetIPValidator)
+	if onetErr != nil {
+		return 0, onetErr
+	}
+	if !targetConn.allowsTarget(tgtUDPAddr, time.Now()) {
+		return 0, onet.NewConnectionError("ERR_KEY_EXPIRED", "Access key expired", nil)
+	}
+	proxyTargetBytes, err := targetConn.WriteTo(payload, tgtUDPAddr)
+	if err != nil {
+		return proxyTargetBytes, onet.NewConnectionError("ERR_WRITE", "Failed to write to target", err)
+	}
+	return proxyTargetBytes, nil
+}
+
+// copyUDPOverTCPFromTarget frames the datagrams received on `targetConn` and
+// writes them to `clientWriter` until `targetConn` is closed.  It returns the
+// number of payload bytes received from targets.
+func copyUDPOverTCPFromTarget(clientWriter io.Writer, targetConn *natconn, sm metrics.ShadowsocksMetrics) int64 {
+	// `pkt` holds one frame, leaving enough room for a max-length address
+	// (i.e. IPv6) before the body:
+	// [padding?][header][address][body]
+	pkt := make([]byte, maxUDPOverTCPFrameSize)
+	bodyStart := ss.UDPOverTCPFrameHeaderSize + maxAddrLen
+	var targetProxyBytes int64
+	for {
+		bodyLen, raddr, err := targetConn.ReadFrom(pkt[bodyStart:])
+		if err == errNATFiltered {
+			debugUDPAddr(raddr, "Filtered response: %v", err)
+			sm.AddUDPPacketFromTarget(targetConn.clientLocation, targetConn.keyID, "ERR_NAT_FILTERED", bodyLen, 0)
+			continue
+		}
+		if err != nil {
+			// The socket was closed.
+			return targetProxyBytes
+		}
+		targetProxyBytes += int64(bodyLen)
+		srcAddr := socks.ParseAddr(raddr.String())
+		addrStart := bodyStart - len(srcAddr)
+		copy(pkt[addrStart:], srcAddr)
+		frameStart := addrStart - ss.UDPOverTCPFrameHeaderSize
+		status := "OK"
+		proxyClientBytes := 0
+		if err := ss.WriteUDPOverTCPFrame(clientWriter, pkt[frameStart:bodyStart+bodyLen]); err != nil {
+			debugUDPAddr(raddr, "Failed to write to client: %v", err)
+			status = "ERR_WRITE"
+		} else {
+			proxyClientBytes = bodyStart + bodyLen - frameStart
+			targetConn.onDelivered(bodyLen)
+		}
+		sm.AddUDPPacketFromTarget(targetConn.clientLocation, targetConn.keyID, status, bodyLen, proxyClientBytes)
+	}
+}
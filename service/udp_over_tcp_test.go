@@ -0,0 +1,139 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/require"
+)
+
+func writeUDPOverTCPDatagram(t *testing.T, w *ss.Writer, target net.Addr, payload []byte) {
+	frame := make([]byte, ss.UDPOverTCPFrameHeaderSize)
+	frame = append(frame, socks.ParseAddr(target.String())...)
+	frame = append(frame, payload...)
+	require.NoError(t, ss.WriteUDPOverTCPFrame(w, frame))
+}
+
+func TestUDPOverTCPRejectedTarget(t *testing.T) {
+	echoConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer echoConn.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echoConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echoConn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	// Only the first datagram is rejected.
+	var calls int32
+	validator := func(ip net.IP) *onet.ConnectionError {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return onet.NewConnectionError("ERR_ADDRESS_PRIVATE", "Rejected in test", nil)
+		}
+		return nil
+	}
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, 200*time.Millisecond, &TCPServiceOptions{TargetIPValidator: validator})
+	listener := makeLocalhostListener(t)
+	go s.Serve(onet.AdaptListener(listener))
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	cipher := firstCipher(cipherList)
+	ssw := ss.NewShadowsocksWriter(conn, cipher)
+	ssr := ss.NewShadowsocksReader(conn, cipher)
+	_, err = ssw.Write(socks.ParseAddr(ss.UDPOverTCPTargetAddr))
+	require.NoError(t, err)
+
+	// The first datagram is dropped, and the connection keeps relaying the next.
+	writeUDPOverTCPDatagram(t, ssw, echoConn.LocalAddr(), []byte("rejected"))
+	writeUDPOverTCPDatagram(t, ssw, echoConn.LocalAddr(), []byte("accepted"))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	datagram, err := ss.ReadUDPOverTCPFrame(ssr, make([]byte, 1024))
+	require.NoError(t, err)
+	addrLen := len(socks.ParseAddr(echoConn.LocalAddr().String()))
+	require.Equal(t, "accepted", string(datagram[addrLen:]))
+
+	conn.Close()
+	require.NoError(t, s.GracefulStop())
+	require.Equal(t, []string{"OK"}, testMetrics.closeStatus)
+	require.Equal(t, []string{"ERR_ADDRESS_PRIVATE", "OK"}, testMetrics.udpClientStatus)
+	require.Equal(t, []string{"OK"}, testMetrics.udpTargetStatus)
+}
+
+func TestUDPOverTCPNATFilter(t *testing.T) {
+	targetConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer targetConn.Close()
+	otherConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer otherConn.Close()
+	// The target replies from another port first, then from its own.
+	go func() {
+		buf := make([]byte, 1024)
+		n, addr, err := targetConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		otherConn.WriteTo([]byte("filtered"), addr)
+		time.Sleep(50 * time.Millisecond)
+		targetConn.WriteTo(buf[:n], addr)
+	}()
+
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, 200*time.Millisecond, &TCPServiceOptions{
+		TargetIPValidator: allowAll,
+		NATFilter:         NATFilterAddressAndPortDependent,
+	})
+	listener := makeLocalhostListener(t)
+	go s.Serve(onet.AdaptListener(listener))
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	cipher := firstCipher(cipherList)
+	ssw := ss.NewShadowsocksWriter(conn, cipher)
+	ssr := ss.NewShadowsocksReader(conn, cipher)
+	_, err = ssw.Write(socks.ParseAddr(ss.UDPOverTCPTargetAddr))
+	require.NoError(t, err)
+	writeUDPOverTCPDatagram(t, ssw, targetConn.LocalAddr(), []byte("request"))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	datagram, err := ss.ReadUDPOverTCPFrame(ssr, make([]byte, 1024))
+	require.NoError(t, err)
+	addrLen := len(socks.ParseAddr(targetConn.LocalAddr().String()))
+	require.Equal(t, "request", string(datagram[addrLen:]))
+
+	conn.Close()
+	require.NoError(t, s.GracefulStop())
+	require.Equal(t, []string{"OK"}, testMetrics.udpClientStatus)
+	require.Equal(t, []string{"ERR_NAT_FILTERED", "OK"}, testMetrics.udpTargetStatus)
+}
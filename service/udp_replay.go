@@ -0,0 +1,123 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// UDPReplayFilter remembers the salts of recent UDP packets, per access key,
+// so that replayed packets can be rejected.  Every UDP packet has its own salt,
+// so salts are only remembered for a time window, and each key is limited to
+// a fixed number of salts per window.  If a key exceeds its limit, its window
+// is cut short, which bounds memory at the cost of a shorter window under load.
+// The windows of keys without recent packets are removed.
+type UDPReplayFilter struct {
+	mu        sync.Mutex
+	window    time.Duration
+	maxPerKey int
+	// The SipHash key of the salts.
+	k0, k1 uint64
+	keys   map[string]*saltWindow
+	// When the inactive windows were last removed.
+	lastPrune time.Time
+	now       func() time.Time // Overridden in tests.
+}
+
+// saltWindow holds the salts of one key in two generations: the current one,
+// and the previous one, which is discarded when the current one is retired.
+type saltWindow struct {
+	start    time.Time
+	current  map[uint64]empty
+	previous map[uint64]empty
+}
+
+// NewUDPReplayFilter creates a filter that remembers each salt for at least
+// `window`, and for up to twice as long, unless its key receives more than
+// `maxPerKey` packets in that time.  Zero `maxPerKey` means no limit.
+func NewUDPReplayFilter(window time.Duration, maxPerKey int) *UDPReplayFilter {
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		panic("Failed to generate the UDP replay filter key: " + err.Error())
+	}
+	return &UDPReplayFilter{
+		window:    window,
+		maxPerKey: maxPerKey,
+		k0:        binary.LittleEndian.Uint64(key[:8]),
+		k1:        binary.LittleEndian.Uint64(key[8:]),
+		keys:      make(map[string]*saltWindow),
+		lastPrune: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// saltHash reduces a salt to 64 bits.  The hash is keyed with a random key, so
+// that clients can't choose salts that collide with those of other clients.
+func (f *UDPReplayFilter) saltHash(salt []byte) uint64 {
+	return sipHash24(f.k0, f.k1, salt)
+}
+
+// prune removes the windows that haven't started a generation for two windows,
+// whose salts would all be discarded by their next packet anyway.  It must be
+// called with f.mu held.
+func (f *UDPReplayFilter) prune(now time.Time) {
+	for id, w := range f.keys {
+		if now.Sub(w.start) >= 2*f.window {
+			delete(f.keys, id)
+		}
+	}
+	f.lastPrune = now
+}
+
+// Add records a packet with this key ID and salt.  It returns false if the
+// salt was already seen within the window.  A nil filter accepts every salt.
+func (f *UDPReplayFilter) Add(id string, salt []byte) bool {
+	if f == nil {
+		return true
+	}
+	hash := f.saltHash(salt)
+	now := f.now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now.Sub(f.lastPrune) >= f.window {
+		f.prune(now)
+	}
+	w, ok := f.keys[id]
+	if !ok {
+		w = &saltWindow{start: now, current: make(map[uint64]empty)}
+		f.keys[id] = w
+	}
+	if _, ok := w.current[hash]; ok {
+		return false
+	}
+	if age := now.Sub(w.start); age >= f.window || (f.maxPerKey > 0 && len(w.current) >= f.maxPerKey) {
+		if age >= 2*f.window {
+			// The current generation is also too old to keep.
+			w.previous = nil
+		} else {
+			w.previous = w.current
+		}
+		w.current = make(map[uint64]empty)
+		w.start = now
+	}
+	if _, ok := w.previous[hash]; ok {
+		return false
+	}
+	w.current[hash] = empty{}
+	return true
+}
@@ -0,0 +1,128 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func makeTestSalt(i int) []byte {
+	salt := make([]byte, 32)
+	binary.BigEndian.PutUint64(salt, uint64(i))
+	return salt
+}
+
+func TestUDPReplayFilter(t *testing.T) {
+	f := NewUDPReplayFilter(time.Minute, 100)
+	if !f.Add("key 1", makeTestSalt(1)) {
+		t.Error("First salt was rejected")
+	}
+	if f.Add("key 1", makeTestSalt(1)) {
+		t.Error("Replayed salt was accepted")
+	}
+	if !f.Add("key 2", makeTestSalt(1)) {
+		t.Error("Salt from another key was rejected")
+	}
+}
+
+func TestUDPReplayFilterNil(t *testing.T) {
+	var f *UDPReplayFilter
+	if !f.Add("key", makeTestSalt(1)) || !f.Add("key", makeTestSalt(1)) {
+		t.Error("Nil filter rejected a salt")
+	}
+}
+
+func TestUDPReplayFilterWindow(t *testing.T) {
+	now := time.Now()
+	f := NewUDPReplayFilter(time.Minute, 100)
+	f.now = func() time.Time { return now }
+	f.Add("key", makeTestSalt(1))
+
+	// The salt is remembered for at least one window.
+	now = now.Add(59 * time.Second)
+	if f.Add("key", makeTestSalt(1)) {
+		t.Error("Salt was forgotten within the window")
+	}
+	// In the next window, it's still in the previous generation.
+	now = now.Add(30 * time.Second)
+	f.Add("key", makeTestSalt(2))
+	if f.Add("key", makeTestSalt(1)) {
+		t.Error("Salt was forgotten too soon")
+	}
+	// Two windows later, both generations have been discarded.
+	now = now.Add(2 * time.Minute)
+	if !f.Add("key", makeTestSalt(1)) {
+		t.Error("Salt was remembered for too long")
+	}
+}
+
+func TestUDPReplayFilterMaxPerKey(t *testing.T) {
+	const maxPerKey = 10
+	f := NewUDPReplayFilter(time.Hour, maxPerKey)
+	for i := 0; i < 2*maxPerKey; i++ {
+		if !f.Add("key", makeTestSalt(i)) {
+			t.Fatalf("Salt %d was rejected", i)
+		}
+	}
+	w := f.keys["key"]
+	if len(w.current) > maxPerKey || len(w.previous) > maxPerKey {
+		t.Errorf("Too many salts: %d + %d", len(w.current), len(w.previous))
+	}
+	// The oldest salts were discarded to make room.
+	if !f.Add("key", makeTestSalt(0)) {
+		t.Error("Expected the oldest salt to be forgotten")
+	}
+	// The most recent ones are still remembered.
+	if f.Add("key", makeTestSalt(2*maxPerKey-1)) {
+		t.Error("Expected a recent salt to be remembered")
+	}
+}
+
+func TestUDPReplayFilterPrune(t *testing.T) {
+	now := time.Now()
+	f := NewUDPReplayFilter(time.Minute, 100)
+	f.now = func() time.Time { return now }
+	f.Add("inactive", makeTestSalt(1))
+	f.Add("active", makeTestSalt(1))
+
+	for i := 2; i < 5; i++ {
+		now = now.Add(time.Minute)
+		f.Add("active", makeTestSalt(i))
+	}
+	if _, ok := f.keys["inactive"]; ok {
+		t.Error("The window of an inactive key was kept")
+	}
+	if _, ok := f.keys["active"]; !ok {
+		t.Error("The window of an active key was removed")
+	}
+	if f.Add("active", makeTestSalt(4)) {
+		t.Error("Replayed salt of an active key was accepted")
+	}
+}
+
+func BenchmarkUDPReplayFilter(b *testing.B) {
+	f := NewUDPReplayFilter(time.Minute, 100_000)
+	salts := make([][]byte, 1000)
+	for i := range salts {
+		salts[i] = makeTestSalt(i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		binary.BigEndian.PutUint64(salts[i%len(salts)], uint64(i))
+		f.Add("key", salts[i%len(salts)])
+	}
+}
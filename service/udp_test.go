@@ -19,6 +19,7 @@ import (
 	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -28,6 +29,7 @@ import (
 	logging "github.com/op/go-logging"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const timeout = 5 * time.Minute
@@ -100,10 +102,17 @@ type natTestMetrics struct {
 	metrics.ShadowsocksMetrics
 	natEntriesAdded int
 	upstreamPackets []udpReport
+	mu              sync.Mutex // Protects the fields below, which are added in the background.
+	dnsResults      []string
+	sessions        []metrics.UDPSessionMetrics
+	aclHits         []string
+	rateLimited     []string
 }
 
 func (m *natTestMetrics) AddTCPProbe(status, drainResult string, port int, data metrics.ProxyMetrics) {
 }
+func (m *natTestMetrics) AddTCPFallback(status, result string, port int, data metrics.ProxyMetrics) {
+}
 func (m *natTestMetrics) AddClosedTCPConnection(clientLocation, accessKey, status string, data metrics.ProxyMetrics, timeToCipher, duration time.Duration) {
 }
 func (m *natTestMetrics) GetLocation(net.Addr) (string, error) {
@@ -118,19 +127,39 @@ func (m *natTestMetrics) AddUDPPacketFromClient(clientLocation, accessKey, statu
 }
 func (m *natTestMetrics) AddUDPPacketFromTarget(clientLocation, accessKey, status string, targetProxyBytes, proxyClientBytes int) {
 }
-func (m *natTestMetrics) AddUDPNatEntry() {
+func (m *natTestMetrics) AddUDPNatEntry(accessKey string) {
 	m.natEntriesAdded++
 }
-func (m *natTestMetrics) RemoveUDPNatEntry() {}
+func (m *natTestMetrics) RemoveUDPNatEntry(accessKey string) {}
+func (m *natTestMetrics) AddClosedUDPSession(clientLocation, accessKey string, data metrics.UDPSessionMetrics, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions = append(m.sessions, data)
+}
+func (m *natTestMetrics) AddUDPDNSQuery(accessKey, result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dnsResults = append(m.dnsResults, result)
+}
+func (m *natTestMetrics) AddACLHit(policy, rule, action string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.aclHits = append(m.aclHits, policy+"/"+rule+"/"+action)
+}
+func (m *natTestMetrics) AddRateLimited(proto, limit, action string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rateLimited = append(m.rateLimited, proto+"/"+limit+"/"+action)
+}
 
 // Takes a validation policy, and returns the metrics it
 // generates when localhost access is attempted
-func sendToDiscard(payloads [][]byte, validator onet.TargetIPValidator) *natTestMetrics {
+func sendToDiscard(payloads [][]byte, validator onet.TargetIPValidator, opts ...*UDPServiceOptions) *natTestMetrics {
 	ciphers, _ := MakeTestCiphers([]string{"asdf"})
 	cipher := ciphers.SnapshotForClientIP(nil)[0].Value.(*CipherEntry).Cipher
 	clientConn := makePacketConn()
 	metrics := &natTestMetrics{}
-	service := NewUDPService(timeout, ciphers, metrics)
+	service := NewUDPService(timeout, ciphers, metrics, opts...)
 	service.SetTargetIPValidator(validator)
 	go service.Serve(clientConn)
 
@@ -172,6 +201,40 @@ func TestIPFilter(t *testing.T) {
 			assert.Equal(t, report.accessKey, "id-0", "Unexpected access key: %s", report.accessKey)
 		}
 	})
+
+	t.Run("Denied by ACL", func(t *testing.T) {
+		acl, err := NewACLPolicy("no-discard", "", []ACLRuleConfig{{Action: ACLDeny, Protocols: []string{"udp"}, Ports: []string{"9"}}})
+		require.NoError(t, err)
+		metrics := sendToDiscard(payloads, allowAll, &UDPServiceOptions{ACL: acl})
+		assert.Equal(t, 0, metrics.natEntriesAdded, "Unexpected NAT entry on denied packet")
+		require.Equal(t, 2, len(metrics.upstreamPackets), "Expected 2 reports, not %v", metrics.upstreamPackets)
+		for _, report := range metrics.upstreamPackets {
+			assert.Equal(t, "ERR_ACL_DENIED", report.status)
+		}
+		assert.Equal(t, []string{"no-discard/0/deny", "no-discard/0/deny"}, metrics.aclHits)
+	})
+
+	t.Run("Port blocked", func(t *testing.T) {
+		blocklist := onet.NewPortBlocklist([]onet.PortRange{{First: 9, Last: 9}})
+		metrics := sendToDiscard(payloads, allowAll, &UDPServiceOptions{BlockedPorts: blocklist})
+		assert.Equal(t, 0, metrics.natEntriesAdded, "Unexpected NAT entry on blocked packet")
+		require.Equal(t, 2, len(metrics.upstreamPackets), "Expected 2 reports, not %v", metrics.upstreamPackets)
+		for _, report := range metrics.upstreamPackets {
+			assert.Equal(t, "ERR_PORT_BLOCKED", report.status)
+		}
+	})
+
+	t.Run("Client rate limited", func(t *testing.T) {
+		// Without a NAT entry, both packets are from a new client address.
+		limiter := NewClientLimiter(ClientLimits{IPRate: 0.001, IPBurst: 1})
+		metrics := sendToDiscard(payloads, onet.RequirePublicIP, &UDPServiceOptions{ClientLimiter: limiter})
+		require.Equal(t, 2, len(metrics.upstreamPackets), "Expected 2 reports, not %v", metrics.upstreamPackets)
+		assert.Equal(t, "ERR_ADDRESS_INVALID", metrics.upstreamPackets[0].status)
+		// Rejected before trial decryption.
+		assert.Equal(t, "ERR_RATE_LIMITED", metrics.upstreamPackets[1].status)
+		assert.Equal(t, "", metrics.upstreamPackets[1].accessKey)
+		assert.Equal(t, []string{"udp/ip_rate/drop"}, metrics.rateLimited)
+	})
 }
 
 func TestUpstreamMetrics(t *testing.T) {
@@ -193,6 +256,136 @@ func TestUpstreamMetrics(t *testing.T) {
 	}
 }
 
+func TestUDPReplay(t *testing.T) {
+	ciphers, _ := MakeTestCiphers([]string{"asdf"})
+	entry := ciphers.SnapshotForClientIP(nil)[0].Value.(*CipherEntry)
+	clientConn := makePacketConn()
+	metrics := &natTestMetrics{}
+	service := NewUDPService(timeout, ciphers, metrics, &UDPServiceOptions{
+		ReplayFilter: NewUDPReplayFilter(time.Minute, 100),
+	})
+	service.SetTargetIPValidator(allowAll)
+	go service.Serve(clientConn)
+
+	pack := func(saltGenerator ss.SaltGenerator) []byte {
+		plaintext := append(socks.ParseAddr("127.0.0.1:9"), []byte("payload")...)
+		ciphertext := make([]byte, entry.Cipher.SaltSize()+len(plaintext)+entry.Cipher.TagSize())
+		ciphertext, err := ss.PackWithSaltGenerator(ciphertext, plaintext, entry.Cipher, saltGenerator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ciphertext
+	}
+	clientPacket := pack(ss.RandomSaltGenerator)
+	// Decryption is in-place, so each send needs its own copy.
+	packets := [][]byte{
+		clientPacket,
+		append([]byte(nil), clientPacket...),
+		// A packet that the server encrypted, reflected back.
+		pack(entry.SaltGenerator),
+	}
+	for _, payload := range packets {
+		clientConn.recv <- packet{addr: &clientAddr, payload: payload}
+	}
+	service.GracefulStop()
+
+	var statuses []string
+	for _, report := range metrics.upstreamPackets {
+		statuses = append(statuses, report.status)
+	}
+	assert.Equal(t, []string{"OK", "ERR_REPLAY_CLIENT", "ERR_REPLAY_SERVER"}, statuses)
+}
+
+func TestUDPDNSProxy(t *testing.T) {
+	stub := startStubResolver(t, false)
+	dnsProxy, err := NewDNSProxy(stub.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dnsProxy.Close()
+	ciphers, _ := MakeTestCiphers([]string{"asdf"})
+	cipher := ciphers.SnapshotForClientIP(nil)[0].Value.(*CipherEntry).Cipher
+	clientConn := makePacketConn()
+	metrics := &natTestMetrics{}
+	// Only the first packet of a new client passes the limiter, but the client's
+	// key is remembered without a NAT entry.
+	limiter := NewClientLimiter(ClientLimits{IPRate: 0.001, IPBurst: 1})
+	service := NewUDPService(timeout, ciphers, metrics, &UDPServiceOptions{DNSProxy: dnsProxy, ClientLimiter: limiter})
+	// dnsAddr is a documentation address.
+	service.SetTargetIPValidator(allowAll)
+	go service.Serve(clientConn)
+
+	// The client's resolver is unreachable, so the response must come from the proxy.
+	plaintext := append(socks.ParseAddr(dnsAddr.String()), makeDNSQuery(t, 42, "example.com.")...)
+	for i := 0; i < 3; i++ {
+		ciphertext := make([]byte, cipher.SaltSize()+len(plaintext)+cipher.TagSize())
+		ciphertext, err = ss.Pack(ciphertext, plaintext, cipher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientConn.recv <- packet{addr: &clientAddr, payload: ciphertext}
+
+		reply := <-clientConn.send
+		assert.Equal(t, clientAddr.String(), reply.addr.String())
+		buf, err := ss.Unpack(nil, reply.payload, cipher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcAddr := socks.SplitAddr(buf)
+		assert.Equal(t, dnsAddr.String(), srcAddr.String())
+		msg := parseDNSResponse(t, buf[len(srcAddr):])
+		assert.Equal(t, uint16(42), msg.ID)
+	}
+	service.GracefulStop()
+
+	assert.Equal(t, 0, metrics.natEntriesAdded)
+	assert.Equal(t, []string{DNSResultUpstream, DNSResultCached, DNSResultCached}, metrics.dnsResults)
+	assert.Empty(t, metrics.rateLimited)
+}
+
+func TestUDPResolver(t *testing.T) {
+	stub := startStubResolver(t, false)
+	resolver := startStubResolverClient(t, stub, &metrics.NoOpMetrics{})
+	targetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer targetConn.Close()
+	_, port, _ := net.SplitHostPort(targetConn.LocalAddr().String())
+
+	ciphers, _ := MakeTestCiphers([]string{"asdf"})
+	cipher := ciphers.SnapshotForClientIP(nil)[0].Value.(*CipherEntry).Cipher
+	clientConn := makePacketConn()
+	metrics := &natTestMetrics{}
+	service := NewUDPService(timeout, ciphers, metrics, &UDPServiceOptions{
+		Resolver:     resolver,
+		IPPreference: IPPreferenceIPv4,
+	})
+	service.SetTargetIPValidator(allowAll)
+	go service.Serve(clientConn)
+
+	// The hostname isn't cached, so the packet is forwarded in the background.
+	plaintext := append(socks.ParseAddr(net.JoinHostPort("example.com", port)), []byte("payload")...)
+	ciphertext := make([]byte, cipher.SaltSize()+len(plaintext)+cipher.TagSize())
+	ciphertext, err = ss.Pack(ciphertext, plaintext, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn.recv <- packet{addr: &clientAddr, payload: ciphertext}
+
+	buf := make([]byte, 100)
+	targetConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := targetConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "payload", string(buf[:n]))
+	service.GracefulStop()
+
+	assert.Equal(t, []udpReport{{"", "id-0", "OK", len(ciphertext), n}}, metrics.upstreamPackets)
+	assert.True(t, resolver.isCached("example.com"))
+}
+
 func assertAlmostEqual(t *testing.T, a, b time.Time) {
 	delta := a.Sub(b)
 	limit := 100 * time.Millisecond
@@ -208,15 +401,96 @@ func TestNATEmpty(t *testing.T) {
 	}
 }
 
+func natCipherEntry(keyID string) *CipherEntry {
+	entry := MakeCipherEntry(keyID, natCipher, "test password")
+	return &entry
+}
+
 func setupNAT() (*fakePacketConn, *fakePacketConn, *natconn) {
+	return setupNATWithFilter(NATFilterEndpointIndependent)
+}
+
+func setupNATWithFilter(filter NATFilter) (*fakePacketConn, *fakePacketConn, *natconn) {
 	nat := newNATmap(timeout, &natTestMetrics{}, &sync.WaitGroup{})
 	clientConn := makePacketConn()
 	targetConn := makePacketConn()
-	nat.Add(&clientAddr, clientConn, natCipher, targetConn, "ZZ", "key id")
+	nat.Add(&clientAddr, clientConn, natCipherEntry("key id"), targetConn, "ZZ", filter)
 	entry := nat.Get(clientAddr.String())
 	return clientConn, targetConn, entry
 }
 
+func TestNATCloseOnExpiry(t *testing.T) {
+	nat := newNATmap(timeout, &natTestMetrics{}, &sync.WaitGroup{})
+	cipherEntry := natCipherEntry("key id")
+	cipherEntry.NotAfter = time.Now().Add(50 * time.Millisecond)
+	cipherEntry.CloseOnExpiry = true
+	entry, err := nat.Add(&clientAddr, makePacketConn(), cipherEntry, makePacketConn(), "ZZ", NATFilterEndpointIndependent)
+	require.NoError(t, err)
+	require.False(t, entry.keyExpired(time.Now()))
+	require.Eventually(t, func() bool {
+		entry.mu.Lock()
+		defer entry.mu.Unlock()
+		return entry.expired
+	}, time.Second, 10*time.Millisecond, "The entry should expire with its key")
+	require.True(t, entry.keyExpired(time.Now()))
+}
+
+func TestNATTargetsAfterExpiry(t *testing.T) {
+	nat := newNATmap(timeout, &natTestMetrics{}, &sync.WaitGroup{})
+	cipherEntry := natCipherEntry("key id")
+	cipherEntry.NotAfter = time.Now().Add(time.Hour)
+	entry, err := nat.Add(&clientAddr, makePacketConn(), cipherEntry, makePacketConn(), "ZZ", NATFilterEndpointIndependent)
+	require.NoError(t, err)
+	_, err = entry.WriteTo([]byte{1}, &targetAddr)
+	require.NoError(t, err)
+
+	newTarget := &net.UDPAddr{IP: targetAddr.IP, Port: targetAddr.Port + 1}
+	before := cipherEntry.NotAfter.Add(-time.Second)
+	require.True(t, entry.allowsTarget(&targetAddr, before))
+	require.True(t, entry.allowsTarget(newTarget, before))
+	// After expiry, the client can keep talking to its targets, but not to new ones.
+	after := cipherEntry.NotAfter.Add(time.Second)
+	require.True(t, entry.allowsTarget(&targetAddr, after))
+	require.False(t, entry.allowsTarget(newTarget, after), "New target allowed after expiry")
+}
+
+func TestNATTargetsBounded(t *testing.T) {
+	nat := newNATmap(timeout, &natTestMetrics{}, &sync.WaitGroup{})
+	cipherEntry := natCipherEntry("key id")
+	cipherEntry.NotAfter = time.Now().Add(time.Hour)
+	entry, err := nat.Add(&clientAddr, makePacketConn(), cipherEntry, makePacketConn(), "ZZ", NATFilterEndpointIndependent)
+	require.NoError(t, err)
+	for port := 1; port <= 2*maxPeers; port++ {
+		entry.onWrite(&net.UDPAddr{IP: targetAddr.IP, Port: port})
+	}
+	entry.mu.Lock()
+	numTargets := len(entry.targets.peers)
+	entry.mu.Unlock()
+	require.LessOrEqual(t, numTargets, maxPeers)
+
+	// After expiry, the most recent targets are still allowed.
+	after := cipherEntry.NotAfter.Add(time.Second)
+	require.True(t, entry.allowsTarget(&net.UDPAddr{IP: targetAddr.IP, Port: 2 * maxPeers}, after))
+	require.False(t, entry.allowsTarget(&net.UDPAddr{IP: targetAddr.IP, Port: 1}, after))
+}
+
+func TestFindAccessKeyUDPValidity(t *testing.T) {
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	entry := cipherList.SnapshotForClientIP(nil)[0].Value.(*CipherEntry)
+	packet, err := ss.Pack(make([]byte, serverUDPBufferSize), ss.MakeTestPayload(50), entry.Cipher)
+	require.NoError(t, err)
+	buf := make([]byte, serverUDPBufferSize)
+
+	entry.NotAfter = time.Now().Add(-time.Second)
+	_, _, err = findAccessKeyUDP(nil, buf, packet, cipherList)
+	require.Error(t, err, "Expired key was accepted")
+	entry.NotAfter = time.Time{}
+	_, found, err := findAccessKeyUDP(nil, buf, packet, cipherList)
+	require.NoError(t, err)
+	require.Equal(t, entry, found)
+}
+
 func TestNATGet(t *testing.T) {
 	_, targetConn, entry := setupNAT()
 	if entry == nil {
@@ -227,6 +501,123 @@ func TestNATGet(t *testing.T) {
 	}
 }
 
+func TestNATAddExisting(t *testing.T) {
+	testMetrics := &natTestMetrics{}
+	nat := newNATmap(timeout, testMetrics, &sync.WaitGroup{})
+	clientConn := makePacketConn()
+	targetConn := makePacketConn()
+	entry, err := nat.Add(&clientAddr, clientConn, natCipherEntry("key id"), targetConn, "ZZ", NATFilterEndpointIndependent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another reader adds an entry for the same client.
+	otherConn := makePacketConn()
+	if got, err := nat.Add(&clientAddr, clientConn, natCipherEntry("key id"), otherConn, "ZZ", NATFilterEndpointIndependent); got != entry || err != nil {
+		t.Errorf("Expected the existing entry, got %v, %v", got, err)
+	}
+	if _, ok := <-otherConn.recv; ok {
+		t.Error("Expected the redundant target connection to be closed")
+	}
+	if testMetrics.natEntriesAdded != 1 {
+		t.Errorf("Wrong NAT add count: %d", testMetrics.natEntriesAdded)
+	}
+}
+
+// addNATClient adds an entry for a client with the given port and key, and
+// returns its target connection.
+func addNATClient(nat *natmap, port int, keyID string) (*fakePacketConn, error) {
+	targetConn := makePacketConn()
+	clientAddr := &net.UDPAddr{IP: clientAddr.IP, Port: port}
+	_, err := nat.Add(clientAddr, makePacketConn(), natCipherEntry(keyID), targetConn, "ZZ", NATFilterEndpointIndependent)
+	return targetConn, err
+}
+
+func natHasClient(nat *natmap, port int) bool {
+	return nat.Get((&net.UDPAddr{IP: clientAddr.IP, Port: port}).String()) != nil
+}
+
+func TestNATLimitReject(t *testing.T) {
+	nat := newNATmap(timeout, &natTestMetrics{}, &sync.WaitGroup{})
+	nat.limits = natLimits{maxEntries: 2, maxEntriesPerKey: 1}
+
+	_, err := addNATClient(nat, 1, "key 1")
+	assert.NoError(t, err)
+	// Over the per-key limit.
+	rejectedConn, err := addNATClient(nat, 2, "key 1")
+	assert.Equal(t, errNATLimit, err)
+	if _, ok := <-rejectedConn.recv; ok {
+		t.Error("Expected the rejected target connection to be closed")
+	}
+	_, err = addNATClient(nat, 3, "key 2")
+	assert.NoError(t, err)
+	// Over the total limit.
+	_, err = addNATClient(nat, 4, "key 3")
+	assert.Equal(t, errNATLimit, err)
+
+	assert.True(t, natHasClient(nat, 1))
+	assert.False(t, natHasClient(nat, 2))
+	assert.True(t, natHasClient(nat, 3))
+	assert.False(t, natHasClient(nat, 4))
+}
+
+func TestNATLimitKeyOverride(t *testing.T) {
+	nat := newNATmap(timeout, &natTestMetrics{}, &sync.WaitGroup{})
+	nat.limits = natLimits{maxEntriesPerKey: 1}
+	addClient := func(port int, cipherEntry *CipherEntry) error {
+		clientAddr := &net.UDPAddr{IP: clientAddr.IP, Port: port}
+		_, err := nat.Add(clientAddr, makePacketConn(), cipherEntry, makePacketConn(), "ZZ", NATFilterEndpointIndependent)
+		return err
+	}
+
+	larger := natCipherEntry("larger")
+	larger.MaxNATEntries = 2
+	assert.NoError(t, addClient(1, larger))
+	assert.NoError(t, addClient(2, larger))
+	assert.Equal(t, errNATLimit, addClient(3, larger))
+
+	unlimited := natCipherEntry("unlimited")
+	unlimited.MaxNATEntries = -1
+	for port := 4; port < 8; port++ {
+		assert.NoError(t, addClient(port, unlimited))
+	}
+
+	// Other keys keep the service's limit.
+	assert.NoError(t, addClient(8, natCipherEntry("default")))
+	assert.Equal(t, errNATLimit, addClient(9, natCipherEntry("default")))
+}
+
+func TestNATLimitEvict(t *testing.T) {
+	nat := newNATmap(timeout, &natTestMetrics{}, &sync.WaitGroup{})
+	nat.limits = natLimits{maxEntries: 3, maxEntriesPerKey: 2, evict: true}
+
+	targetConns := make(map[int]*fakePacketConn)
+	addClient := func(port int, keyID string, lastActive int64) {
+		targetConn, err := addNATClient(nat, port, keyID)
+		assert.NoError(t, err)
+		targetConns[port] = targetConn
+		// Pretend that the clients became active in the order given.
+		entry := nat.Get((&net.UDPAddr{IP: clientAddr.IP, Port: port}).String())
+		atomic.StoreInt64(&entry.lastActive, lastActive)
+	}
+	addClient(1, "key 1", 2)
+	addClient(2, "key 1", 1)
+	addClient(3, "key 2", 3)
+	// Over the per-key limit: evicts client 2, the least active of key 1.
+	addClient(4, "key 1", 4)
+	assert.False(t, natHasClient(nat, 2))
+	assertAlmostEqual(t, targetConns[2].deadline, time.Now())
+	// Over the total limit: evicts client 1, the least active overall.
+	addClient(5, "key 3", 5)
+	assert.False(t, natHasClient(nat, 1))
+	assertAlmostEqual(t, targetConns[1].deadline, time.Now())
+
+	for _, port := range []int{3, 4, 5} {
+		assert.True(t, natHasClient(nat, port), "Missing client %d", port)
+	}
+	assert.Equal(t, map[string]int{"key 1": 1, "key 2": 1, "key 3": 1}, nat.keyEntries)
+}
+
 func TestNATWrite(t *testing.T) {
 	_, targetConn, entry := setupNAT()
 
@@ -314,6 +705,45 @@ func TestNATFastClose(t *testing.T) {
 	assertAlmostEqual(t, targetConn.deadline, time.Now())
 }
 
+func TestNATFilter(t *testing.T) {
+	otherPort := net.UDPAddr{IP: targetAddr.IP, Port: targetAddr.Port + 1}
+	otherIP := net.UDPAddr{IP: []byte{192, 0, 2, 4}, Port: targetAddr.Port}
+	tests := []struct {
+		filter    NATFilter
+		forwarded []*net.UDPAddr
+	}{
+		{NATFilterEndpointIndependent, []*net.UDPAddr{&otherIP, &otherPort, &targetAddr}},
+		{NATFilterAddressDependent, []*net.UDPAddr{&otherPort, &targetAddr}},
+		{NATFilterAddressAndPortDependent, []*net.UDPAddr{&targetAddr}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.filter), func(t *testing.T) {
+			clientConn, targetConn, entry := setupNATWithFilter(tt.filter)
+			entry.WriteTo([]byte{1}, &targetAddr)
+			<-targetConn.send
+
+			// Each peer replies in turn.  A packet that is wrongly forwarded
+			// shows up in place of the next expected one.
+			expected := 0
+			for _, peer := range []*net.UDPAddr{&otherIP, &otherPort, &targetAddr} {
+				targetConn.recv <- packet{addr: peer, payload: []byte{1, 2, 3}}
+				if peer != tt.forwarded[expected] {
+					continue
+				}
+				expected++
+				sent := <-clientConn.send
+				plaintext, err := ss.Unpack(nil, sent.payload, natCipher)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := socks.SplitAddr(plaintext).String(); got != peer.String() {
+					t.Errorf("Forwarded a packet from %v, expected %v", got, peer)
+				}
+			}
+		})
+	}
+}
+
 func TestNATNoFastClose_NotDNS(t *testing.T) {
 	clientConn, targetConn, entry := setupNAT()
 
@@ -391,6 +821,37 @@ func TestNATTimeout(t *testing.T) {
 	assertAlmostEqual(t, before, time.Now())
 }
 
+func TestNATSessionMetrics(t *testing.T) {
+	for _, dst := range []*net.UDPAddr{&dnsAddr, &targetAddr} {
+		m := &natTestMetrics{}
+		var running sync.WaitGroup
+		nat := newNATmap(timeout, m, &running)
+		clientConn := makePacketConn()
+		targetConn := makePacketConn()
+		entry, err := nat.Add(&clientAddr, clientConn, natCipherEntry("key id"), targetConn, "ZZ", NATFilterEndpointIndependent)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entry.WriteTo([]byte{1, 2, 3}, dst)
+		<-targetConn.send
+		targetConn.recv <- packet{addr: dst, payload: []byte{1, 2, 3, 4, 5}}
+		<-clientConn.send
+		// End the session.
+		targetConn.recv <- packet{err: &fakeTimeoutError{}}
+		running.Wait()
+
+		expected := metrics.UDPSessionMetrics{
+			PacketsToTarget:   1,
+			BytesToTarget:     3,
+			PacketsFromTarget: 1,
+			BytesFromTarget:   5,
+			DNSOnly:           dst == &dnsAddr,
+		}
+		assert.Equal(t, []metrics.UDPSessionMetrics{expected}, m.sessions, "Destination %v", dst)
+	}
+}
+
 // Simulates receiving invalid UDP packets on a server with 100 ciphers.
 func BenchmarkUDPUnpackFail(b *testing.B) {
 	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(100))
@@ -432,7 +893,7 @@ func BenchmarkUDPUnpackRepeat(b *testing.B) {
 		cipherNumber := n % numCiphers
 		ip := ips[cipherNumber]
 		packet := packets[cipherNumber]
-		_, _, _, err := findAccessKeyUDP(ip, testBuf, packet, cipherList)
+		_, _, err := findAccessKeyUDP(ip, testBuf, packet, cipherList)
 		if err != nil {
 			b.Error(err)
 		}
@@ -460,7 +921,7 @@ func BenchmarkUDPUnpackSharedKey(b *testing.B) {
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
 		ip := ips[n%numIPs]
-		_, _, _, err := findAccessKeyUDP(ip, testBuf, packet, cipherList)
+		_, _, err := findAccessKeyUDP(ip, testBuf, packet, cipherList)
 		if err != nil {
 			b.Error(err)
 		}
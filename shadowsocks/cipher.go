@@ -141,6 +141,32 @@ func NewCipher(cipherName string, secretText string) (*Cipher, error) {
 	return &Cipher{*aeadSpec, secret}, nil
 }
 
+// NewCipherFromKey creates a Cipher given a cipher name and a raw key.
+// Unlike NewCipher, the key is used as-is instead of being derived from a
+// password, so it must have exactly KeySize(cipherName) bytes and should come
+// from a secure random source.
+func NewCipherFromKey(cipherName string, key []byte) (*Cipher, error) {
+	aeadSpec, err := getAEADSpec(cipherName)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != aeadSpec.keySize {
+		return nil, fmt.Errorf("Wrong key size for %v: got %d bytes, want %d", aeadSpec.name, len(key), aeadSpec.keySize)
+	}
+	secret := make([]byte, len(key))
+	copy(secret, key)
+	return &Cipher{*aeadSpec, secret}, nil
+}
+
+// KeySize returns the size of the raw key used by the named cipher.
+func KeySize(cipherName string) (int, error) {
+	aeadSpec, err := getAEADSpec(cipherName)
+	if err != nil {
+		return 0, err
+	}
+	return aeadSpec.keySize, nil
+}
+
 // Assumes all ciphers have NonceSize() <= 12.
 var zeroNonce [12]byte
 
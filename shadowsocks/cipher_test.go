@@ -15,6 +15,7 @@
 package shadowsocks
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -58,3 +59,42 @@ func TestMaxNonceSize(t *testing.T) {
 		}
 	}
 }
+
+func TestNewCipherFromKey(t *testing.T) {
+	for _, aeadName := range SupportedCipherNames() {
+		keySize, err := KeySize(aeadName)
+		if err != nil {
+			t.Fatalf("Failed to get key size for %v: %v", aeadName, err)
+		}
+		// A raw key equal to the derived password key must produce an equivalent cipher.
+		key := simpleEVPBytesToKey([]byte("test secret"), keySize)
+		fromKey, err := NewCipherFromKey(aeadName, key)
+		if err != nil {
+			t.Fatalf("Failed to create Cipher %v from key: %v", aeadName, err)
+		}
+		fromSecret, err := NewCipher(aeadName, "test secret")
+		if err != nil {
+			t.Fatalf("Failed to create Cipher %v: %v", aeadName, err)
+		}
+		if !bytes.Equal(fromKey.secret, fromSecret.secret) {
+			t.Errorf("Cipher %v from key doesn't match the password-derived cipher", aeadName)
+		}
+		// The cipher must not alias the caller's buffer.
+		key[0] ^= 0xff
+		if bytes.Equal(fromKey.secret, key) {
+			t.Errorf("Cipher %v shares memory with the provided key", aeadName)
+		}
+	}
+}
+
+func TestNewCipherFromKeyWrongSize(t *testing.T) {
+	if _, err := NewCipherFromKey(TestCipher, make([]byte, 16)); err == nil {
+		t.Error("Should get an error for a short key")
+	}
+	if _, err := NewCipherFromKey(TestCipher, make([]byte, 33)); err == nil {
+		t.Error("Should get an error for a long key")
+	}
+	if _, err := NewCipherFromKey("aes-256-cfb", make([]byte, 32)); err == nil {
+		t.Error("Should get an error for unsupported cipher")
+	}
+}
@@ -15,10 +15,41 @@
 package shadowsocks
 
 import (
+	"bytes"
 	"testing"
 	"time"
 )
 
+type fixedSaltGenerator struct{}
+
+func (fixedSaltGenerator) GetSalt(salt []byte) error {
+	for i := range salt {
+		salt[i] = byte(i)
+	}
+	return nil
+}
+
+func TestPackWithSaltGenerator(t *testing.T) {
+	cipher := newTestCipher(t)
+	plaintext := []byte("Hello")
+	pkt, err := PackWithSaltGenerator(make([]byte, 100), plaintext, cipher, fixedSaltGenerator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedSalt := make([]byte, cipher.SaltSize())
+	fixedSaltGenerator{}.GetSalt(expectedSalt)
+	if !bytes.Equal(pkt[:len(expectedSalt)], expectedSalt) {
+		t.Errorf("Wrong salt: %v", pkt[:len(expectedSalt)])
+	}
+	decrypted, err := Unpack(nil, pkt, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Wrong plaintext: %v", decrypted)
+	}
+}
+
 // Microbenchmark for the performance of Shadowsocks UDP encryption.
 func BenchmarkPack(b *testing.B) {
 	b.StopTimer()
@@ -0,0 +1,95 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/xtaci/smux"
+)
+
+// Reserved target addresses ask the server to handle a TCP connection
+// specially instead of connecting to a target.  They use the ".invalid" TLD,
+// which is guaranteed never to resolve (RFC 6761), so they can't collide with
+// a real destination.
+
+// MuxTargetAddr asks the server to run a stream multiplexer (smux) inside the
+// encrypted stream.  Each multiplexed stream begins with the SOCKS address of
+// its own target.
+const MuxTargetAddr = "mux.shadowsocks.invalid:0"
+
+// NewMuxConfig returns the smux configuration of MuxTargetAddr connections.
+// Clients and servers must use the same one.
+func NewMuxConfig() *smux.Config {
+	config := smux.DefaultConfig()
+	config.Version = 2
+	return config
+}
+
+// UDPOverTCPTargetAddr asks the server to relay UDP datagrams carried in the
+// encrypted stream.  Each datagram is framed by UDPOverTCPFrameHeaderSize bytes
+// holding its length (big-endian), followed by the SOCKS address of the peer
+// and the payload, as in the plaintext of a Shadowsocks UDP packet.
+const UDPOverTCPTargetAddr = "udp.shadowsocks.invalid:0"
+
+// UDPOverTCPFrameHeaderSize is the size of the length prefix of a datagram in
+// UDP-over-TCP mode.
+const UDPOverTCPFrameHeaderSize = 2
+
+// WriteUDPOverTCPFrame writes one datagram to `w`.  `frame` must consist of
+// UDPOverTCPFrameHeaderSize bytes of space, which are overwritten with the
+// length, followed by the datagram.  The frame is sent in a single Write, which
+// splits it into chunks of at most 0x3FFF bytes of payload if needed.  The
+// reader reassembles it from the length.
+func WriteUDPOverTCPFrame(w io.Writer, frame []byte) error {
+	if len(frame) < UDPOverTCPFrameHeaderSize {
+		return errors.New("frame is missing the header")
+	}
+	datagramLen := len(frame) - UDPOverTCPFrameHeaderSize
+	if datagramLen > 0xffff {
+		return errors.New("datagram is too large")
+	}
+	binary.BigEndian.PutUint16(frame, uint16(datagramLen))
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadUDPOverTCPFrame reads one datagram from `r` into `buf`, and returns the
+// slice of `buf` that holds it.  If the datagram doesn't fit, it is discarded
+// and ReadUDPOverTCPFrame returns io.ErrShortBuffer.
+func ReadUDPOverTCPFrame(r io.Reader, buf []byte) ([]byte, error) {
+	var header [UDPOverTCPFrameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	datagramLen := int(binary.BigEndian.Uint16(header[:]))
+	if datagramLen > len(buf) {
+		// Skip the datagram to stay in sync with the stream.
+		if _, err := io.CopyN(ioutil.Discard, r, int64(datagramLen)); err != nil {
+			return nil, err
+		}
+		return nil, io.ErrShortBuffer
+	}
+	if _, err := io.ReadFull(r, buf[:datagramLen]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf[:datagramLen], nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func makeFrame(datagram []byte) []byte {
+	return append(make([]byte, UDPOverTCPFrameHeaderSize), datagram...)
+}
+
+func TestUDPOverTCPFrames(t *testing.T) {
+	var stream bytes.Buffer
+	require.NoError(t, WriteUDPOverTCPFrame(&stream, makeFrame([]byte("first"))))
+	require.NoError(t, WriteUDPOverTCPFrame(&stream, makeFrame(nil)))
+	require.NoError(t, WriteUDPOverTCPFrame(&stream, makeFrame([]byte("third"))))
+
+	buf := make([]byte, 10)
+	datagram, err := ReadUDPOverTCPFrame(&stream, buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), datagram)
+	datagram, err = ReadUDPOverTCPFrame(&stream, buf)
+	require.NoError(t, err)
+	require.Empty(t, datagram)
+	datagram, err = ReadUDPOverTCPFrame(&stream, buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte("third"), datagram)
+	_, err = ReadUDPOverTCPFrame(&stream, buf)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestUDPOverTCPFrameTooLarge(t *testing.T) {
+	require.Error(t, WriteUDPOverTCPFrame(ioutil.Discard, make([]byte, UDPOverTCPFrameHeaderSize+0x10000)))
+	require.Error(t, WriteUDPOverTCPFrame(ioutil.Discard, nil))
+}
+
+func TestUDPOverTCPFrameShortBuffer(t *testing.T) {
+	var stream bytes.Buffer
+	require.NoError(t, WriteUDPOverTCPFrame(&stream, makeFrame([]byte("too long"))))
+	require.NoError(t, WriteUDPOverTCPFrame(&stream, makeFrame([]byte("short"))))
+
+	buf := make([]byte, 5)
+	_, err := ReadUDPOverTCPFrame(&stream, buf)
+	require.Equal(t, io.ErrShortBuffer, err)
+	// The oversized datagram is skipped.
+	datagram, err := ReadUDPOverTCPFrame(&stream, buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte("short"), datagram)
+}
+
+func TestUDPOverTCPFrameTruncated(t *testing.T) {
+	var stream bytes.Buffer
+	require.NoError(t, WriteUDPOverTCPFrame(&stream, makeFrame([]byte("datagram"))))
+	truncated := bytes.NewReader(stream.Bytes()[:stream.Len()-1])
+	_, err := ReadUDPOverTCPFrame(truncated, make([]byte, 10))
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+}